@@ -0,0 +1,138 @@
+package keychain
+
+import (
+	"github.com/maybetheresloop/keychain/internal/data"
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+// batchOp is a single write in a batch. A nil value marks a delete.
+type batchOp struct {
+	key   []byte
+	value []byte
+}
+
+// Batch is a group of writes that are applied to a store atomically, with Keychain.Write. The
+// zero value is an empty batch that is ready to use.
+type Batch struct {
+	ops []batchOp
+}
+
+// Set adds the insertion of a key-value pair to the batch.
+func (b *Batch) Set(key []byte, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds the removal of a key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all of the writes from the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies all of the writes in the batch to the store, in order. The writes are appended to
+// the log as a single group and synchronized to disk together. If the store is reopened after a
+// crash in the middle of writing the group, then none of its writes are applied.
+func (k *Keychain) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	k.mtx.Lock()
+	seq, err := k.writeBatch(b)
+	k.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return k.waitSync(seq)
+}
+
+// clearBatchSize is the number of keys that Clear removes at a time.
+const clearBatchSize = 1000
+
+// Clear removes every key from the store. The keys are removed in batches, so a crash or a failed
+// write can leave some of them behind, and keys written concurrently may or may not be removed.
+func (k *Keychain) Clear() error {
+	it := k.Scan(nil)
+	defer it.Close()
+
+	var batch Batch
+	for it.Next() {
+		batch.Delete(append([]byte(nil), it.Key()...))
+		if batch.Len() == clearBatchSize {
+			if err := k.Write(&batch); err != nil {
+				return err
+			}
+
+			batch.Reset()
+		}
+	}
+
+	return k.Write(&batch)
+}
+
+// writeBatch appends the writes in a batch to the log and applies them, returning the sequence
+// number of the writes. It must be called with the write lock held.
+func (k *Keychain) writeBatch(b *Batch) (uint64, error) {
+	items := make([]*data.Item, 0, len(b.ops)+1)
+	items = append(items, data.NewBatchMarker(len(b.ops)))
+	for _, op := range b.ops {
+		if op.value == nil {
+			items = append(items, data.NewItemDeleteMarker(op.key))
+		} else {
+			items = append(items, data.NewItem(op.key, op.value))
+		}
+	}
+
+	entries, err := k.append(items...)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := entries[0].Seq
+	for i, op := range b.ops {
+		k.applyEntry(op.key, entries[i+1])
+	}
+
+	return seq, nil
+}
+
+// applyEntry points a key at a newly written entry. If there are transactions in progress, then
+// the replaced entry is kept as the previous version of the key, for as long as their snapshots
+// need it.
+func (k *Keychain) applyEntry(key []byte, newEntry *data.Entry) {
+	v, found := k.entries.Search(key)
+	if found {
+		entry := v.(*data.Entry)
+		k.markDead(key, entry)
+
+		if len(k.txns) > 0 {
+			prev := *entry
+			newEntry.Prev = &prev
+			pruneVersions(newEntry.Prev, k.oldestSnapshot())
+		}
+
+		*entry = *newEntry
+	} else {
+		// The tree keeps the key, so it is copied in case the caller reuses its buffer.
+		k.entries.Insert(append([]byte(nil), key...), art.Value(newEntry))
+	}
+
+	// Delete markers never hold live data.
+	if newEntry.ValueSize == -1 {
+		k.markDead(key, newEntry)
+	}
+}
@@ -0,0 +1,132 @@
+package keychain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	set(keys, []byte("key"), []byte("value"), t)
+	set(keys, []byte("key2"), []byte("value2"), t)
+
+	var b Batch
+	b.Set([]byte("key3"), []byte("value3"))
+	b.Delete([]byte("key"))
+	b.Set([]byte("key2"), []byte("value21"))
+
+	if err := keys.Write(&b); err != nil {
+		t.Fatalf("failed writing batch: %v", err)
+	}
+
+	getAndExpect(keys, []byte("key"), nil, t)
+	getAndExpect(keys, []byte("key2"), []byte("value21"), t)
+	getAndExpect(keys, []byte("key3"), []byte("value3"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	stat, err := os.Stat(segmentPath(name, 0))
+	if err != nil {
+		t.Fatalf("could not stat data file: %v", err)
+	}
+
+	keys, err = Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	getAndExpect(keys, []byte("key"), nil, t)
+	getAndExpect(keys, []byte("key2"), []byte("value21"), t)
+	getAndExpect(keys, []byte("key3"), []byte("value3"), t)
+
+	b.Reset()
+	b.Set([]byte("key4"), []byte("value4"))
+	b.Set([]byte("key2"), []byte("value22"))
+
+	if err := keys.Write(&b); err != nil {
+		t.Fatalf("failed writing batch: %v", err)
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// Cut off the last record of the second batch, as if the process crashed while writing it.
+	if err := os.Truncate(segmentPath(name, 0), stat.Size()+40); err != nil {
+		t.Fatalf("could not truncate data file: %v", err)
+	}
+
+	keys, err = Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+	defer keys.Close()
+
+	if recovered := keys.Recovered(); len(recovered) != 1 || recovered[0].Offset != stat.Size() {
+		t.Fatalf("expected the incomplete batch to be discarded, got=%v", recovered)
+	}
+
+	getAndExpect(keys, []byte("key2"), []byte("value21"), t)
+	getAndExpect(keys, []byte("key4"), nil, t)
+}
+
+func TestClear(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	// More keys than are removed at a time.
+	for i := 0; i < clearBatchSize+10; i++ {
+		set(keys, []byte(fmt.Sprintf("key%d", i)), []byte("value"), t)
+	}
+
+	if err := keys.Clear(); err != nil {
+		t.Fatalf("failed to clear database: %v", err)
+	}
+
+	it := keys.Scan(nil)
+	if it.Next() {
+		t.Fatalf("expected no keys after clearing, got '%s'", it.Key())
+	}
+
+	it.Close()
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys, err = Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	getAndExpect(keys, []byte("key0"), nil, t)
+	getAndExpect(keys, []byte(fmt.Sprintf("key%d", clearBatchSize+9)), nil, t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"errors"
+	"crypto/tls"
 	"net"
 
 	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/server"
 	"github.com/maybetheresloop/keychain/pkg/resp"
 )
 
+// client sends commands to a Keychain server and returns the replies.
 type client interface {
-	Del(keys ...string) (int, error)
-	Set(key string, value string) (interface{}, error)
-	Get(key string) ([]byte, error)
+	Do(args ...string) (resp.Value, error)
 
 	Close() error
 }
@@ -22,92 +22,87 @@ type remoteClient struct {
 	conn net.Conn
 }
 
-func openRemote(addr string) (client, error) {
-
-	conn, err := net.Dial("tcp", addr)
+// openRemote connects to a server. The network is either "tcp" or "unix". If config is not nil,
+// then the connection uses TLS.
+func openRemote(network string, addr string, config *tls.Config) (client, error) {
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 
+	if config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	return newRemoteClient(conn), nil
+}
+
+func newRemoteClient(conn net.Conn) *remoteClient {
 	return &remoteClient{
 		w:    resp.NewWriter(conn),
+		rd:   resp.NewReader(conn),
 		conn: conn,
-	}, nil
-}
-
-func (r *remoteClient) Del(keys ...string) (int, error) {
-	args := make([]interface{}, 0, len(keys)+1)
-	args = append(args, "del")
-	for _, key := range keys {
-		args = append(args, key)
 	}
+}
 
-	if err := r.w.WriteCommand(args...); err != nil {
-		return 0, err
+func (r *remoteClient) Do(args ...string) (resp.Value, error) {
+	cmd := make([]interface{}, len(args))
+	for i, arg := range args {
+		cmd[i] = arg
 	}
 
-	res, err := r.rd.ReadMessage(nil)
-	if err != nil {
-		return 0, err
+	if err := r.w.WriteCommand(cmd...); err != nil {
+		return resp.Value{}, err
 	}
 
-	switch v := res.(type) {
-	case int64:
-		return int(v), nil
-	case resp.RespError:
-		return 0, &v
-	default:
-		return 0, errors.New("unexpected response")
+	if err := r.w.Flush(); err != nil {
+		return resp.Value{}, err
 	}
-}
 
-func (r *remoteClient) Set(key string, value string) (interface{}, error) {
-	return nil, nil
-}
-
-func (r *remoteClient) Get(key string) ([]byte, error) {
-	return nil, nil
+	return r.rd.ReadValue()
 }
 
 func (r *remoteClient) Close() error {
 	return r.conn.Close()
 }
 
+// localClient runs commands against a store that is opened directly instead of through a
+// server. The commands are served in-process over a pipe, so that they behave exactly as they
+// would with a server.
 type localClient struct {
+	*remoteClient
+
 	keys   *keychain.Keychain
+	srv    *server.Server
 	dbName string
 }
 
-func (l *localClient) Del(keys ...string) (int, error) {
-
-	removed := 0
-	for _, key := range keys {
-		ok, err := l.keys.Remove([]byte(key))
-		if err != nil {
-			return removed, err
-		}
-
-		if ok {
-			removed += 1
-		}
-	}
-
-	return removed, nil
-}
-
-func (l *localClient) Set(key string, value string) (interface{}, error) {
-	err := l.keys.Set([]byte(key), []byte(value))
+func openLocal(dbName string) (client, error) {
+	keys, err := keychain.Open(dbName)
 	if err != nil {
 		return nil, err
 	}
 
-	return "OK", nil
-}
+	srv := server.New(keys)
+	clientConn, serverConn := net.Pipe()
+	go srv.ServeConn(serverConn)
 
-func (l *localClient) Get(key string) ([]byte, error) {
-	return l.keys.Get([]byte(key))
+	return &localClient{
+		remoteClient: newRemoteClient(clientConn),
+		keys:         keys,
+		srv:          srv,
+		dbName:       dbName,
+	}, nil
 }
 
 func (l *localClient) Close() error {
+	l.remoteClient.Close()
+	l.srv.Close()
 	return l.keys.Close()
 }
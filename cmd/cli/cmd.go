@@ -1,6 +0,0 @@
-package main
-
-func Del(keys []string) (int, error) {
-
-	return 0, nil
-}
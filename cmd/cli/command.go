@@ -1,7 +1,60 @@
 package main
 
-type Command struct {
-	handler func(c client) (interface{}, error)
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/maybetheresloop/keychain/internal/util"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+)
+
+// formatReply formats a reply the way redis-cli does, with the type of the reply shown alongside
+// its value.
+func formatReply(reply resp.Value) string {
+	return formatReplyIndent(reply, "")
 }
 
-var RunLocal = Command{}
+func formatReplyIndent(reply resp.Value, indent string) string {
+	if reply.IsNull() {
+		return util.Nil
+	}
+
+	switch reply.Type() {
+	case resp.SimpleString:
+		s, _ := reply.AsString()
+		return s
+	case resp.Error:
+		s, _ := reply.AsString()
+		return fmt.Sprintf("%s %s", util.Error, s)
+	case resp.Integer:
+		n, _ := reply.AsInt()
+		return fmt.Sprintf("%s %d", util.Integer, n)
+	case resp.BulkString:
+		s, _ := reply.AsString()
+		return strconv.Quote(s)
+	case resp.Array:
+		elems, _ := reply.AsArray()
+		if len(elems) == 0 {
+			return util.EmptyArray
+		}
+
+		var b strings.Builder
+		width := len(strconv.Itoa(len(elems)))
+		for i, elem := range elems {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			if i > 0 {
+				b.WriteString("\n")
+				b.WriteString(indent)
+			}
+
+			b.WriteString(prefix)
+			b.WriteString(formatReplyIndent(elem, indent+strings.Repeat(" ", len(prefix))))
+		}
+
+		return b.String()
+	default:
+		s, _ := reply.AsString()
+		return s
+	}
+}
@@ -2,83 +2,88 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
-	"github.com/maybetheresloop/keychain"
-
+	keychainclient "github.com/maybetheresloop/keychain/pkg/client"
+	"github.com/maybetheresloop/keychain/pkg/resp"
 	"github.com/urfave/cli"
 )
 
-func prompt(sc *bufio.Scanner, addr string) bool {
-	fmt.Printf("%s> ", addr)
-	return sc.Scan()
-}
+// runCmd runs a single command and prints its reply. It returns true if the reply is an error.
+func runCmd(c client, args []string) (bool, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return false, err
+	}
 
-func runCmd(c client, cmd string, tail []string) error {
-	switch strings.ToLower(cmd) {
-	case "set":
-		res, err := c.Set(tail[0], tail[1])
-		if err != nil {
-			return err
-		}
+	fmt.Println(formatReply(reply))
 
-		switch v := res.(type) {
-		case string:
-			fmt.Printf("%s\n", v)
-		case []byte:
-			fmt.Println("(nil)")
-		default:
-			panic("unexpected")
-		}
-	case "get":
-		res, err := c.Get(tail[0])
-		if err != nil {
-			return err
-		}
+	return reply.Type() == resp.Error, nil
+}
 
-		if res == nil {
-			fmt.Println("(nil)")
-		} else {
-			fmt.Printf("%s\n", res)
-		}
-	case "del":
-		res, err := c.Del(tail...)
-		if err != nil {
-			return err
-		}
+// tlsConfig returns the TLS configuration selected by the command line flags, or nil if TLS is
+// not enabled.
+func tlsConfig(ctx *cli.Context) (*tls.Config, error) {
+	if !ctx.Bool("tls") {
+		return nil, nil
+	}
 
-		fmt.Println(res)
+	config, err := keychainclient.TLSConfig(ctx.String("cacert"), ctx.String("cert"), ctx.String("key"))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	config.ServerName = ctx.String("host")
+	return config, nil
 }
 
 func run(ctx *cli.Context) error {
 	var (
 		c    client
 		name string
+		err  error
 	)
 
-	if name = "keychain.db"; name != "" {
-		keys, err := keychain.Open(name)
+	config, err := tlsConfig(ctx)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	switch {
+	case ctx.String("file") != "":
+		name = ctx.String("file")
+		c, err = openLocal(name)
+	case ctx.String("socket") != "":
+		name = ctx.String("socket")
+		c, err = openRemote("unix", name, config)
+	default:
+		name = net.JoinHostPort(ctx.String("host"), strconv.FormatUint(uint64(ctx.Uint("port")), 10))
+		c, err = openRemote("tcp", name, config)
+	}
+
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer c.Close()
+
+	if ctx.NArg() > 0 {
+		isErr, err := runCmd(c, ctx.Args())
 		if err != nil {
-			return err
+			return cli.NewExitError(err, 1)
 		}
-		defer keys.Close()
 
-		c = &localClient{
-			keys:   keys,
-			dbName: name,
+		// Error replies have already been printed, but still make the command fail.
+		if isErr {
+			return cli.NewExitError("", 1)
 		}
-	} else {
-		name = fmt.Sprintf("%s:%d", ctx.String("host"), ctx.Uint("port"))
-	}
 
-	if ctx.NArg() > 0 {
-		return runCmd(c, ctx.Args().First(), ctx.Args().Tail())
+		return nil
 	}
 
 	return runCli(c, name)
@@ -94,21 +99,39 @@ func runCli(c client, name string) error {
 	}
 
 	for prompt(sc) {
-		line := sc.Text()
+		split, err := resp.SplitArgs(sc.Bytes())
+		if err != nil {
+			fmt.Printf("Invalid argument(s): %v\n", err)
+			continue
+		}
+
+		args := make([]string, len(split))
+		for i, arg := range split {
+			args[i] = string(arg)
+		}
 
-		parts := strings.Split(line, " ")
-		if err := runCmd(c, parts[0], parts[1:]); err != nil {
-			return err
+		if len(args) == 0 {
+			continue
+		}
+
+		if _, err := runCmd(c, args); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+
+		if cmd := strings.ToLower(args[0]); cmd == "quit" || cmd == "exit" {
+			return nil
 		}
 	}
 
-	return nil
+	return sc.Err()
 }
 
 func main() {
 
 	app := cli.NewApp()
 	app.Name = "keychain-cli"
+	app.Usage = "Run commands against a Keychain server, or a local database."
+	app.UsageText = "keychain-cli [global options] [command [arguments...]]"
 	app.Email = "maybetheresloop@gmail.com"
 	app.Author = "maybetheresloop"
 	app.Version = "0.1.0"
@@ -124,6 +147,34 @@ func main() {
 			Usage: "The PORT to connect to",
 			Value: 7878,
 		},
+		cli.StringFlag{
+			Name:  "socket, s",
+			Usage: "The PATH of a unix socket to connect to, instead of the host and port",
+		},
+		cli.StringFlag{
+			Name:      "file, f",
+			Usage:     "The database DIRECTORY to open directly, instead of connecting to a server",
+			TakesFile: true,
+		},
+		cli.BoolFlag{
+			Name:  "tls",
+			Usage: "Connect to the server with TLS",
+		},
+		cli.StringFlag{
+			Name:      "cacert",
+			Usage:     "The CA certificate FILE used to verify the server, instead of the system CAs",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "cert",
+			Usage:     "The client certificate FILE to authenticate with",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "key",
+			Usage:     "The private key FILE of the client certificate",
+			TakesFile: true,
+		},
 	}
 
 	app.Action = run
@@ -1 +1,61 @@
 package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatReply(t *testing.T) {
+	tests := []struct {
+		reply    resp.Value
+		expected string
+	}{
+		{resp.SimpleStringValue("OK"), "OK"},
+		{resp.ErrorValue("ERR syntax error"), "(error) ERR syntax error"},
+		{resp.IntegerValue(3), "(integer) 3"},
+		{resp.BulkStringValue([]byte("bar")), `"bar"`},
+		{resp.NullBulkStringValue(), "(nil)"},
+		{resp.NullArrayValue(), "(nil)"},
+		{resp.ArrayValue(), "(empty array)"},
+		{resp.ArrayValue(
+			resp.BulkStringValue([]byte("a")),
+			resp.IntegerValue(1),
+			resp.ArrayValue(resp.SimpleStringValue("x"), resp.SimpleStringValue("y")),
+		), "1) \"a\"\n2) (integer) 1\n3) 1) x\n   2) y"},
+	}
+
+	for i, tt := range tests {
+		assert.Equal(t, tt.expected, formatReply(tt.reply), "tests[%d]", i)
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	c, err := openLocal(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer c.Close()
+
+	reply, err := c.Do("SET", "foo", "bar")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.SimpleStringValue("OK"), reply)
+
+	reply, err = c.Do("GET", "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.BulkStringValue([]byte("bar")), reply)
+
+	reply, err = c.Do("DEL", "foo", "baz")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.IntegerValue(1), reply)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+)
+
+// command describes how the proxy runs a command.
+type command struct {
+	// arity is the number of arguments the command takes, including its name. A negative arity
+	// means that the command takes at least -arity arguments.
+	arity int
+
+	// admin is set for commands that change the backends, which take the lock themselves instead
+	// of running with it held for reading.
+	admin bool
+
+	// writes returns the keys that the command writes, and is nil for commands that do not write.
+	writes func(args [][]byte) [][]byte
+
+	// restricted reports whether the command may only be run by connections that have
+	// authenticated, and is nil for commands that any connection may run.
+	restricted func(args [][]byte) bool
+
+	handler func(p *Proxy, args [][]byte) resp.Value
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"ping":    {arity: -1, handler: ping},
+		"echo":    {arity: 2, handler: echo},
+		"get":     {arity: 2, handler: forward},
+		"set":     {arity: -3, writes: firstKey, handler: forward},
+		"expire":  {arity: 3, writes: firstKey, handler: forward},
+		"ttl":     {arity: 2, handler: forward},
+		"pttl":    {arity: 2, handler: forward},
+		"persist": {arity: 2, writes: firstKey, handler: forward},
+		"del":     {arity: -2, writes: allKeys, handler: sum},
+		"exists":  {arity: -2, handler: sum},
+		"mget":    {arity: -2, handler: mget},
+		"keys":    {arity: 2, handler: keys},
+		"proxy":   {arity: -2, admin: true, restricted: addsNode, handler: proxy},
+	}
+}
+
+// firstKey returns the key of a command whose only key is its first argument.
+func firstKey(args [][]byte) [][]byte {
+	return args[1:2]
+}
+
+// allKeys returns the keys of a command whose arguments are all keys.
+func allKeys(args [][]byte) [][]byte {
+	return args[1:]
+}
+
+// addsNode reports whether a PROXY command adds a backend.
+func addsNode(args [][]byte) bool {
+	return strings.EqualFold(string(args[1]), "addnode")
+}
+
+// toArgs converts the arguments of a command for a client of a backend.
+func toArgs(args [][]byte) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		out[i] = arg
+	}
+
+	return out
+}
+
+// ping handles PING [message], which is answered by the proxy itself.
+func ping(p *Proxy, args [][]byte) resp.Value {
+	switch len(args) {
+	case 1:
+		return resp.SimpleStringValue("PONG")
+	case 2:
+		return resp.BulkStringValue(args[1])
+	default:
+		return resp.ErrorValue("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echo(p *Proxy, args [][]byte) resp.Value {
+	return resp.BulkStringValue(args[1])
+}
+
+// forward sends a command whose only key is its first argument to the backend of the key.
+func forward(p *Proxy, args [][]byte) resp.Value {
+	return p.do(p.ring.lookup(args[1]), toArgs(args))
+}
+
+// shard is the part of a command on several keys that is sent to one backend.
+type shard struct {
+	node string
+
+	// args are the arguments sent to the backend, and indexes are the positions of its keys in
+	// the original command, counting from the first key.
+	args    []interface{}
+	indexes []int
+
+	reply resp.Value
+}
+
+// split splits a command whose arguments are all keys between the backends of the keys. The
+// keys keep their order within each shard.
+func (p *Proxy) split(args [][]byte) []*shard {
+	var shards []*shard
+	byNode := make(map[string]*shard)
+	for i, key := range args[1:] {
+		node := p.ring.lookup(key)
+		s, ok := byNode[node]
+		if !ok {
+			s = &shard{node: node, args: []interface{}{args[0]}}
+			byNode[node] = s
+			shards = append(shards, s)
+		}
+
+		s.args = append(s.args, key)
+		s.indexes = append(s.indexes, i)
+	}
+
+	return shards
+}
+
+// doShards sends the shards of a command to their backends concurrently, and returns the first
+// error reply, if any.
+func (p *Proxy) doShards(shards []*shard) (resp.Value, bool) {
+	var wg sync.WaitGroup
+	for _, s := range shards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			s.reply = p.do(s.node, s.args)
+		}(s)
+	}
+
+	wg.Wait()
+
+	for _, s := range shards {
+		if s.reply.Type() == resp.Error {
+			return s.reply, false
+		}
+	}
+
+	return resp.Value{}, true
+}
+
+// sum handles commands on several keys that reply with a count, such as DEL and EXISTS, by adding
+// up the counts of the backends.
+func sum(p *Proxy, args [][]byte) resp.Value {
+	shards := p.split(args)
+	if errReply, ok := p.doShards(shards); !ok {
+		return errReply
+	}
+
+	var total int64
+	for _, s := range shards {
+		n, err := s.reply.AsInt()
+		if err != nil {
+			return resp.ErrorValue("ERR backend " + s.node + ": " + err.Error())
+		}
+
+		total += n
+	}
+
+	return resp.IntegerValue(total)
+}
+
+// mget handles MGET key [key ...], putting the values from the backends back in the order of the
+// keys.
+func mget(p *Proxy, args [][]byte) resp.Value {
+	shards := p.split(args)
+	if errReply, ok := p.doShards(shards); !ok {
+		return errReply
+	}
+
+	values := make([]resp.Value, len(args)-1)
+	for _, s := range shards {
+		elems, err := s.reply.AsArray()
+		if err == nil && len(elems) != len(s.indexes) {
+			err = errUnexpectedReply
+		}
+
+		if err != nil {
+			return resp.ErrorValue("ERR backend " + s.node + ": " + err.Error())
+		}
+
+		for i, elem := range elems {
+			values[s.indexes[i]] = elem
+		}
+	}
+
+	return resp.ArrayValue(values...)
+}
+
+// keys handles KEYS pattern, combining the keys of every backend.
+func keys(p *Proxy, args [][]byte) resp.Value {
+	shards := make([]*shard, 0, len(p.ring.nodes))
+	for _, node := range p.ring.nodes {
+		shards = append(shards, &shard{node: node, args: toArgs(args)})
+	}
+
+	if errReply, ok := p.doShards(shards); !ok {
+		return errReply
+	}
+
+	var all []resp.Value
+	for _, s := range shards {
+		elems, err := s.reply.AsArray()
+		if err != nil {
+			return resp.ErrorValue("ERR backend " + s.node + ": " + err.Error())
+		}
+
+		all = append(all, elems...)
+	}
+
+	return resp.ArrayValue(all...)
+}
+
+// proxy handles PROXY NODES, which lists the backends, and PROXY ADDNODE host:port, which adds a
+// backend and moves the keys that belong to it, replying with the number of keys moved.
+func proxy(p *Proxy, args [][]byte) resp.Value {
+	switch sub := strings.ToLower(string(args[1])); {
+	case sub == "nodes" && len(args) == 2:
+		nodes := p.Nodes()
+		elems := make([]resp.Value, len(nodes))
+		for i, node := range nodes {
+			elems[i] = resp.BulkStringValue([]byte(node))
+		}
+
+		return resp.ArrayValue(elems...)
+	case sub == "addnode" && len(args) == 3:
+		n, err := p.AddNode(string(args[2]))
+		if err != nil {
+			return resp.ErrorValue("ERR " + err.Error())
+		}
+
+		return resp.IntegerValue(int64(n))
+	case sub == "nodes" || sub == "addnode":
+		return resp.ErrorValue("ERR wrong number of arguments for 'proxy|" + sub + "' command")
+	default:
+		return resp.ErrorValue("ERR unknown subcommand '" + string(args[1]) + "'")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/maybetheresloop/keychain/pkg/client"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const DefaultPort = 7879
+
+// parseBackends parses a comma-separated list of backend addresses, given as host:port.
+func parseBackends(s string) ([]string, error) {
+	var backends []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		if _, port, err := net.SplitHostPort(field); err != nil {
+			return nil, fmt.Errorf("invalid backend '%s', expected host:port", field)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid backend port '%s'", port)
+		}
+
+		backends = append(backends, field)
+	}
+
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+
+	return backends, nil
+}
+
+func run(c *cli.Context) error {
+	backends, err := parseBackends(c.String("backends"))
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(c.String("bind"), strconv.FormatUint(uint64(c.Uint("port")), 10))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	p := New(backends, c.Int("vnodes"), &client.Options{
+		PoolSize:   c.Int("pool-size"),
+		MaxRetries: 1,
+		Username:   c.String("backend-user"),
+		Password:   c.String("backend-pass"),
+	})
+	p.SetPassword(c.String("requirepass"))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Infof("Starting proxy on %s for backends %s...", lis.Addr(), strings.Join(backends, ", "))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Serve(lis)
+	}()
+
+	select {
+	case sig := <-sigs:
+		log.Infof("Received %s, shutting down...", sig)
+	case err = <-errs:
+		log.Errorf("error serving connections: %v", err)
+	}
+
+	p.Close()
+	return err
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "keychain-proxy"
+	app.Usage = "Shard keys across several Keychain servers."
+	app.Version = "0.1.0"
+	app.Action = run
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "bind, b",
+			Usage: "The ADDRESS to listen on for TCP connections, or all addresses if empty",
+		},
+		cli.UintFlag{
+			Name:  "port, p",
+			Usage: "The PORT to listen on for TCP connections",
+			Value: DefaultPort,
+		},
+		cli.StringFlag{
+			Name:     "backends",
+			Required: true,
+			Usage:    "The SERVERS to shard keys across, as a comma-separated list of host:port",
+		},
+		cli.IntFlag{
+			Name:  "vnodes",
+			Usage: "The NUMBER of points that each server has on the hash ring",
+			Value: DefaultVirtualNodes,
+		},
+		cli.IntFlag{
+			Name:  "pool-size",
+			Usage: "The maximum NUMBER of connections to each server",
+			Value: client.DefaultPoolSize,
+		},
+		cli.StringFlag{
+			Name:   "requirepass",
+			Usage:  "The PASSWORD that clients must authenticate with, which is also required to add servers",
+			EnvVar: "KEYCHAIN_REQUIREPASS",
+		},
+		cli.StringFlag{
+			Name:  "backend-user",
+			Usage: "The USER to authenticate with to the servers, or the default user if empty",
+		},
+		cli.StringFlag{
+			Name:   "backend-pass",
+			Usage:  "The PASSWORD to authenticate with to the servers",
+			EnvVar: "KEYCHAIN_BACKEND_PASS",
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Info(err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maybetheresloop/keychain/pkg/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateBatchSize is the number of keys removed from a backend at a time once they have been
+// moved.
+const migrateBatchSize = 1000
+
+var errUnexpectedReply = errors.New("unexpected reply")
+
+// migration records the keys that are written through the proxy while keys are being copied to a
+// new backend, so that they can be copied again before the backend is added to the ring.
+type migration struct {
+	// next is the ring with the new backend, to.
+	next *ring
+	to   string
+
+	mtx   sync.Mutex
+	dirty map[string]struct{}
+}
+
+// record marks the keys that belong to the new backend as written.
+func (m *migration) record(keys [][]byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key := range keys {
+		if m.next.lookup(key) == m.to {
+			m.dirty[string(key)] = struct{}{}
+		}
+	}
+}
+
+// AddNode adds a backend, given as host:port, and moves the keys of the other backends that now
+// belong to it, returning the number of keys moved.
+//
+// Keys are copied to the new backend while commands keep running, and the keys written meanwhile
+// are copied again with commands held off, before the backend is added to the ring. Keys are only
+// removed from their old backends afterwards, so that if copying fails, then every key is still
+// where it was.
+func (p *Proxy) AddNode(addr string) (int, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return 0, fmt.Errorf("invalid backend address '%s'", addr)
+	}
+
+	p.addMtx.Lock()
+	defer p.addMtx.Unlock()
+
+	if p.ring.has(addr) {
+		return 0, fmt.Errorf("backend %s already exists", addr)
+	}
+
+	ctx := context.Background()
+	target := p.newClient(addr)
+	if err := target.Ping(ctx); err != nil {
+		target.Close()
+		return 0, fmt.Errorf("backend %s: %v", addr, err)
+	}
+
+	m := &migration{next: p.ring.add(addr), to: addr, dirty: make(map[string]struct{})}
+
+	p.mtx.Lock()
+	p.migration = m
+	p.mtx.Unlock()
+
+	// moved holds the keys copied to the new backend, along with the backends they are moved from.
+	moved := make(map[string]string)
+	err := p.copyKeys(ctx, m, target, moved)
+
+	p.mtx.Lock()
+	p.migration = nil
+	if err == nil {
+		err = p.copyDirty(ctx, m, target, moved)
+	}
+
+	if err == nil {
+		p.ring = m.next
+		p.backends[addr] = target
+	}
+	p.mtx.Unlock()
+
+	byNode := make(map[string][][]byte)
+	for key, node := range moved {
+		byNode[node] = append(byNode[node], []byte(key))
+	}
+
+	if err != nil {
+		// The keys are still on their old backends, so the copies are removed.
+		var keys [][]byte
+		for _, nodeKeys := range byNode {
+			keys = append(keys, nodeKeys...)
+		}
+
+		if err := deleteKeys(ctx, target, keys); err != nil {
+			log.Errorf("error removing copied keys from %s: %v", addr, err)
+		}
+
+		target.Close()
+		return 0, err
+	}
+
+	// The keys left behind on failure can no longer be reached through the proxy, so they are
+	// only logged.
+	for node, keys := range byNode {
+		if err := deleteKeys(ctx, p.backends[node], keys); err != nil {
+			log.Errorf("error removing moved keys from %s: %v", node, err)
+		}
+	}
+
+	log.Infof("Added backend %s, moved %d keys", addr, len(moved))
+	return len(moved), nil
+}
+
+// copyKeys copies the keys of the backends that belong to the new backend to it, without the lock
+// held. It must be called with addMtx held.
+func (p *Proxy) copyKeys(ctx context.Context, m *migration, target *client.Client, moved map[string]string) error {
+	for _, node := range p.ring.nodes {
+		keys, err := movingKeys(ctx, p.backends[node], m.next, m.to)
+		if err != nil {
+			return fmt.Errorf("backend %s: %v", node, err)
+		}
+
+		for _, key := range keys {
+			ok, err := copyKey(ctx, p.backends[node], target, key)
+			if err != nil {
+				return fmt.Errorf("moving '%s' from %s: %v", key, node, err)
+			}
+
+			if ok {
+				moved[string(key)] = node
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyDirty copies the keys that were written while they were being copied again, and removes
+// those that no longer exist from the new backend. It must be called with the lock held.
+func (p *Proxy) copyDirty(ctx context.Context, m *migration, target *client.Client, moved map[string]string) error {
+	var gone [][]byte
+	for key := range m.dirty {
+		node := p.ring.lookup([]byte(key))
+		ok, err := copyKey(ctx, p.backends[node], target, []byte(key))
+		if err != nil {
+			return fmt.Errorf("moving '%s' from %s: %v", key, node, err)
+		}
+
+		if ok {
+			moved[key] = node
+		} else {
+			delete(moved, key)
+			gone = append(gone, []byte(key))
+		}
+	}
+
+	if err := deleteKeys(ctx, target, gone); err != nil {
+		return fmt.Errorf("backend %s: %v", m.to, err)
+	}
+
+	return nil
+}
+
+// movingKeys returns the keys of a backend that belong to another backend on the next ring.
+func movingKeys(ctx context.Context, c *client.Client, next *ring, to string) ([][]byte, error) {
+	reply, err := c.Do(ctx, "KEYS", "*")
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := reply.AsArray()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, elem := range elems {
+		key, err := elem.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		if next.lookup(key) == to {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// copyKey copies a key, along with its expiry, from one backend to another. Returns false if the
+// key no longer exists, for example because it has expired.
+func copyKey(ctx context.Context, from *client.Client, to *client.Client, key []byte) (bool, error) {
+	value, err := from.Get(ctx, key)
+	if err != nil || value == nil {
+		return false, err
+	}
+
+	reply, err := from.Do(ctx, "PTTL", key)
+	if err != nil {
+		return false, err
+	}
+
+	ms, err := reply.AsInt()
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case ms == -1:
+		err = to.Set(ctx, key, value)
+	case ms > 0:
+		err = to.SetWithTTL(ctx, key, value, time.Duration(ms)*time.Millisecond)
+	default:
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// deleteKeys removes keys from a backend, migrateBatchSize keys at a time.
+func deleteKeys(ctx context.Context, c *client.Client, keys [][]byte) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+
+		if _, err := c.Del(ctx, batch...); err != nil {
+			return err
+		}
+
+		keys = keys[len(batch):]
+	}
+
+	return nil
+}
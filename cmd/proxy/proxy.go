@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/maybetheresloop/keychain/pkg/client"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrProxyClosed is returned by Serve once the proxy has been closed.
+var ErrProxyClosed = errors.New("proxy: proxy closed")
+
+// Proxy is a RESP server that shards keys across a set of Keychain servers, called backends.
+// Each key belongs to one backend, chosen by a consistent hash ring, and commands on several keys
+// are split between the backends that the keys belong to.
+type Proxy struct {
+	// mtx is held for reading while commands run, and for writing while a backend is added to
+	// the ring, so that commands never see a key that is being moved between backends.
+	mtx      sync.RWMutex
+	ring     *ring
+	backends map[string]*client.Client
+
+	// addMtx serializes adding backends. The ring and the backends only change while it is held,
+	// so they can be read without mtx by whoever holds it.
+	addMtx sync.Mutex
+
+	// migration records the keys written while a backend is being added, if one is.
+	migration *migration
+
+	// opts are the options of the clients of the backends, without an address.
+	opts client.Options
+
+	// password is the password that clients must authenticate with, if it is not empty.
+	password string
+
+	connMtx   sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a proxy for the specified backends, given as host:port, each of which is placed on
+// the hash ring at vnodes points. The clients of the backends use the specified options, apart
+// from the address.
+func New(backends []string, vnodes int, opts *client.Options) *Proxy {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	p := &Proxy{
+		ring:      newRing(vnodes),
+		backends:  make(map[string]*client.Client),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	if opts != nil {
+		p.opts = *opts
+	}
+
+	for _, addr := range backends {
+		if _, ok := p.backends[addr]; !ok {
+			p.ring = p.ring.add(addr)
+			p.backends[addr] = p.newClient(addr)
+		}
+	}
+
+	return p
+}
+
+// SetPassword sets the password that clients must authenticate with using AUTH before running
+// commands. Adding backends is only allowed once a client has authenticated, so it is refused
+// unless a password is set. It must be called before Serve.
+func (p *Proxy) SetPassword(password string) {
+	p.password = password
+}
+
+// newClient returns a client for a backend.
+func (p *Proxy) newClient(addr string) *client.Client {
+	opts := p.opts
+	opts.Addr = addr
+	return client.New(&opts)
+}
+
+// Nodes returns the addresses of the backends, in order.
+func (p *Proxy) Nodes() []string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	nodes := append([]string(nil), p.ring.nodes...)
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Serve accepts connections on the listener and serves each of them in its own goroutine, until
+// the listener fails or the proxy is closed.
+func (p *Proxy) Serve(lis net.Listener) error {
+	p.connMtx.Lock()
+	if p.closed {
+		p.connMtx.Unlock()
+		lis.Close()
+		return ErrProxyClosed
+	}
+
+	p.listeners[lis] = struct{}{}
+	p.connMtx.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			p.connMtx.Lock()
+			closed := p.closed
+			delete(p.listeners, lis)
+			p.connMtx.Unlock()
+
+			if closed {
+				return ErrProxyClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("error accepting connection: %v", err)
+				p.connMtx.Lock()
+				p.listeners[lis] = struct{}{}
+				p.connMtx.Unlock()
+				continue
+			}
+
+			lis.Close()
+			return err
+		}
+
+		if !p.track(conn) {
+			conn.Close()
+			return ErrProxyClosed
+		}
+
+		go func() {
+			defer p.untrack(conn)
+			p.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the open connections and waits for them to finish,
+// and then closes the clients of the backends.
+func (p *Proxy) Close() error {
+	p.connMtx.Lock()
+	p.closed = true
+
+	var firstErr error
+	for lis := range p.listeners {
+		if err := lis.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for conn := range p.conns {
+		conn.Close()
+	}
+
+	p.connMtx.Unlock()
+	p.wg.Wait()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, c := range p.backends {
+		c.Close()
+	}
+
+	return firstErr
+}
+
+// track adds a connection to the set of open connections, unless the proxy is closed.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.connMtx.Lock()
+	defer p.connMtx.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+	return true
+}
+
+// untrack removes a connection from the set of open connections.
+func (p *Proxy) untrack(conn net.Conn) {
+	p.connMtx.Lock()
+	delete(p.conns, conn)
+	p.connMtx.Unlock()
+
+	p.wg.Done()
+}
+
+// serveConn reads commands from a client connection and answers them until the client
+// disconnects. As with the server, pipelined commands are answered in order, and the replies are
+// flushed once there are no more commands to read.
+func (p *Proxy) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := resp.NewReader(conn)
+	w := resp.NewWriter(conn)
+
+	// authed is set once the connection has authenticated with the password of the proxy.
+	var authed bool
+
+	for {
+		if !r.HasMessage() {
+			if err := w.Flush(); err != nil {
+				log.Errorf("error writing reply to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+
+		v, err := r.ReadValue()
+		if err != nil {
+			if err != io.EOF {
+				w.WriteError(resp.NewRespError("ERR Protocol error: " + err.Error()))
+				w.Flush()
+			}
+
+			return
+		}
+
+		if v.Type() == resp.Array && v.IsNull() {
+			continue
+		}
+
+		args, ok := commandArgs(v)
+		if !ok {
+			w.WriteError(resp.NewRespError("ERR Protocol error: expected an array of bulk strings"))
+			continue
+		}
+
+		var name string
+		if len(args) > 0 {
+			name = strings.ToLower(string(args[0]))
+		}
+
+		var reply resp.Value
+		switch {
+		case name == "quit":
+			w.WriteSimpleString("OK")
+			if err := w.Flush(); err != nil {
+				log.Errorf("error writing reply to %s: %v", conn.RemoteAddr(), err)
+			}
+
+			return
+		case name == "auth":
+			reply = p.auth(args, &authed)
+		case p.password != "" && !authed:
+			reply = resp.ErrorValue("NOAUTH Authentication required.")
+		default:
+			reply = p.execute(args, authed)
+		}
+
+		if err := w.WriteValue(reply); err != nil {
+			log.Errorf("error writing reply to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// auth handles AUTH [username] password, which authenticates a connection with the password of
+// the proxy. The only username is that of the default user.
+func (p *Proxy) auth(args [][]byte, authed *bool) resp.Value {
+	if len(args) < 2 || len(args) > 3 {
+		return resp.ErrorValue("ERR wrong number of arguments for 'auth' command")
+	}
+
+	if p.password == "" {
+		return resp.ErrorValue("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	name, password := "default", args[1]
+	if len(args) == 3 {
+		name, password = string(args[1]), args[2]
+	}
+
+	if name != "default" || subtle.ConstantTimeCompare(password, []byte(p.password)) != 1 {
+		return resp.ErrorValue("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+
+	*authed = true
+	return resp.SimpleStringValue("OK")
+}
+
+// commandArgs returns the arguments of a command, which is sent as an array of bulk strings.
+func commandArgs(v resp.Value) ([][]byte, bool) {
+	if v.Type() != resp.Array {
+		return nil, false
+	}
+
+	elems, _ := v.AsArray()
+	args := make([][]byte, 0, len(elems))
+	for _, elem := range elems {
+		if elem.Type() != resp.BulkString || elem.IsNull() {
+			return nil, false
+		}
+
+		arg, _ := elem.AsBytes()
+		args = append(args, arg)
+	}
+
+	return args, true
+}
+
+// execute runs a command for a connection, which may have authenticated, and returns its reply.
+func (p *Proxy) execute(args [][]byte, authed bool) resp.Value {
+	if len(args) == 0 {
+		return resp.ErrorValue("ERR empty command")
+	}
+
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		return resp.ErrorValue("ERR unknown command '" + string(args[0]) + "'")
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return resp.ErrorValue("ERR wrong number of arguments for '" + name + "' command")
+	}
+
+	if cmd.restricted != nil && cmd.restricted(args) && !authed {
+		return resp.ErrorValue("NOPERM this command requires an authenticated connection, and no password is set with --requirepass")
+	}
+
+	if !cmd.admin {
+		p.mtx.RLock()
+		defer p.mtx.RUnlock()
+
+		if p.migration != nil && cmd.writes != nil {
+			p.migration.record(cmd.writes(args))
+		}
+	}
+
+	return cmd.handler(p, args)
+}
+
+// do sends a command to a backend. Errors replies are returned as they are, and other errors,
+// such as a backend that is unreachable, are returned as error replies naming the backend. It
+// must be called with the lock held.
+func (p *Proxy) do(node string, args []interface{}) resp.Value {
+	reply, err := p.backends[node].Do(context.Background(), args...)
+	if err != nil {
+		if e, ok := err.(client.Error); ok {
+			return resp.ErrorValue(string(e))
+		}
+
+		return resp.ErrorValue("ERR backend " + node + ": " + err.Error())
+	}
+
+	return reply
+}
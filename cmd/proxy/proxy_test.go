@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/server"
+	"github.com/maybetheresloop/keychain/pkg/client"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// backend is a Keychain server started for a test.
+type backend struct {
+	addr string
+	keys *keychain.Keychain
+	stop func()
+}
+
+// startBackend starts a server for a new store on a random local port.
+func startBackend(t *testing.T) *backend {
+	return startBackendConf(t, nil)
+}
+
+// startBackendConf is like startBackend, but uses the specified configuration for the server.
+func startBackendConf(t *testing.T, conf *server.Conf) *backend {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	keys, err := keychain.Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	srv := server.NewConf(keys, conf)
+	go srv.Serve(lis)
+
+	return &backend{addr: lis.Addr().String(), keys: keys, stop: func() {
+		srv.Close()
+		keys.Close()
+		os.RemoveAll(name)
+	}}
+}
+
+// numKeys returns the number of keys in a store.
+func numKeys(keys *keychain.Keychain) int {
+	it := keys.Scan(nil)
+	defer it.Close()
+
+	return it.Len()
+}
+
+// startProxy starts a proxy for the backends on a random local port, returning a client for it
+// and a function that shuts it down.
+func startProxy(t *testing.T, backends ...*backend) (*Proxy, *client.Client, func()) {
+	return startProxyOpts(t, nil, backends...)
+}
+
+// startProxyOpts is like startProxy, but the clients of the backends use the specified options.
+func startProxyOpts(t *testing.T, opts *client.Options, backends ...*backend) (*Proxy, *client.Client, func()) {
+	return startProxyPass(t, "", opts, backends...)
+}
+
+// startProxyPass is like startProxyOpts, but the proxy requires the specified password, which its
+// client authenticates with.
+func startProxyPass(t *testing.T, password string, opts *client.Options, backends ...*backend) (*Proxy, *client.Client, func()) {
+	var addrs []string
+	for _, b := range backends {
+		addrs = append(addrs, b.addr)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	p := New(addrs, 0, opts)
+	p.SetPassword(password)
+	go p.Serve(lis)
+
+	c := client.New(&client.Options{Addr: lis.Addr().String(), Password: password})
+	return p, c, func() {
+		c.Close()
+		p.Close()
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(DefaultVirtualNodes, "a:1", "b:1", "c:1")
+
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[r.lookup([]byte("key:"+strconv.Itoa(i)))]++
+	}
+
+	for node, n := range counts {
+		assert.True(t, n > 6000 && n < 14000, "%s owns %d of 30000 keys", node, n)
+	}
+
+	// The owner of a key does not depend on the order in which the backends were added.
+	assert.Equal(t, r.points, newRing(DefaultVirtualNodes, "c:1", "a:1", "b:1").points)
+
+	// Adding a backend only moves keys to it.
+	next := r.add("d:1")
+	moved := 0
+	for i := 0; i < 30000; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		if owner := next.lookup(key); owner != r.lookup(key) {
+			assert.Equal(t, "d:1", owner)
+			moved++
+		}
+	}
+
+	assert.True(t, moved > 4000 && moved < 11000, "moved %d of 30000 keys", moved)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, r.nodes)
+	assert.Equal(t, next, next.add("d:1"))
+
+	// Keys with the same hash tag belong to the same backend.
+	assert.Equal(t, []byte("user:1"), hashTag([]byte("{user:1}:name")))
+	assert.Equal(t, []byte("{}:name"), hashTag([]byte("{}:name")))
+	assert.Equal(t, []byte("{user"), hashTag([]byte("{user")))
+	for i := 0; i < 100; i++ {
+		tag := "{user:" + strconv.Itoa(i) + "}"
+		assert.Equal(t, r.lookup([]byte(tag+":name")), r.lookup([]byte(tag+":email")))
+	}
+
+	assert.Equal(t, "", newRing(DefaultVirtualNodes).lookup([]byte("foo")))
+}
+
+func TestProxy(t *testing.T) {
+	backends := []*backend{startBackend(t), startBackend(t), startBackend(t)}
+	for _, b := range backends {
+		defer b.stop()
+	}
+
+	p, c, stop := startProxy(t, backends...)
+	defer stop()
+
+	ctx := context.Background()
+	do := func(args ...interface{}) (resp.Value, error) {
+		return c.Do(ctx, args...)
+	}
+
+	reply, err := do("PING")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.SimpleStringValue("PONG"), reply)
+
+	const n = 100
+	var keys []interface{}
+	for i := 0; i < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		keys = append(keys, key)
+		assert.Nil(t, c.Set(ctx, []byte(key), []byte("value:"+strconv.Itoa(i))))
+	}
+
+	// Every key is stored on the backend that it belongs to, and only there.
+	for i := 0; i < n; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		owner := p.ring.lookup(key)
+		for _, b := range backends {
+			assert.Equal(t, b.addr == owner, b.keys.Has(key), "key %s on %s", key, b.addr)
+		}
+	}
+
+	for _, b := range backends {
+		assert.True(t, numKeys(b.keys) > 0, "no keys on %s", b.addr)
+	}
+
+	value, err := c.Get(ctx, []byte("key:7"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value:7"), value)
+
+	// MGET puts the values back in the order of the keys.
+	reply, err = do("MGET", "key:3", "missing", "key:42", "key:3", "key:99")
+	assert.Nil(t, err)
+	assert.Equal(t, resp.ArrayValue(
+		resp.BulkStringValue([]byte("value:3")),
+		resp.NullBulkStringValue(),
+		resp.BulkStringValue([]byte("value:42")),
+		resp.BulkStringValue([]byte("value:3")),
+		resp.BulkStringValue([]byte("value:99")),
+	), reply)
+
+	count, err := c.Exists(ctx, []byte("key:1"), []byte("key:2"), []byte("missing"), []byte("key:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+
+	reply, err = do("KEYS", "*")
+	assert.Nil(t, err)
+	elems, _ := reply.AsArray()
+	assert.Len(t, elems, n)
+
+	_, err = do("SET", "temp", "x", "EX", "100")
+	assert.Nil(t, err)
+	ttl, err := c.TTL(ctx, []byte("temp"))
+	assert.Nil(t, err)
+	assert.Equal(t, 100*time.Second, ttl)
+
+	args := append([]interface{}{"DEL"}, keys[:50]...)
+	args = append(args, "missing")
+	reply, err = do(args...)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.IntegerValue(50), reply)
+
+	reply, err = do("KEYS", "key:*")
+	assert.Nil(t, err)
+	elems, _ = reply.AsArray()
+	assert.Len(t, elems, n-50)
+
+	reply, err = do("PROXY", "NODES")
+	assert.Nil(t, err)
+	nodes, _ := reply.AsArray()
+	assert.Len(t, nodes, 3)
+
+	_, err = do("FLUSHALL")
+	assert.Equal(t, client.Error("ERR unknown command 'FLUSHALL'"), err)
+
+	_, err = do("GET")
+	assert.Equal(t, client.Error("ERR wrong number of arguments for 'get' command"), err)
+
+	_, err = do("SET", "foo", "bar", "XX")
+	assert.Equal(t, client.Error("ERR syntax error"), err)
+}
+
+func TestAddNode(t *testing.T) {
+	backends := []*backend{startBackend(t), startBackend(t)}
+	for _, b := range backends {
+		defer b.stop()
+	}
+
+	_, c, stop := startProxyPass(t, "secret", nil, backends...)
+	defer stop()
+
+	ctx := context.Background()
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		if i%2 == 0 {
+			assert.Nil(t, c.SetWithTTL(ctx, key, key, time.Hour))
+		} else {
+			assert.Nil(t, c.Set(ctx, key, key))
+		}
+	}
+
+	added := startBackend(t)
+	defer added.stop()
+
+	reply, err := c.Do(ctx, "PROXY", "ADDNODE", added.addr)
+	assert.Nil(t, err)
+	moved, _ := reply.AsInt()
+	assert.True(t, moved > 0 && moved < n, "moved %d of %d keys", moved, n)
+	assert.Equal(t, int(moved), numKeys(added.keys))
+
+	// Every key can still be read through the proxy, keeps its expiry, and is only stored on the
+	// backend that it now belongs to.
+	for i := 0; i < n; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		value, err := c.Get(ctx, key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, value)
+
+		ttl, err := c.TTL(ctx, key)
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			assert.True(t, ttl > 59*time.Minute, "key %s has a TTL of %v", key, ttl)
+		} else {
+			assert.Equal(t, client.NoExpiry, ttl)
+		}
+
+		stored := 0
+		for _, b := range append(backends, added) {
+			if b.keys.Has(key) {
+				stored++
+			}
+		}
+
+		assert.Equal(t, 1, stored, "key %s stored %d times", key, stored)
+	}
+
+	reply, err = c.Do(ctx, "PROXY", "NODES")
+	assert.Nil(t, err)
+	nodes, _ := reply.AsArray()
+	assert.Len(t, nodes, 3)
+
+	_, err = c.Do(ctx, "PROXY", "ADDNODE", added.addr)
+	assert.Equal(t, client.Error("ERR backend "+added.addr+" already exists"), err)
+
+	_, err = c.Do(ctx, "PROXY", "ADDNODE", "nonsense")
+	assert.Equal(t, client.Error("ERR invalid backend address 'nonsense'"), err)
+}
+
+func TestAddNodeWrites(t *testing.T) {
+	backends := []*backend{startBackend(t), startBackend(t)}
+	for _, b := range backends {
+		defer b.stop()
+	}
+
+	p, c, stop := startProxy(t, backends...)
+	defer stop()
+
+	ctx := context.Background()
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		assert.Nil(t, c.Set(ctx, key, key))
+	}
+
+	added := startBackend(t)
+	defer added.stop()
+
+	// Commands keep running while keys are copied, and what they write is not lost. Keys are
+	// written in order, so the first written keys have been.
+	done := make(chan struct{})
+	writes := make(chan error, 1)
+	written := 0
+	go func() {
+		var err error
+		for ; err == nil && written < n; written++ {
+			select {
+			case <-done:
+				writes <- nil
+				return
+			default:
+			}
+
+			key := []byte("key:" + strconv.Itoa(written))
+			if written%2 == 0 {
+				_, err = c.Del(ctx, key)
+			} else {
+				err = c.Set(ctx, key, []byte("new"))
+			}
+		}
+
+		writes <- err
+	}()
+
+	_, err := p.AddNode(added.addr)
+	close(done)
+	assert.Nil(t, err)
+	assert.Nil(t, <-writes)
+	assert.True(t, written > 0, "no keys written during the migration")
+
+	for i := 0; i < n; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		expected := key
+		if i < written && i%2 == 0 {
+			expected = nil
+		} else if i < written {
+			expected = []byte("new")
+		}
+
+		value, err := c.Get(ctx, key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value, "value of %s", key)
+
+		stored := 0
+		for _, b := range append(backends, added) {
+			if b.keys.Has(key) {
+				stored++
+			}
+		}
+
+		if expected == nil {
+			assert.Equal(t, 0, stored, "deleted key %s stored %d times", key, stored)
+		} else {
+			assert.Equal(t, 1, stored, "key %s stored %d times", key, stored)
+		}
+	}
+
+	assert.Equal(t, 3, len(p.Nodes()))
+}
+
+func TestBackendAuth(t *testing.T) {
+	backends := []*backend{
+		startBackendConf(t, &server.Conf{RequirePass: "secret"}),
+		startBackendConf(t, &server.Conf{RequirePass: "secret"}),
+	}
+
+	for _, b := range backends {
+		defer b.stop()
+	}
+
+	_, c, stop := startProxyOpts(t, &client.Options{Password: "secret"}, backends...)
+	defer stop()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		key := []byte("key:" + strconv.Itoa(i))
+		assert.Nil(t, c.Set(ctx, key, key))
+	}
+
+	n, err := c.Exists(ctx, []byte("key:0"), []byte("key:9"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// Without the password, the backends refuse the commands.
+	_, c, stop = startProxy(t, backends...)
+	defer stop()
+
+	_, err = c.Get(ctx, []byte("key:0"))
+	assert.NotNil(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	b := startBackend(t)
+	defer b.stop()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	p := New([]string{b.addr}, 0, nil)
+	p.SetPassword("secret")
+	go p.Serve(lis)
+	defer p.Close()
+
+	ctx := context.Background()
+	for password, expected := range map[string]error{
+		"":       client.Error("NOAUTH Authentication required."),
+		"wrong":  client.Error("WRONGPASS invalid username-password pair or user is disabled."),
+		"secret": nil,
+	} {
+		c := client.New(&client.Options{Addr: lis.Addr().String(), Password: password})
+		assert.Equal(t, expected, c.Set(ctx, []byte("foo"), []byte("bar")), "password %q", password)
+		c.Close()
+	}
+
+	c := client.New(&client.Options{Addr: lis.Addr().String(), Username: "default", Password: "secret"})
+	defer c.Close()
+
+	value, err := c.Get(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// An authenticated connection may add backends.
+	_, err = c.Do(ctx, "PROXY", "ADDNODE", "nonsense")
+	assert.Equal(t, client.Error("ERR invalid backend address 'nonsense'"), err)
+
+	// Without a password, no connection may add backends.
+	_, c2, stop := startProxy(t, b)
+	defer stop()
+
+	_, err = c2.Do(ctx, "PROXY", "ADDNODE", "nonsense")
+	assert.Equal(t, client.Error("NOPERM this command requires an authenticated connection, and no password is set with --requirepass"), err)
+
+	_, err = c2.Do(ctx, "PROXY", "NODES")
+	assert.Nil(t, err)
+
+	_, err = c2.Do(ctx, "AUTH", "secret")
+	assert.Equal(t, client.Error("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"), err)
+}
+
+func TestParseBackends(t *testing.T) {
+	backends, err := parseBackends("127.0.0.1:7878, 127.0.0.1:7879,")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:7878", "127.0.0.1:7879"}, backends)
+
+	for _, s := range []string{"", "localhost", "localhost:http", "localhost:70000"} {
+		_, err := parseBackends(s)
+		assert.NotNil(t, err, "backends %q", s)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points that each backend has on the hash ring. More points
+// spread the keys more evenly between the backends.
+const DefaultVirtualNodes = 160
+
+// point is a position on the hash ring owned by a backend.
+type point struct {
+	hash uint32
+	node string
+}
+
+// ring is a consistent hash ring that assigns each key to one of a set of backends. Every backend
+// is placed on the ring at several points, and a key belongs to the backend at the first point
+// after the hash of the key. Adding a backend only moves the keys that now belong to it.
+//
+// A ring is immutable, so that it can be read without locking.
+type ring struct {
+	vnodes int
+	nodes  []string
+	points []point
+}
+
+// newRing returns a ring with the specified backends, each of which is placed at vnodes points.
+func newRing(vnodes int, nodes ...string) *ring {
+	r := &ring{vnodes: vnodes}
+	for _, node := range nodes {
+		r = r.add(node)
+	}
+
+	return r
+}
+
+// add returns a copy of the ring with another backend, or the ring itself if the backend is
+// already on it.
+func (r *ring) add(node string) *ring {
+	if r.has(node) {
+		return r
+	}
+
+	nr := &ring{
+		vnodes: r.vnodes,
+		nodes:  append(append([]string(nil), r.nodes...), node),
+		points: make([]point, len(r.points), len(r.points)+r.vnodes),
+	}
+
+	copy(nr.points, r.points)
+	for i := 0; i < r.vnodes; i++ {
+		h := crc32.ChecksumIEEE([]byte(node + "-" + strconv.Itoa(i)))
+		nr.points = append(nr.points, point{hash: h, node: node})
+	}
+
+	// Backends whose points collide are ordered by name, so that the owner of a key does not
+	// depend on the order in which the backends were added.
+	sort.Slice(nr.points, func(i, j int) bool {
+		if nr.points[i].hash != nr.points[j].hash {
+			return nr.points[i].hash < nr.points[j].hash
+		}
+
+		return nr.points[i].node < nr.points[j].node
+	})
+
+	return nr
+}
+
+// has reports whether a backend is on the ring.
+func (r *ring) has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the backend that a key belongs to, or an empty string if the ring is empty.
+func (r *ring) lookup(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE(hashTag(key))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].node
+}
+
+// hashTag returns the part of a key that is hashed. As in Redis Cluster, if the key contains a
+// non-empty substring between the first '{' and the next '}', then only that substring is hashed,
+// so that keys such as {user:1}:name and {user:1}:email belong to the same backend.
+func hashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
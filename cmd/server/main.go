@@ -1,99 +1,314 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"os"
-
-	"github.com/maybetheresloop/keychain/pkg/resp"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/cluster"
+	"github.com/maybetheresloop/keychain/internal/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 const SockAddrUnix = "/var/keychain/keychain.sock"
-const SockAddrTcp = ":7878"
+const DefaultPort = 7878
 
-func ParseBulkStringArray(r *resp.Reader, num int64) (interface{}, error) {
+// tlsConfig returns the TLS configuration selected by the command line flags, or nil if TLS is
+// not enabled.
+func tlsConfig(c *cli.Context) (*tls.Config, error) {
+	if c.String("tls-cert") == "" && c.String("tls-key") == "" {
+		if c.Uint("tls-port") != 0 {
+			return nil, fmt.Errorf("a TLS port requires a certificate and key")
+		}
 
-	return nil, nil
+		return nil, nil
+	}
+
+	return server.TLSConfig(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"), c.String("tls-auth-clients"))
 }
 
-// Processes a client connection. This can be a connection through either a TCP socket or a Unix domain socket.
-func processConnection(conn net.Conn, state *State) error {
+// listen opens the TCP and Unix domain socket listeners selected by the command line flags. If TLS
+// is enabled, then it is used on the TLS port if there is one, and on the TCP port otherwise.
+func listen(c *cli.Context) ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}
 
-	r := resp.NewReader(conn)
+	config, err := tlsConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if port := c.Uint("port"); port != 0 {
+		addr := net.JoinHostPort(c.String("bind"), strconv.FormatUint(uint64(port), 10))
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if config != nil && c.Uint("tls-port") == 0 {
+			lis = tls.NewListener(lis, config)
+		}
+
+		listeners = append(listeners, lis)
+	}
+
+	if port := c.Uint("tls-port"); port != 0 {
+		addr := net.JoinHostPort(c.String("bind"), strconv.FormatUint(uint64(port), 10))
+		lis, err := tls.Listen("tcp", addr, config)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		listeners = append(listeners, lis)
+	}
+
+	if path := c.String("unixsocket"); path != "" {
+		perm, err := strconv.ParseUint(c.String("unixsocketperm"), 8, 32)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("invalid unix socket permissions %q", c.String("unixsocketperm"))
+		}
+
+		lis, err := server.ListenUnix(path, os.FileMode(perm))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		listeners = append(listeners, lis)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no TCP port or unix socket to listen on")
+	}
+
+	return listeners, nil
+}
+
+// replicaOf returns the address of the primary selected by the --replicaof flag, as host:port,
+// which may be given as "host port" or "host:port".
+func replicaOf(c *cli.Context) (string, error) {
+	addr := c.String("replicaof")
+	if addr == "" {
+		return "", nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if fields := strings.Fields(addr); len(fields) == 2 {
+		host, port, err = fields[0], fields[1], nil
+	}
 
-	res, err := r.ReadMessage(resp.BulkStringSliceParser)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("invalid primary address '%s'", addr)
 	}
 
-	value, ok := res.([][]byte)
-	if !ok {
-		return nil
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid primary port '%s'", port)
 	}
 
-	if bytes.Compare(value[0], []byte("get")) == 0 {
-		//state.keys.Get
+	return net.JoinHostPort(host, port), nil
+}
+
+// parsePeers parses the members of a cluster, given as a comma-separated list of
+// <id>=<host>:<port>@<cport>, where port is the port that clients connect to and cport is the
+// port of the cluster bus.
+func parsePeers(s string) ([]cluster.Peer, error) {
+	var peers []cluster.Peer
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(field, '=')
+		at := strings.LastIndexByte(field, '@')
+		if eq <= 0 || at < eq {
+			return nil, fmt.Errorf("invalid cluster peer '%s', expected id=host:port@cport", field)
+		}
+
+		host, _, err := net.SplitHostPort(field[eq+1 : at])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster peer '%s': %v", field, err)
+		}
+
+		peers = append(peers, cluster.Peer{
+			ID:         field[:eq],
+			Addr:       net.JoinHostPort(host, field[at+1:]),
+			ClientAddr: field[eq+1 : at],
+		})
 	}
 
-	return nil
+	return peers, nil
+}
+
+// startCluster starts the cluster node selected by the command line flags, along with the
+// listener for the cluster bus, or returns nil if cluster mode is not enabled. The cluster bus
+// listens on the cluster port, which is the TCP port plus 10000 unless specified.
+func startCluster(c *cli.Context, keys *keychain.Keychain) (*cluster.Node, net.Listener, error) {
+	id := c.String("cluster-id")
+	if id == "" {
+		return nil, nil, nil
+	}
+
+	if c.String("replicaof") != "" {
+		return nil, nil, fmt.Errorf("cluster mode cannot be combined with --replicaof")
+	}
+
+	peers, err := parsePeers(c.String("cluster-peers"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	port := uint64(c.Uint("cluster-port"))
+	if port == 0 {
+		port = uint64(c.Uint("port")) + 10000
+	}
 
-	//r := resp.NewReader(conn)
-	//w := resp
-	//
-	//for {
-	//	message, err := r.ReadMessage()
-	//
-	//	// RESP parsing errors are fatal and cause the connection to be closed immediately.
-	//	if err != nil {
-	//		break
-	//	}
-	//
-	//}
+	dir := c.String("cluster-dir")
+	if dir == "" {
+		dir = filepath.Join(c.String("file"), "raft")
+	}
+
+	lis, err := net.Listen("tcp", net.JoinHostPort(c.String("bind"), strconv.FormatUint(port, 10)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	node, err := cluster.New(keys, &cluster.Conf{ID: id, Dir: dir, Peers: peers})
+	if err != nil {
+		lis.Close()
+		return nil, nil, err
+	}
+
+	return node, lis, nil
 }
 
-type State struct {
-	keys *keychain.Keychain
+// restore creates the database in the directory from a snapshot written by SAVE or BGSAVE.
+func restore(path string, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return keychain.Restore(f, dir)
 }
 
 func run(c *cli.Context) error {
 	fp := c.String("file")
-	log.Infof("Using database file: %s", fp)
+	log.Infof("Using database directory: %s", fp)
+
+	if path := c.String("restore"); path != "" {
+		if err := restore(path, fp); err != nil {
+			return err
+		}
+
+		log.Infof("Restored database from snapshot: %s", path)
+	}
+
+	keys, err := keychain.Open(fp)
+	if err != nil {
+		return err
+	}
 
-	_, err := keychain.Open(fp)
+	primary, err := replicaOf(c)
 	if err != nil {
+		keys.Close()
 		return err
 	}
 
-	log.Info("Starting server on port 7878...")
+	var masterTLS *tls.Config
+	if primary != "" && c.Bool("tls-replication") {
+		if masterTLS, err = server.ReplicaTLSConfig(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca")); err != nil {
+			keys.Close()
+			return err
+		}
+	}
+
+	var acl *server.ACL
+	if path := c.String("aclfile"); path != "" {
+		if acl, err = server.LoadACL(path); err != nil {
+			keys.Close()
+			return err
+		}
+	}
 
-	lis, err := net.Listen("tcp", ":7878")
+	listeners, err := listen(c)
 	if err != nil {
+		keys.Close()
 		return err
 	}
 
-	keys, err := keychain.Open("")
+	node, clusterLis, err := startCluster(c, keys)
 	if err != nil {
-		log.Errorf("failed to open database file: %v", err)
+		for _, lis := range listeners {
+			lis.Close()
+		}
+
+		keys.Close()
+		return err
 	}
 
-	state := &State{
-		keys: keys,
+	srv := server.NewConf(keys, &server.Conf{
+		MaxBulkLength:      c.Int64("max-bulk-len"),
+		MaxQueryBufferSize: c.Int64("max-query-buffer"),
+		ACL:                acl,
+		RequirePass:        c.String("requirepass"),
+		ReplicaOf:          primary,
+		MasterUser:         c.String("masteruser"),
+		MasterAuth:         c.String("masterauth"),
+		MasterTLSConfig:    masterTLS,
+		Cluster:            node,
+		SnapshotPath:       c.String("snapshot-file"),
+	})
+
+	// The store is closed once the server has stopped, so that no writes are lost on shutdown.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		log.Infof("Starting server on %s %s...", lis.Addr().Network(), lis.Addr())
+
+		go func(lis net.Listener) {
+			errs <- srv.Serve(lis)
+		}(lis)
 	}
 
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			log.Errorf("error accepting connection: %v", err)
-		}
+	if node != nil {
+		log.Infof("Starting cluster bus on %s as node %s...", clusterLis.Addr(), node.ID())
+		go node.Serve(clusterLis)
+	}
+
+	select {
+	case sig := <-sigs:
+		log.Infof("Received %s, shutting down...", sig)
+	case err = <-errs:
+		log.Errorf("error serving connections: %v", err)
+	}
 
-		go processConnection(conn, state)
+	srv.Close()
+	if node != nil {
+		node.Close()
 	}
 
-	return nil
+	if closeErr := keys.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return err
 }
 
 func main() {
@@ -107,12 +322,166 @@ func main() {
 	fileFlag := cli.StringFlag{
 		Name:      "file, f",
 		Required:  true,
-		Usage:     "Database FILE to use",
+		Usage:     "Database DIRECTORY to use",
+		TakesFile: true,
+	}
+
+	bindFlag := cli.StringFlag{
+		Name:  "bind, b",
+		Usage: "The ADDRESS to listen on for TCP connections, or all addresses if empty",
+	}
+
+	portFlag := cli.UintFlag{
+		Name:  "port, p",
+		Usage: "The PORT to listen on for TCP connections, or 0 to not listen on TCP",
+		Value: DefaultPort,
+	}
+
+	unixSocketFlag := cli.StringFlag{
+		Name:      "unixsocket, s",
+		Usage:     "The PATH of a unix socket to listen on, such as " + SockAddrUnix,
+		TakesFile: true,
+	}
+
+	unixSocketPermFlag := cli.StringFlag{
+		Name:  "unixsocketperm",
+		Usage: "The octal PERMISSIONS of the unix socket, such as 700",
+		Value: "0",
+	}
+
+	maxBulkLenFlag := cli.Int64Flag{
+		Name:  "max-bulk-len",
+		Usage: "The maximum LENGTH in bytes of a bulk string in a command",
+		Value: server.DefaultMaxBulkLength,
+	}
+
+	maxQueryBufferFlag := cli.Int64Flag{
+		Name:  "max-query-buffer",
+		Usage: "The maximum SIZE in bytes of a single command",
+		Value: server.DefaultMaxQueryBufferSize,
+	}
+
+	requirePassFlag := cli.StringFlag{
+		Name:   "requirepass",
+		Usage:  "The PASSWORD that clients must authenticate with as the default user",
+		EnvVar: "KEYCHAIN_REQUIREPASS",
+	}
+
+	aclFileFlag := cli.StringFlag{
+		Name:      "aclfile",
+		Usage:     "The PATH of an ACL file defining the users of the server",
+		TakesFile: true,
+	}
+
+	replicaOfFlag := cli.StringFlag{
+		Name:  "replicaof",
+		Usage: "The ADDRESS of a primary to replicate, as \"host port\" or host:port",
+	}
+
+	masterUserFlag := cli.StringFlag{
+		Name:  "masteruser",
+		Usage: "The USER that a replica authenticates with to its primary, or the default user if empty",
+	}
+
+	masterAuthFlag := cli.StringFlag{
+		Name:   "masterauth",
+		Usage:  "The PASSWORD that a replica authenticates with to its primary",
+		EnvVar: "KEYCHAIN_MASTERAUTH",
+	}
+
+	clusterIDFlag := cli.StringFlag{
+		Name:  "cluster-id",
+		Usage: "The ID of the node in a Raft cluster, which enables cluster mode",
+	}
+
+	clusterPeersFlag := cli.StringFlag{
+		Name:  "cluster-peers",
+		Usage: "The initial MEMBERS of the cluster, as a comma-separated list of id=host:port@cport",
+	}
+
+	clusterPortFlag := cli.UintFlag{
+		Name:  "cluster-port",
+		Usage: "The PORT of the cluster bus, or the TCP port plus 10000 if 0",
+	}
+
+	clusterDirFlag := cli.StringFlag{
+		Name:      "cluster-dir",
+		Usage:     "The DIRECTORY of the cluster log, or a directory in the database directory if empty",
+		TakesFile: true,
+	}
+
+	snapshotFileFlag := cli.StringFlag{
+		Name:      "snapshot-file",
+		Usage:     "The FILE that SAVE and BGSAVE write snapshots of the database to",
+		Value:     "keychain.snapshot",
 		TakesFile: true,
 	}
 
+	restoreFlag := cli.StringFlag{
+		Name:      "restore",
+		Usage:     "A snapshot FILE to create the database from, which must not exist yet",
+		TakesFile: true,
+	}
+
+	tlsPortFlag := cli.UintFlag{
+		Name:  "tls-port",
+		Usage: "The PORT to listen on for TLS connections, instead of using TLS on the TCP port",
+	}
+
+	tlsCertFlag := cli.StringFlag{
+		Name:      "tls-cert",
+		Usage:     "The certificate FILE of the server, which enables TLS",
+		TakesFile: true,
+	}
+
+	tlsKeyFlag := cli.StringFlag{
+		Name:      "tls-key",
+		Usage:     "The private key FILE of the server certificate",
+		TakesFile: true,
+	}
+
+	tlsCAFlag := cli.StringFlag{
+		Name:      "tls-ca",
+		Usage:     "The CA certificate FILE used to authenticate clients",
+		TakesFile: true,
+	}
+
+	tlsAuthClientsFlag := cli.StringFlag{
+		Name:  "tls-auth-clients",
+		Usage: "Whether clients must present a certificate: yes, optional or no",
+		Value: "yes",
+	}
+
+	tlsReplicationFlag := cli.BoolFlag{
+		Name:  "tls-replication",
+		Usage: "Connect to the primary with TLS, presenting the server certificate and verifying the primary with the CA certificate",
+	}
+
 	app.Flags = []cli.Flag{
 		fileFlag,
+		bindFlag,
+		portFlag,
+		unixSocketFlag,
+		unixSocketPermFlag,
+		maxBulkLenFlag,
+		maxQueryBufferFlag,
+		requirePassFlag,
+		aclFileFlag,
+		replicaOfFlag,
+		masterUserFlag,
+		masterAuthFlag,
+		clusterIDFlag,
+		clusterPeersFlag,
+		clusterPortFlag,
+		clusterDirFlag,
+		snapshotFileFlag,
+		restoreFlag,
+		tlsPortFlag,
+		tlsCertFlag,
+		tlsKeyFlag,
+		tlsCAFlag,
+		tlsAuthClientsFlag,
+		tlsReplicationFlag,
 	}
 
 	if err := app.Run(os.Args); err != nil {
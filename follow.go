@@ -0,0 +1,166 @@
+package keychain
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// MaxFollowerLag is the number of bytes of records that a follower may have buffered before it is
+// considered too far behind, and is stopped with ErrFollowerLagging.
+const MaxFollowerLag = 64 << 20
+
+// ErrFollowerClosed is returned by Follower.Next once the follower or the store has been closed.
+var ErrFollowerClosed = errors.New("keychain: follower is closed")
+
+// ErrFollowerLagging is returned by Follower.Next if the follower fell too far behind the writes
+// to the store.
+var ErrFollowerLagging = errors.New("keychain: follower is lagging")
+
+// Record is a write appended to the log of a store.
+type Record struct {
+	// Seq is the sequence number of the write. The records written together by a batch share a
+	// sequence number, and the writes in between have consecutive sequence numbers.
+	Seq uint64
+
+	Key []byte
+
+	// Value is the new value of the key, or nil if the key was removed.
+	Value []byte
+
+	// Expiry is the time, in nanoseconds since the Unix epoch, at which the key expires, or zero
+	// if it does not expire.
+	Expiry int64
+}
+
+// Follower receives the records appended to the log of a store, in order, as they are written.
+type Follower struct {
+	k   *Keychain
+	seq uint64
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	records []Record
+	size    int64
+	err     error
+}
+
+// Follow starts following the writes to the store. It returns an iterator over the live keys of
+// the store at the moment following started, along with a follower that receives every write
+// after that moment, so that together they give a complete copy of the store. Both must be
+// closed once they are no longer needed.
+func (k *Keychain) Follow() (*Iterator, *Follower) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	f := &Follower{k: k, seq: k.counter}
+	f.cond = sync.NewCond(&f.mtx)
+	k.followers[f] = struct{}{}
+
+	return k.newIterator(IteratorOptions{}), f
+}
+
+// Seq returns the sequence number of the last write to the store.
+func (k *Keychain) Seq() uint64 {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	return k.counter
+}
+
+// Seq returns the sequence number of the last write included in the iterator returned along with
+// the follower. The follower receives the writes after it.
+func (f *Follower) Seq() uint64 {
+	return f.seq
+}
+
+// Next waits for writes to the store and returns the records written since the last call, in
+// order.
+func (f *Follower) Next() ([]Record, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for len(f.records) == 0 && f.err == nil {
+		f.cond.Wait()
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	records := f.records
+	f.records, f.size = nil, 0
+	return records, nil
+}
+
+// Close stops following the writes to the store. A call to Next that is waiting returns
+// ErrFollowerClosed.
+func (f *Follower) Close() error {
+	f.k.mtx.Lock()
+	delete(f.k.followers, f)
+	f.k.mtx.Unlock()
+
+	f.stop(ErrFollowerClosed)
+	return nil
+}
+
+// stop makes Next fail with the specified error.
+func (f *Follower) stop(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.err == nil {
+		f.err = err
+		f.records = nil
+	}
+
+	f.cond.Broadcast()
+}
+
+// publish passes appended items to the followers of the store. The keys and values are copied,
+// since they belong to the caller. It must be called with the write lock held.
+func (k *Keychain) publish(seq uint64, items []*data.Item) {
+	if len(k.followers) == 0 {
+		return
+	}
+
+	records := make([]Record, 0, len(items))
+	var size int64
+	for _, item := range items {
+		if item.IsBatchMarker() {
+			continue
+		}
+
+		r := Record{Seq: seq, Key: append([]byte(nil), item.Key...), Expiry: item.Expiry}
+		if item.ValueSize != -1 {
+			r.Value = append([]byte{}, item.Value...)
+		}
+
+		records = append(records, r)
+		size += int64(len(r.Key) + len(r.Value))
+	}
+
+	for f := range k.followers {
+		f.mtx.Lock()
+		f.records = append(f.records, records...)
+		f.size += size
+		lagging := f.size > MaxFollowerLag
+		f.cond.Broadcast()
+		f.mtx.Unlock()
+
+		if lagging {
+			delete(k.followers, f)
+			f.stop(ErrFollowerLagging)
+		}
+	}
+}
+
+// closeFollowers stops all of the followers of the store. It must be called with the write lock
+// held.
+func (k *Keychain) closeFollowers() {
+	for f := range k.followers {
+		delete(k.followers, f)
+		f.stop(ErrFollowerClosed)
+	}
+}
@@ -0,0 +1,104 @@
+package keychain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFollow(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	set(keys, []byte("a"), []byte("value-a"), t)
+	set(keys, []byte("b"), []byte("value-b"), t)
+	remove(keys, []byte("b"), t)
+
+	// The snapshot holds the live keys, and the follower receives everything after it.
+	it, f := keys.Follow()
+	expectKeys([]string{"a"}, collect(it, t), t)
+
+	if f.Seq() != keys.Seq() {
+		t.Fatalf("incorrect sequence number: expected=%d, got=%d", keys.Seq(), f.Seq())
+	}
+
+	value := []byte("value-c")
+	set(keys, []byte("c"), value, t)
+
+	// The records do not share memory with the caller.
+	value[0] = 'x'
+
+	if err := keys.SetWithTTL([]byte("d"), []byte("value-d"), time.Hour); err != nil {
+		t.Fatalf("failed setting value: %v", err)
+	}
+
+	remove(keys, []byte("a"), t)
+
+	var b Batch
+	b.Set([]byte("e"), []byte("value-e"))
+	b.Delete([]byte("c"))
+	if err := keys.Write(&b); err != nil {
+		t.Fatalf("failed writing batch: %v", err)
+	}
+
+	var records []Record
+	for len(records) < 5 {
+		next, err := f.Next()
+		if err != nil {
+			t.Fatalf("failed following writes: %v", err)
+		}
+
+		records = append(records, next...)
+	}
+
+	expected := []Record{
+		{Seq: f.Seq() + 1, Key: []byte("c"), Value: []byte("value-c")},
+		{Seq: f.Seq() + 2, Key: []byte("d"), Value: []byte("value-d")},
+		{Seq: f.Seq() + 3, Key: []byte("a")},
+		{Seq: f.Seq() + 4, Key: []byte("e"), Value: []byte("value-e")},
+		{Seq: f.Seq() + 4, Key: []byte("c")},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("incorrect number of records: expected=%d, got=%d", len(expected), len(records))
+	}
+
+	for i, r := range records {
+		e := expected[i]
+		if r.Seq != e.Seq || !bytes.Equal(r.Key, e.Key) || !bytes.Equal(r.Value, e.Value) || (r.Value == nil) != (e.Value == nil) {
+			t.Fatalf("records[%d]: expected=%+v, got=%+v", i, e, r)
+		}
+
+		if (r.Expiry != 0) != bytes.Equal(r.Key, []byte("d")) {
+			t.Fatalf("records[%d]: incorrect expiry %d", i, r.Expiry)
+		}
+	}
+
+	// Closing the store stops a follower that is waiting.
+	done := make(chan error)
+	go func() {
+		_, err := f.Next()
+		done <- err
+	}()
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("could not close database: %v", err)
+	}
+
+	if err := <-done; err != ErrFollowerClosed {
+		t.Fatalf("expected ErrFollowerClosed, got %v", err)
+	}
+
+	f.Close()
+}
@@ -0,0 +1,79 @@
+package keychain
+
+import (
+	"io"
+	"os"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// hint describes where the value of a key is located in a data file.
+type hint struct {
+	key   []byte
+	entry data.Entry
+}
+
+// writeHintFile writes the hint file for the data file with the specified ID. The hint file is
+// written under a temporary name first, so that a partially written hint file is never used.
+func writeHintFile(dir string, id uint64, hints []hint) error {
+	name := hintPath(dir, id)
+	tmp := name + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := data.NewHintWriter(f)
+	for i := range hints {
+		if err := w.WriteHint(hints[i].key, &hints[i].entry); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// readHintFile reads all of the hints in the hint file for the data file with the specified ID.
+func readHintFile(dir string, id uint64) ([]hint, error) {
+	f, err := os.Open(hintPath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := data.NewHintReader(f, id)
+
+	var hints []hint
+	for {
+		key, entry, err := r.ReadHint()
+		if err == io.EOF {
+			return hints, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		hints = append(hints, hint{key: key, entry: *entry})
+	}
+}
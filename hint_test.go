@@ -0,0 +1,78 @@
+package keychain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHintFiles(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	conf := &Conf{MaxFileSize: 64}
+	keys, err := OpenConf(name, conf)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		set(keys, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), t)
+	}
+	remove(keys, []byte("key2"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	ids, err := listSegments(name)
+	if err != nil {
+		t.Fatalf("could not list data files: %v", err)
+	}
+
+	// Every immutable data file has a hint file, but the active one does not.
+	for i, id := range ids {
+		_, err := os.Stat(hintPath(name, id))
+		if i < len(ids)-1 && err != nil {
+			t.Fatalf("expected hint file for data file %d: %v", id, err)
+		}
+
+		if i == len(ids)-1 && !os.IsNotExist(err) {
+			t.Fatalf("expected no hint file for active data file %d", id)
+		}
+	}
+
+	expect := func() {
+		keys, err := OpenConf(name, conf)
+		if err != nil {
+			t.Fatalf("could not reopen database: %v", err)
+		}
+
+		for i := 0; i < 10; i++ {
+			var expected []byte
+			if i != 2 {
+				expected = []byte(fmt.Sprintf("value%d", i))
+			}
+
+			getAndExpect(keys, []byte(fmt.Sprintf("key%d", i)), expected, t)
+		}
+
+		if err := keys.Close(); err != nil {
+			t.Fatalf("failed to close database: %v", err)
+		}
+	}
+
+	expect()
+
+	// A corrupt hint file is ignored in favor of scanning the data file.
+	if err := ioutil.WriteFile(hintPath(name, ids[0]), []byte("garbage"), 0644); err != nil {
+		t.Fatalf("could not corrupt hint file: %v", err)
+	}
+
+	expect()
+}
@@ -0,0 +1,587 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/stretchr/testify/assert"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// network connects nodes in memory, by address. Nodes can be isolated from the rest of the
+// network to simulate partitions.
+type network struct {
+	mtx      sync.Mutex
+	nodes    map[string]*Node
+	isolated map[string]bool
+}
+
+func newNetwork() *network {
+	return &network{nodes: make(map[string]*Node), isolated: make(map[string]bool)}
+}
+
+// memTransport sends the RPCs of the node at an address over a network.
+type memTransport struct {
+	net  *network
+	from string
+}
+
+func (nw *network) transport(addr string) Transport {
+	return &memTransport{net: nw, from: addr}
+}
+
+// isolate cuts a node off from the rest of the network, or connects it again.
+func (nw *network) isolate(addr string, isolated bool) {
+	nw.mtx.Lock()
+	defer nw.mtx.Unlock()
+
+	nw.isolated[addr] = isolated
+}
+
+func (nw *network) isIsolated(addr string) bool {
+	nw.mtx.Lock()
+	defer nw.mtx.Unlock()
+
+	return nw.isolated[addr]
+}
+
+func (nw *network) reach(from, to string) (*Node, error) {
+	nw.mtx.Lock()
+	defer nw.mtx.Unlock()
+
+	n, ok := nw.nodes[to]
+	if !ok || nw.isolated[from] || nw.isolated[to] {
+		return nil, errUnreachable
+	}
+
+	return n, nil
+}
+
+func (t *memTransport) RequestVote(addr string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n, err := t.net.reach(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.handleRequestVote(req), nil
+}
+
+func (t *memTransport) AppendEntries(addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n, err := t.net.reach(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.handleAppendEntries(req), nil
+}
+
+func (t *memTransport) InstallSnapshot(addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n, err := t.net.reach(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.handleInstallSnapshot(req)
+}
+
+// testCluster runs nodes that are connected by a network, each with its own store.
+type testCluster struct {
+	t     *testing.T
+	dir   string
+	net   *network
+	conf  Conf
+	nodes map[string]*Node
+	keys  map[string]*keychain.Keychain
+	peers []Peer
+}
+
+// newTestCluster starts a cluster of nodes named n1, n2 and so on.
+func newTestCluster(t *testing.T, size int, conf Conf) *testCluster {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	if conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = 10 * time.Millisecond
+	}
+
+	if conf.ElectionTimeout == 0 {
+		conf.ElectionTimeout = 100 * time.Millisecond
+	}
+
+	c := &testCluster{
+		t:     t,
+		dir:   dir,
+		net:   newNetwork(),
+		conf:  conf,
+		nodes: make(map[string]*Node),
+		keys:  make(map[string]*keychain.Keychain),
+	}
+
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		c.peers = append(c.peers, Peer{ID: id, Addr: id})
+	}
+
+	for _, p := range c.peers {
+		c.start(p.ID, c.peers)
+	}
+
+	return c
+}
+
+// start starts a node, reopening its store and its log if it was started before.
+func (c *testCluster) start(id string, peers []Peer) *Node {
+	keys, err := keychain.Open(filepath.Join(c.dir, id, "data"))
+	if err != nil {
+		c.t.Fatalf("could not open database: %v", err)
+	}
+
+	conf := c.conf
+	conf.ID = id
+	conf.Dir = filepath.Join(c.dir, id, "raft")
+	conf.Peers = peers
+	conf.Transport = c.net.transport(id)
+
+	n, err := New(keys, &conf)
+	if err != nil {
+		c.t.Fatalf("could not start node: %v", err)
+	}
+
+	c.net.mtx.Lock()
+	c.net.nodes[id] = n
+	c.net.mtx.Unlock()
+
+	c.nodes[id] = n
+	c.keys[id] = keys
+	return n
+}
+
+// stop stops a node and closes its store.
+func (c *testCluster) stop(id string) {
+	c.net.mtx.Lock()
+	delete(c.net.nodes, id)
+	c.net.mtx.Unlock()
+
+	c.nodes[id].Close()
+	c.keys[id].Close()
+	delete(c.nodes, id)
+	delete(c.keys, id)
+}
+
+func (c *testCluster) close() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+
+	os.RemoveAll(c.dir)
+}
+
+// leader waits for the nodes that are not isolated to elect a leader, and returns it.
+func (c *testCluster) leader() *Node {
+	var leader *Node
+	eventually(c.t, func() bool {
+		leader = nil
+		var term uint64
+		for id, n := range c.nodes {
+			if c.net.isIsolated(id) {
+				continue
+			}
+
+			if t := n.Term(); t > term {
+				term, leader = t, nil
+			}
+
+			if n.State() == Leader && n.Term() == term {
+				leader = n
+			}
+		}
+
+		return leader != nil
+	}, "leader election")
+
+	return leader
+}
+
+// follower returns one of the initial nodes that is not the leader.
+func (c *testCluster) follower(leader *Node) *Node {
+	for _, p := range c.peers {
+		if n, ok := c.nodes[p.ID]; ok && n != leader {
+			return n
+		}
+	}
+
+	c.t.Fatalf("no follower")
+	return nil
+}
+
+// expectValue waits for the store of a node to hold a value for a key, which is nil if the key
+// should not exist.
+func (c *testCluster) expectValue(id string, key string, value []byte) {
+	eventually(c.t, func() bool {
+		v, err := c.keys[id].Get([]byte(key))
+		return err == nil && string(v) == string(value) && (v == nil) == (value == nil)
+	}, fmt.Sprintf("value of %s on %s", key, id))
+}
+
+// eventually waits for a condition to hold, failing the test if it does not within a few seconds.
+func eventually(t *testing.T, cond func() bool, message string) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", message)
+		}
+	}
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{})
+	defer c.close()
+
+	leader := c.leader()
+	for id, n := range c.nodes {
+		n := n
+		eventually(t, func() bool {
+			p, ok := n.Leader()
+			return ok && p.ID == leader.ID()
+		}, "leader known to "+id)
+	}
+
+	// The majority elects a new leader when the leader is partitioned, and the old leader steps
+	// down since it cannot reach the majority.
+	c.net.isolate(leader.ID(), true)
+	newLeader := c.leader()
+	assert.NotEqual(t, leader.ID(), newLeader.ID())
+	assert.True(t, newLeader.Term() > leader.Term())
+
+	eventually(t, func() bool { return leader.State() != Leader }, "old leader stepping down")
+
+	// Once the partition heals, the old leader follows the new one.
+	c.net.isolate(leader.ID(), false)
+	eventually(t, func() bool {
+		p, ok := leader.Leader()
+		return ok && p.ID != leader.ID() && leader.State() == Follower
+	}, "old leader following")
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{})
+	defer c.close()
+
+	leader := c.leader()
+	assert.NoError(t, leader.Set([]byte("a"), []byte("1")))
+	assert.NoError(t, leader.SetWithTTL([]byte("b"), []byte("2"), time.Hour))
+	assert.NoError(t, leader.Set([]byte("c"), []byte("3")))
+
+	ok, err := leader.Remove([]byte("c"))
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = leader.Remove([]byte("c"))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = leader.Expire([]byte("a"), time.Hour)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = leader.Persist([]byte("b"))
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	// Keys that expire on arrival are removed.
+	assert.NoError(t, leader.SetWithTTL([]byte("d"), []byte("4"), -time.Second))
+
+	assert.Equal(t, ErrNotLeader, c.follower(leader).Set([]byte("a"), []byte("2")))
+
+	for id, keys := range c.keys {
+		c.expectValue(id, "a", []byte("1"))
+		c.expectValue(id, "b", []byte("2"))
+		c.expectValue(id, "c", nil)
+		c.expectValue(id, "d", nil)
+
+		// The values are set before the expiries change, so followers may not have applied them yet.
+		keys := keys
+		eventually(t, func() bool {
+			ttlA, _ := keys.TTL([]byte("a"))
+			ttlB, _ := keys.TTL([]byte("b"))
+			return ttlA > 59*time.Minute && ttlB == keychain.NoExpiry
+		}, "expiries on "+id)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{})
+	defer c.close()
+
+	leader := c.leader()
+	follower := c.follower(leader)
+
+	// The majority commits writes without the partitioned follower, which catches up once the
+	// partition heals.
+	c.net.isolate(follower.ID(), true)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, leader.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+
+	c.net.isolate(follower.ID(), false)
+	for i := 0; i < 10; i++ {
+		c.expectValue(follower.ID(), fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+
+	// A leader in the minority cannot commit writes, and steps down.
+	c.net.isolate(leader.ID(), true)
+	assert.Equal(t, ErrLeadershipLost, leader.Set([]byte("lost"), []byte("value")))
+
+	newLeader := c.leader()
+	assert.NoError(t, newLeader.Set([]byte("kept"), []byte("value")))
+
+	// The entry of the old leader that was never committed is replaced by the log of the new
+	// leader.
+	c.net.isolate(leader.ID(), false)
+	c.expectValue(leader.ID(), "kept", []byte("value"))
+	c.expectValue(leader.ID(), "lost", nil)
+
+	for id := range c.keys {
+		c.expectValue(id, "lost", nil)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{SnapshotThreshold: 20})
+	defer c.close()
+
+	leader := c.leader()
+	follower := c.follower(leader)
+
+	// The follower misses entries that are discarded from the log of the leader once they are
+	// included in a snapshot, so it receives the snapshot instead.
+	c.net.isolate(follower.ID(), true)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, leader.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+
+	assert.NoError(t, leader.SetWithTTL([]byte("expiring"), []byte("value"), time.Hour))
+
+	eventually(t, func() bool {
+		leader.mtx.Lock()
+		defer leader.mtx.Unlock()
+
+		return leader.log.snapIndex > 50
+	}, "snapshot on the leader")
+
+	// A key that the follower has but that is not in the snapshot is removed.
+	assert.NoError(t, c.keys[follower.ID()].Set([]byte("stale"), []byte("value")))
+
+	c.net.isolate(follower.ID(), false)
+	for i := 0; i < 100; i++ {
+		c.expectValue(follower.ID(), fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+
+	c.expectValue(follower.ID(), "expiring", []byte("value"))
+	c.expectValue(follower.ID(), "stale", nil)
+
+	ttl, _ := c.keys[follower.ID()].TTL([]byte("expiring"))
+	assert.True(t, ttl > 59*time.Minute)
+
+	follower.mtx.Lock()
+	assert.True(t, follower.log.snapIndex > 50)
+	follower.mtx.Unlock()
+
+	// The follower restarts from its snapshot and log.
+	c.stop(follower.ID())
+	follower = c.start(follower.ID(), c.peers)
+
+	c.expectValue(follower.ID(), "key-99", []byte("value"))
+
+	assert.NoError(t, c.leader().Set([]byte("after"), []byte("value")))
+	c.expectValue(follower.ID(), "after", []byte("value"))
+}
+
+func TestMembership(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{})
+	defer c.close()
+
+	leader := c.leader()
+	assert.NoError(t, leader.Set([]byte("before"), []byte("value")))
+
+	// A new node starts without peers, and receives the log once it is added.
+	c.start("n4", nil)
+	assert.NoError(t, leader.AddPeer(Peer{ID: "n4", Addr: "n4"}))
+	assert.Len(t, leader.Peers(), 4)
+
+	assert.NoError(t, leader.Set([]byte("after"), []byte("value")))
+	c.expectValue("n4", "before", []byte("value"))
+	c.expectValue("n4", "after", []byte("value"))
+
+	eventually(t, func() bool { return len(c.nodes["n4"].Peers()) == 4 }, "configuration on n4")
+
+	// With four members, the leader needs two of the others to commit.
+	follower := c.follower(leader)
+	assert.NoError(t, leader.RemovePeer(follower.ID()))
+	assert.Len(t, leader.Peers(), 3)
+
+	assert.Error(t, leader.RemovePeer(follower.ID()))
+
+	c.stop(follower.ID())
+	assert.NoError(t, leader.Set([]byte("removed"), []byte("value")))
+	c.expectValue("n4", "removed", []byte("value"))
+
+	// A leader that removes itself steps down, and the remaining members elect a new one.
+	assert.NoError(t, leader.RemovePeer(leader.ID()))
+	eventually(t, func() bool { return leader.State() != Leader }, "leader stepping down")
+
+	c.stop(leader.ID())
+	newLeader := c.leader()
+	assert.Len(t, newLeader.Peers(), 2)
+	assert.NoError(t, newLeader.Set([]byte("new-leader"), []byte("value")))
+}
+
+func TestRestart(t *testing.T) {
+	c := newTestCluster(t, 3, Conf{})
+	defer c.close()
+
+	leader := c.leader()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, leader.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+
+	term := leader.Term()
+
+	// The nodes keep their terms and logs across restarts.
+	for _, p := range c.peers {
+		c.stop(p.ID)
+	}
+
+	for _, p := range c.peers {
+		c.start(p.ID, c.peers)
+	}
+
+	leader = c.leader()
+	assert.True(t, leader.Term() > term)
+	assert.NoError(t, leader.Set([]byte("restarted"), []byte("value")))
+
+	for id := range c.keys {
+		c.expectValue(id, "key-9", []byte("value"))
+		c.expectValue(id, "restarted", []byte("value"))
+	}
+}
+
+func TestTornLogEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	l, err := openLog(dir, nil)
+	if err != nil {
+		t.Fatalf("could not open log: %v", err)
+	}
+
+	assert.NoError(t, l.append(Entry{Index: 1, Term: 1, Type: EntryCommand, Data: []byte("entry")}))
+	assert.NoError(t, l.close())
+
+	// A torn entry whose length is damaged is discarded without being read.
+	var header [entryHeaderSize + entryFixedSize]byte
+	header[4] = 0xff
+
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+
+	_, err = f.Write(header[:])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	l, err = openLog(dir, nil)
+	if err != nil {
+		t.Fatalf("could not reopen log: %v", err)
+	}
+
+	defer l.close()
+
+	assert.Equal(t, uint64(1), l.lastIndex())
+	assert.Equal(t, []byte("entry"), l.entries[0].Data)
+}
+
+func TestTCPTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var listeners []net.Listener
+	var peers []Peer
+	for i := 1; i <= 3; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+
+		listeners = append(listeners, lis)
+		peers = append(peers, Peer{ID: fmt.Sprintf("n%d", i), Addr: lis.Addr().String()})
+	}
+
+	var nodes []*Node
+	for i, p := range peers {
+		keys, err := keychain.Open(filepath.Join(dir, p.ID, "data"))
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+
+		defer keys.Close()
+
+		n, err := New(keys, &Conf{
+			ID:                p.ID,
+			Dir:               filepath.Join(dir, p.ID, "raft"),
+			Peers:             peers,
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   100 * time.Millisecond,
+		})
+
+		if err != nil {
+			t.Fatalf("could not start node: %v", err)
+		}
+
+		defer n.Close()
+
+		go n.Serve(listeners[i])
+		nodes = append(nodes, n)
+	}
+
+	var leader *Node
+	eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.State() == Leader {
+				leader = n
+				return true
+			}
+		}
+
+		return false
+	}, "leader election")
+
+	assert.NoError(t, leader.Set([]byte("key"), []byte("value")))
+
+	for _, n := range nodes {
+		n := n
+		eventually(t, func() bool {
+			v, _ := n.keys.Get([]byte("key"))
+			return string(v) == "value"
+		}, "replication to "+n.ID())
+	}
+}
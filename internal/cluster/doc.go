@@ -0,0 +1,4 @@
+// Package cluster replicates a Keychain store across a cluster of nodes with the Raft consensus
+// algorithm. Writes are appended to a replicated log by the leader, and are applied to the store
+// of every node once a majority of the cluster has stored them.
+package cluster
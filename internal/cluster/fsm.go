@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+)
+
+// opType is the type of a write to the store held by a command entry.
+type opType uint8
+
+const (
+	opSet opType = iota
+	opRemove
+	opExpire
+	opPersist
+)
+
+// errInvalidOp is returned when the data of a command entry cannot be decoded.
+var errInvalidOp = errors.New("cluster: invalid command entry")
+
+// op is a write to the store. Expiry times are absolute, in nanoseconds since the Unix epoch, so
+// that every node expires a key at the same time no matter when it applies the write.
+type op struct {
+	typ    opType
+	key    []byte
+	value  []byte
+	expiry int64
+}
+
+// encode encodes a write as the data of a command entry: the type, the expiry, the length of the
+// key as a varint, the key and the value.
+func (o *op) encode() []byte {
+	b := make([]byte, 9+binary.MaxVarintLen64, 9+binary.MaxVarintLen64+len(o.key)+len(o.value))
+	b[0] = byte(o.typ)
+	binary.BigEndian.PutUint64(b[1:], uint64(o.expiry))
+	n := binary.PutUvarint(b[9:], uint64(len(o.key)))
+
+	b = append(b[:9+n], o.key...)
+	return append(b, o.value...)
+}
+
+// decodeOp decodes the data of a command entry.
+func decodeOp(b []byte) (*op, error) {
+	if len(b) < 9 {
+		return nil, errInvalidOp
+	}
+
+	o := &op{typ: opType(b[0]), expiry: int64(binary.BigEndian.Uint64(b[1:]))}
+
+	size, n := binary.Uvarint(b[9:])
+	if n <= 0 || size > uint64(len(b)-9-n) {
+		return nil, errInvalidOp
+	}
+
+	o.key = b[9+n : 9+n+int(size)]
+	o.value = b[9+n+int(size):]
+	return o, nil
+}
+
+// apply applies a write to the store, returning whether it had an effect for the writes that
+// report one.
+func (o *op) apply(keys *keychain.Keychain) (bool, error) {
+	switch o.typ {
+	case opSet:
+		if o.expiry == 0 {
+			return true, keys.Set(o.key, o.value)
+		}
+
+		// A key that has already expired is removed instead, as it would be when it expired.
+		if ttl := time.Until(time.Unix(0, o.expiry)); ttl > 0 {
+			return true, keys.SetWithTTL(o.key, o.value, ttl)
+		}
+
+		_, err := keys.Remove(o.key)
+		return true, err
+	case opRemove:
+		return keys.Remove(o.key)
+	case opExpire:
+		return keys.Expire(o.key, time.Until(time.Unix(0, o.expiry)))
+	case opPersist:
+		return keys.Persist(o.key)
+	}
+
+	return false, errInvalidOp
+}
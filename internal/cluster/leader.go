@@ -0,0 +1,410 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// becomeLeader makes the node the leader of its current term. It must be called with the lock
+// held.
+func (n *Node) becomeLeader() {
+	log.Infof("Elected leader for term %d", n.log.term)
+
+	n.state = Leader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastContact = make(map[string]time.Time)
+	n.triggers = make(map[string]chan struct{})
+
+	// A leader only commits entries of its own term by counting replicas, so an entry of the new
+	// term commits the entries of previous terms along with it.
+	if _, err := n.appendEntry(EntryNoop, nil); err != nil {
+		log.Errorf("error appending to log: %v", err)
+	}
+
+	n.startReplication()
+	n.advanceCommit()
+}
+
+// startReplication starts replicating to the members of the cluster that the leader is not
+// replicating to yet. It must be called with the lock held.
+func (n *Node) startReplication() {
+	now := time.Now()
+	for _, p := range n.peers {
+		if _, ok := n.triggers[p.ID]; ok || p.ID == n.id {
+			continue
+		}
+
+		n.nextIndex[p.ID] = n.log.lastIndex() + 1
+		n.matchIndex[p.ID] = 0
+		n.lastContact[p.ID] = now
+
+		trigger := make(chan struct{}, 1)
+		n.triggers[p.ID] = trigger
+
+		n.wg.Add(1)
+		go n.replicate(p.ID, n.log.term, trigger)
+	}
+}
+
+// signal wakes up the goroutines replicating to the members of the cluster. It must be called
+// with the lock held.
+func (n *Node) signal() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends the entries of the log to a member of the cluster as they are appended, or a
+// heartbeat if there are none, until the node stops being the leader of the term or the member
+// is removed.
+func (n *Node) replicate(id string, term uint64, trigger chan struct{}) {
+	defer n.wg.Done()
+
+	for {
+		n.mtx.Lock()
+		p, ok := n.peer(id)
+		if n.closed || n.state != Leader || n.log.term != term || !ok {
+			if n.triggers[id] == trigger {
+				delete(n.triggers, id)
+			}
+
+			n.mtx.Unlock()
+			return
+		}
+
+		var more bool
+		if n.nextIndex[id] <= n.log.snapIndex {
+			more = n.sendSnapshot(p, term)
+		} else {
+			more = n.sendEntries(p, term)
+		}
+
+		n.mtx.Unlock()
+
+		if !more {
+			select {
+			case <-n.done:
+				return
+			case <-trigger:
+			case <-time.After(n.conf.HeartbeatInterval):
+			}
+		}
+	}
+}
+
+// sendEntries sends the entries that a member of the cluster is missing, and reports whether
+// there are more entries to send right away. It must be called with the lock held, which it
+// releases while waiting for the response.
+func (n *Node) sendEntries(p Peer, term uint64) bool {
+	next := n.nextIndex[p.ID]
+	last := n.log.lastIndex()
+	if last >= next+maxAppendEntries {
+		last = next + maxAppendEntries - 1
+	}
+
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: next - 1,
+		Entries:      n.log.slice(next, last+1),
+		LeaderCommit: n.commitIndex,
+	}
+
+	req.PrevLogTerm, _ = n.log.entryTerm(req.PrevLogIndex)
+
+	n.mtx.Unlock()
+	resp, err := n.trans.AppendEntries(p.Addr, req)
+	n.mtx.Lock()
+
+	if err != nil || !n.handleResponse(p.ID, term, resp.Term) {
+		return false
+	}
+
+	if !resp.Success {
+		next := resp.ConflictIndex
+		if next == 0 || next >= req.PrevLogIndex+1 {
+			next = req.PrevLogIndex
+		}
+
+		if next < 1 {
+			next = 1
+		}
+
+		n.nextIndex[p.ID] = next
+		return true
+	}
+
+	if match := req.PrevLogIndex + uint64(len(req.Entries)); match > n.matchIndex[p.ID] {
+		n.matchIndex[p.ID] = match
+		n.nextIndex[p.ID] = match + 1
+		n.advanceCommit()
+	}
+
+	return n.nextIndex[p.ID] <= n.log.lastIndex()
+}
+
+// sendSnapshot sends the snapshot of the leader to a member of the cluster that is missing
+// entries that have been discarded from the log, and reports whether there are more entries to
+// send right away. It must be called with the lock held, which it releases while waiting for the
+// response.
+func (n *Node) sendSnapshot(p Peer, term uint64) bool {
+	req := &InstallSnapshotRequest{
+		Term:      term,
+		LeaderID:  n.id,
+		LastIndex: n.log.snapIndex,
+		LastTerm:  n.log.snapTerm,
+	}
+
+	var err error
+	if req.Data, err = ioutil.ReadFile(n.log.snapshotPath()); err != nil {
+		log.Errorf("error reading snapshot: %v", err)
+		return false
+	}
+
+	n.mtx.Unlock()
+	resp, err := n.trans.InstallSnapshot(p.Addr, req)
+	n.mtx.Lock()
+
+	if err != nil || !n.handleResponse(p.ID, term, resp.Term) {
+		return false
+	}
+
+	log.Infof("Sent snapshot at entry %d to %s", req.LastIndex, p.ID)
+
+	if req.LastIndex > n.matchIndex[p.ID] {
+		n.matchIndex[p.ID] = req.LastIndex
+		n.nextIndex[p.ID] = req.LastIndex + 1
+		n.advanceCommit()
+	}
+
+	return n.nextIndex[p.ID] <= n.log.lastIndex()
+}
+
+// handleResponse records the response of a member of the cluster to an RPC sent by the leader
+// of a term, and reports whether the node is still the leader of the term. It must be called with
+// the lock held.
+func (n *Node) handleResponse(id string, term uint64, respTerm uint64) bool {
+	if respTerm > n.log.term {
+		n.becomeFollower(respTerm, "")
+		return false
+	}
+
+	if n.state != Leader || n.log.term != term {
+		return false
+	}
+
+	n.lastContact[id] = time.Now()
+	return true
+}
+
+// advanceCommit commits the last entry of the current term that a majority of the cluster has
+// stored, along with every entry before it. It must be called with the lock held.
+func (n *Node) advanceCommit() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.log.entryTerm(index); term != n.log.term {
+			break
+		}
+
+		count := 0
+		for _, p := range n.peers {
+			if p.ID == n.id || n.matchIndex[p.ID] >= index {
+				count++
+			}
+		}
+
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			n.signal()
+			break
+		}
+	}
+
+	// A leader that removed itself from the cluster steps down once the removal is committed.
+	if _, ok := n.peer(n.id); !ok && n.configIndex <= n.commitIndex {
+		log.Infof("Removed from the cluster, stepping down")
+		n.becomeFollower(n.log.term, "")
+	}
+}
+
+// hasQuorumContact reports whether a majority of the cluster has responded to the leader within
+// an election timeout. It must be called with the lock held.
+func (n *Node) hasQuorumContact(now time.Time) bool {
+	count := 0
+	for _, p := range n.peers {
+		if p.ID == n.id || now.Sub(n.lastContact[p.ID]) < n.conf.ElectionTimeout {
+			count++
+		}
+	}
+
+	return count >= n.quorum()
+}
+
+// appendEntry appends an entry of the current term to the log of the leader, returning its index.
+// It must be called with the lock held.
+func (n *Node) appendEntry(typ EntryType, data []byte) (uint64, error) {
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.log.term, Type: typ, Data: data}
+	if err := n.log.append(e); err != nil {
+		return 0, err
+	}
+
+	if typ == EntryConfig {
+		n.updateConfig()
+	}
+
+	n.signal()
+	return e.Index, nil
+}
+
+// start appends an entry to the log of the leader, returning the proposal that is answered once
+// the entry is applied. It must be called with the lock held.
+func (n *Node) start(typ EntryType, data []byte) (*proposal, error) {
+	if n.closed {
+		return nil, ErrClosed
+	}
+
+	if n.state != Leader {
+		return nil, ErrNotLeader
+	}
+
+	index, err := n.appendEntry(typ, data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &proposal{term: n.log.term, done: make(chan result, 1)}
+	n.pending[index] = p
+
+	// A cluster of one commits the entry right away.
+	n.advanceCommit()
+	return p, nil
+}
+
+// wait waits for a proposal to be answered.
+func (n *Node) wait(p *proposal) (bool, error) {
+	select {
+	case r := <-p.done:
+		return r.ok, r.err
+	case <-n.done:
+		return false, ErrClosed
+	}
+}
+
+// failPending fails the writes that are waiting to be committed. The writes that are committed
+// are answered once they are applied. It must be called with the lock held.
+func (n *Node) failPending(err error) {
+	for index, p := range n.pending {
+		if index > n.commitIndex {
+			delete(n.pending, index)
+			p.done <- result{err: err}
+		}
+	}
+}
+
+// propose replicates a write to the store, and waits for it to be applied by the leader.
+func (n *Node) propose(o *op) (bool, error) {
+	n.mtx.Lock()
+	p, err := n.start(EntryCommand, o.encode())
+	n.mtx.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	return n.wait(p)
+}
+
+// Set inserts a key-value pair into the replicated store. It fails with ErrNotLeader unless the
+// node is the leader.
+func (n *Node) Set(key []byte, value []byte) error {
+	_, err := n.propose(&op{typ: opSet, key: key, value: value})
+	return err
+}
+
+// SetWithTTL inserts a key-value pair into the replicated store that expires after the specified
+// duration.
+func (n *Node) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	_, err := n.propose(&op{typ: opSet, key: key, value: value, expiry: time.Now().Add(ttl).UnixNano()})
+	return err
+}
+
+// Remove removes a key from the replicated store. Returns true only if the key existed.
+func (n *Node) Remove(key []byte) (bool, error) {
+	return n.propose(&op{typ: opRemove, key: key})
+}
+
+// Expire sets the time after which an existing key of the replicated store expires. Returns true
+// only if the key exists.
+func (n *Node) Expire(key []byte, ttl time.Duration) (bool, error) {
+	return n.propose(&op{typ: opExpire, key: key, expiry: time.Now().Add(ttl).UnixNano()})
+}
+
+// Persist removes the expiry of a key of the replicated store. Returns true only if the key
+// exists and had an expiry.
+func (n *Node) Persist(key []byte) (bool, error) {
+	return n.propose(&op{typ: opPersist, key: key})
+}
+
+// AddPeer adds a member to the cluster, or changes the addresses of an existing member. The new
+// member should be started without peers beforehand, and receives the log from the leader.
+func (n *Node) AddPeer(peer Peer) error {
+	return n.changeConfig(func(peers []Peer) ([]Peer, error) {
+		for i, p := range peers {
+			if p.ID == peer.ID {
+				peers[i] = peer
+				return peers, nil
+			}
+		}
+
+		return append(peers, peer), nil
+	})
+}
+
+// RemovePeer removes a member from the cluster. A leader can remove itself, in which case it
+// steps down once the removal is committed.
+func (n *Node) RemovePeer(id string) error {
+	return n.changeConfig(func(peers []Peer) ([]Peer, error) {
+		for i, p := range peers {
+			if p.ID == id {
+				return append(peers[:i], peers[i+1:]...), nil
+			}
+		}
+
+		return nil, fmt.Errorf("cluster: no such peer '%s'", id)
+	})
+}
+
+// changeConfig changes the members of the cluster by one at a time, which guarantees that the
+// majorities of the old and new configurations overlap. A change can only be made once the
+// previous one is committed.
+func (n *Node) changeConfig(change func(peers []Peer) ([]Peer, error)) error {
+	n.mtx.Lock()
+	if n.state == Leader && n.configIndex > n.commitIndex {
+		n.mtx.Unlock()
+		return ErrMembershipChange
+	}
+
+	peers, err := change(append([]Peer(nil), n.peers...))
+	if err != nil {
+		n.mtx.Unlock()
+		return err
+	}
+
+	p, err := n.start(EntryConfig, encodePeers(peers))
+	n.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = n.wait(p)
+	return err
+}
@@ -0,0 +1,400 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// EntryType is the type of an entry of the log.
+type EntryType uint8
+
+const (
+	// EntryNoop is appended by a leader when it is elected, so that the entries of previous terms
+	// are committed along with it.
+	EntryNoop EntryType = iota
+
+	// EntryCommand holds a write to the store.
+	EntryCommand
+
+	// EntryConfig holds the members of the cluster, which take effect as soon as the entry is
+	// appended to the log.
+	EntryConfig
+)
+
+// Entry is an entry of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+const (
+	stateFileName    = "state"
+	logFileName      = "log"
+	snapshotFileName = "snapshot"
+
+	// restoreFileName marks a snapshot that was being restored to the store when the node
+	// stopped, which must be restored again.
+	restoreFileName = "restore"
+)
+
+// entryHeaderSize is the size of the header of an entry in the log file: the CRC-32 of the rest
+// of the record, and the length of the data.
+const entryHeaderSize = 8
+
+// entryFixedSize is the size of the fixed-size fields of an entry in the log file: the index, the
+// term and the type.
+const entryFixedSize = 17
+
+// errCorruptEntry is returned when an entry of the log file does not match its checksum.
+var errCorruptEntry = errors.New("corrupt entry")
+
+// persistentState is the state of a node that must survive restarts, other than its log.
+type persistentState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+}
+
+// logStore holds the persistent state of a node: its current term and vote, the metadata of its
+// last snapshot, and the entries of its log that follow the snapshot.
+type logStore struct {
+	dir string
+	f   *os.File
+
+	term uint64
+	vote string
+
+	// snapIndex and snapTerm are the index and term of the last entry included in the snapshot,
+	// and snapPeers are the members of the cluster as of that entry. Without a snapshot, they
+	// are zero and the initial members.
+	snapIndex uint64
+	snapTerm  uint64
+	snapPeers []Peer
+
+	// entries[i] is the entry at index snapIndex+1+i.
+	entries []Entry
+}
+
+// openLog opens the persistent state of a node in a directory, creating it if it does not exist.
+// peers are the members of the cluster if the node has no snapshot.
+func openLog(dir string, peers []Peer) (*logStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &logStore{dir: dir, snapPeers: peers}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		var state persistentState
+		if err := json.Unmarshal(b, &state); err != nil {
+			return nil, fmt.Errorf("cluster: invalid state file: %v", err)
+		}
+
+		l.term, l.vote = state.Term, state.Vote
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	meta, err := readSnapshotMeta(l.snapshotPath())
+	if err == nil {
+		l.snapIndex, l.snapTerm, l.snapPeers = meta.Index, meta.Term, meta.Peers
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// load reads the entries of the log file that follow the snapshot. A partially written entry at
+// the end of the file, left by a crash, is discarded.
+func (l *logStore) load() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rd := bufio.NewReader(f)
+
+	var offset int64
+	for {
+		e, n, err := readEntry(rd, info.Size()-offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptEntry {
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+
+		// Entries included in the snapshot are left over from a crash before the log file was
+		// rewritten.
+		if e.Index > l.snapIndex {
+			if e.Index != l.lastIndex()+1 {
+				f.Close()
+				return fmt.Errorf("cluster: log file has entry %d after entry %d", e.Index, l.lastIndex())
+			}
+
+			l.entries = append(l.entries, e)
+		}
+
+		offset += n
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	return nil
+}
+
+// readEntry reads an entry of the log file, returning it along with its size in the file. The
+// entry must fit in the remaining bytes of the file, so that a damaged length is not trusted
+// before the checksum is verified.
+func readEntry(rd io.Reader, remaining int64) (Entry, int64, error) {
+	var header [entryHeaderSize + entryFixedSize]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return Entry{}, 0, err
+	}
+
+	crc := binary.BigEndian.Uint32(header[0:])
+	size := binary.BigEndian.Uint32(header[4:])
+	if int64(size) > remaining-int64(len(header)) {
+		return Entry{}, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return Entry{}, 0, err
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(header[entryHeaderSize:])
+	h.Write(data)
+	if h.Sum32() != crc {
+		return Entry{}, 0, errCorruptEntry
+	}
+
+	e := Entry{
+		Index: binary.BigEndian.Uint64(header[8:]),
+		Term:  binary.BigEndian.Uint64(header[16:]),
+		Type:  EntryType(header[24]),
+		Data:  data,
+	}
+
+	return e, int64(len(header)) + int64(size), nil
+}
+
+// writeEntry writes an entry in the format of the log file.
+func writeEntry(w io.Writer, e *Entry) error {
+	var header [entryHeaderSize + entryFixedSize]byte
+	binary.BigEndian.PutUint32(header[4:], uint32(len(e.Data)))
+	binary.BigEndian.PutUint64(header[8:], e.Index)
+	binary.BigEndian.PutUint64(header[16:], e.Term)
+	header[24] = byte(e.Type)
+
+	h := crc32.NewIEEE()
+	h.Write(header[entryHeaderSize:])
+	h.Write(e.Data)
+	binary.BigEndian.PutUint32(header[0:], h.Sum32())
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(e.Data)
+	return err
+}
+
+// setState persists the current term and vote.
+func (l *logStore) setState(term uint64, vote string) error {
+	b, err := json.Marshal(persistentState{Term: term, Vote: vote})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileSync(filepath.Join(l.dir, stateFileName), b); err != nil {
+		return err
+	}
+
+	l.term, l.vote = term, vote
+	return nil
+}
+
+// lastIndex returns the index of the last entry of the log.
+func (l *logStore) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the last entry of the log.
+func (l *logStore) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+
+	return l.entries[len(l.entries)-1].Term
+}
+
+// entryTerm returns the term of the entry at an index, if the entry is in the log or is the last
+// entry of the snapshot.
+func (l *logStore) entryTerm(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+// slice returns a copy of the entries from lo up to, but not including, hi. The entries must
+// follow the snapshot.
+func (l *logStore) slice(lo, hi uint64) []Entry {
+	if hi <= lo {
+		return nil
+	}
+
+	return append([]Entry(nil), l.entries[lo-l.snapIndex-1:hi-l.snapIndex-1]...)
+}
+
+// append appends entries to the log and synchronizes them to disk.
+func (l *logStore) append(entries ...Entry) error {
+	w := bufio.NewWriter(l.f)
+	for i := range entries {
+		if err := writeEntry(w, &entries[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncate removes the entries from an index to the end of the log.
+func (l *logStore) truncate(index uint64) error {
+	l.entries = l.entries[:index-l.snapIndex-1]
+	return l.rewrite()
+}
+
+// compact discards the entries up to and including an index, which are included in a snapshot
+// that has been saved. If the log does not contain the entry at the index with the same term,
+// then the whole log is discarded.
+func (l *logStore) compact(index, term uint64, peers []Peer) error {
+	if t, ok := l.entryTerm(index); ok && t == term {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	} else {
+		l.entries = nil
+	}
+
+	l.snapIndex, l.snapTerm, l.snapPeers = index, term, peers
+	return l.rewrite()
+}
+
+// rewrite replaces the log file with one that holds the entries of the log.
+func (l *logStore) rewrite() error {
+	path := filepath.Join(l.dir, logFileName)
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for i := range l.entries {
+		if err := writeEntry(w, &l.entries[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+func (l *logStore) snapshotPath() string {
+	return filepath.Join(l.dir, snapshotFileName)
+}
+
+func (l *logStore) close() error {
+	return l.f.Close()
+}
+
+// writeFileSync writes a file atomically, by writing a temporary file that replaces it once it
+// has been synchronized to disk.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
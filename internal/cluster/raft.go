@@ -0,0 +1,846 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultHeartbeatInterval is the interval at which the leader sends heartbeats, when no other
+	// interval is configured.
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+
+	// DefaultElectionTimeout is the minimum time a follower waits without hearing from a leader
+	// before it starts an election, when no other timeout is configured.
+	DefaultElectionTimeout = time.Second
+
+	// DefaultSnapshotThreshold is the number of entries applied since the last snapshot after
+	// which a new snapshot is taken, when no other threshold is configured.
+	DefaultSnapshotThreshold = 8192
+)
+
+// maxAppendEntries is the maximum number of entries sent in a single AppendEntriesRequest.
+const maxAppendEntries = 256
+
+var (
+	// ErrNotLeader is returned when a write is sent to a node that is not the leader.
+	ErrNotLeader = errors.New("cluster: node is not the leader")
+
+	// ErrLeadershipLost is returned when the node stops being the leader before a write it
+	// accepted is committed. The write may or may not be applied.
+	ErrLeadershipLost = errors.New("cluster: leadership lost before the write was committed")
+
+	// ErrMembershipChange is returned when a change to the members of the cluster is requested
+	// while another one has not been committed yet.
+	ErrMembershipChange = errors.New("cluster: a membership change is already in progress")
+
+	// ErrClosed is returned once the node has been closed.
+	ErrClosed = errors.New("cluster: node is closed")
+)
+
+// State is the role of a node in the cluster.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+
+	return "unknown"
+}
+
+// Peer is a member of the cluster.
+type Peer struct {
+	ID string
+
+	// Addr is the address on which the node serves the RPCs of the cluster.
+	Addr string
+
+	// ClientAddr is the address on which the node serves clients, which are redirected to it when
+	// it is the leader.
+	ClientAddr string
+}
+
+// Conf represents the configuration options for a node.
+type Conf struct {
+	// ID identifies the node in the cluster. It is required.
+	ID string
+
+	// Dir is the directory in which the node keeps its log and snapshots. It is required, and
+	// must not be the directory of the store.
+	Dir string
+
+	// Peers are the initial members of the cluster, including the node itself. They are only used
+	// when the node starts without any state. A node that joins an existing cluster starts with
+	// no peers, and learns about them once it is added by the leader.
+	Peers []Peer
+
+	// Transport sends RPCs to the other nodes. If it is nil, then a TCPTransport is used.
+	Transport Transport
+
+	// HeartbeatInterval is the interval at which the leader sends heartbeats. If it is zero,
+	// then DefaultHeartbeatInterval is used.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is the minimum time a follower waits without hearing from a leader before
+	// it starts an election. The actual timeout is chosen at random, up to twice as long. If it
+	// is zero, then DefaultElectionTimeout is used.
+	ElectionTimeout time.Duration
+
+	// SnapshotThreshold is the number of entries applied since the last snapshot after which a
+	// new snapshot is taken. If it is zero, then DefaultSnapshotThreshold is used.
+	SnapshotThreshold uint64
+}
+
+// Node is a member of a cluster that replicates a store. Writes are sent to the leader, which
+// applies them to the store of every node once they are committed. Reads are served by every
+// node from its own store, which may lag behind the leader.
+type Node struct {
+	id    string
+	keys  *keychain.Keychain
+	conf  Conf
+	log   *logStore
+	rpc   *rpc.Server
+	trans Transport
+
+	// ownTransport is set if the transport was created by the node, which closes it.
+	ownTransport bool
+
+	// applyMtx is held while entries or snapshots are applied to the store. It is acquired
+	// before mtx.
+	applyMtx sync.Mutex
+
+	mtx       sync.Mutex
+	applyCond *sync.Cond
+	state     State
+	leader    string
+
+	// peers are the members of the cluster as of the last configuration entry of the log, at
+	// configIndex, or as of the snapshot if configIndex is zero.
+	peers       []Peer
+	configIndex uint64
+
+	commitIndex uint64
+	lastApplied uint64
+
+	// deadline is the time at which the node starts an election if it has not heard from a
+	// leader.
+	deadline time.Time
+
+	// The state of the leader, by peer ID: the index of the next entry to send, the index of the
+	// last entry known to be replicated, the time of the last response, and the channel that
+	// wakes up the goroutine replicating to the peer.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastContact map[string]time.Time
+	triggers    map[string]chan struct{}
+
+	// pending holds the writes accepted by the leader that have not been applied yet, by index.
+	pending map[uint64]*proposal
+
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// proposal is a write accepted by the leader, which is answered once its entry is applied.
+type proposal struct {
+	term uint64
+	done chan result
+}
+
+type result struct {
+	ok  bool
+	err error
+}
+
+// New starts a node that replicates the specified store. The store must only be written to
+// through the node. The node starts as a follower, and the nodes elect a leader once they can
+// reach each other. The store is not closed when the node is.
+func New(keys *keychain.Keychain, conf *Conf) (*Node, error) {
+	if conf.ID == "" {
+		return nil, errors.New("cluster: node ID is required")
+	}
+
+	if conf.Dir == "" {
+		return nil, errors.New("cluster: directory is required")
+	}
+
+	n := &Node{
+		id:          conf.ID,
+		keys:        keys,
+		conf:        *conf,
+		trans:       conf.Transport,
+		pending:     make(map[uint64]*proposal),
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastContact: make(map[string]time.Time),
+		triggers:    make(map[string]chan struct{}),
+	}
+
+	if n.conf.HeartbeatInterval == 0 {
+		n.conf.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if n.conf.ElectionTimeout == 0 {
+		n.conf.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	if n.conf.SnapshotThreshold == 0 {
+		n.conf.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	var err error
+	if n.log, err = openLog(conf.Dir, conf.Peers); err != nil {
+		return nil, err
+	}
+
+	// A snapshot that was being restored when the node stopped left the store in an unknown
+	// state, so it is restored again.
+	if _, err := os.Stat(filepath.Join(conf.Dir, restoreFileName)); err == nil {
+		if err := n.restore(); err != nil {
+			n.log.close()
+			return nil, err
+		}
+	}
+
+	if n.trans == nil {
+		n.trans = NewTCPTransport(0)
+		n.ownTransport = true
+	}
+
+	n.rpc = rpc.NewServer()
+	if err := n.rpc.RegisterName("Raft", &service{n}); err != nil {
+		n.log.close()
+		return nil, err
+	}
+
+	// The store already holds the entries that were applied before the node stopped, and
+	// applying them again from the snapshot onwards leaves it in the same state.
+	n.commitIndex = n.log.snapIndex
+	n.lastApplied = n.log.snapIndex
+	n.applyCond = sync.NewCond(&n.mtx)
+	n.updateConfig()
+	n.resetDeadline()
+
+	n.wg.Add(2)
+	go n.tick()
+	go n.applyEntries()
+
+	return n, nil
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// State returns the current role of the node.
+func (n *Node) State() State {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.state
+}
+
+// Term returns the current term of the node.
+func (n *Node) Term() uint64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.log.term
+}
+
+// Leader returns the leader of the cluster, as far as the node knows.
+func (n *Node) Leader() (Peer, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.leader == "" {
+		return Peer{}, false
+	}
+
+	return n.peer(n.leader)
+}
+
+// Peers returns the members of the cluster.
+func (n *Node) Peers() []Peer {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return append([]Peer(nil), n.peers...)
+}
+
+// CommitIndex returns the index of the last entry known to be committed.
+func (n *Node) CommitIndex() uint64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.commitIndex
+}
+
+// AppliedIndex returns the index of the last entry applied to the store.
+func (n *Node) AppliedIndex() uint64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.lastApplied
+}
+
+// Close stops the node. Writes that are waiting to be committed fail with ErrClosed.
+func (n *Node) Close() error {
+	n.mtx.Lock()
+	if n.closed {
+		n.mtx.Unlock()
+		return nil
+	}
+
+	n.closed = true
+	close(n.done)
+	n.applyCond.Broadcast()
+
+	for lis := range n.listeners {
+		lis.Close()
+	}
+
+	for conn := range n.conns {
+		conn.Close()
+	}
+
+	n.mtx.Unlock()
+
+	if n.ownTransport {
+		n.trans.(*TCPTransport).Close()
+	}
+
+	n.wg.Wait()
+
+	// A snapshot may still be being restored.
+	n.applyMtx.Lock()
+	defer n.applyMtx.Unlock()
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.log.close()
+}
+
+// tick starts elections when a follower has not heard from a leader in time, and makes a leader
+// that has lost contact with a majority of the cluster step down, so that clients are not sent to
+// a leader that cannot commit their writes.
+func (n *Node) tick() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.conf.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-n.done:
+			return
+		case now = <-ticker.C:
+		}
+
+		n.mtx.Lock()
+		if n.state == Leader {
+			if !n.hasQuorumContact(now) {
+				log.Warnf("Lost contact with a majority of the cluster in term %d, stepping down", n.log.term)
+				n.becomeFollower(n.log.term, "")
+			}
+		} else if now.After(n.deadline) {
+			n.campaign()
+		}
+
+		n.mtx.Unlock()
+	}
+}
+
+// resetDeadline chooses a new election deadline at random. It must be called with the lock held.
+func (n *Node) resetDeadline() {
+	timeout := n.conf.ElectionTimeout + time.Duration(rand.Int63n(int64(n.conf.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// campaign starts an election for the next term, unless the node is not a member of the cluster.
+// It must be called with the lock held.
+func (n *Node) campaign() {
+	n.resetDeadline()
+	if _, ok := n.peer(n.id); !ok {
+		return
+	}
+
+	term := n.log.term + 1
+	if err := n.log.setState(term, n.id); err != nil {
+		log.Errorf("error starting election: %v", err)
+		return
+	}
+
+	n.state = Candidate
+	n.leader = ""
+	log.Infof("Starting election for term %d", term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+
+	for _, p := range n.peers {
+		if p.ID == n.id {
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(p Peer) {
+			defer n.wg.Done()
+
+			resp, err := n.trans.RequestVote(p.Addr, req)
+			if err != nil {
+				return
+			}
+
+			n.mtx.Lock()
+			defer n.mtx.Unlock()
+
+			if resp.Term > n.log.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+
+			if n.state != Candidate || n.log.term != term || !resp.VoteGranted {
+				return
+			}
+
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// becomeFollower makes the node a follower in a term, which is at least its current term. It
+// must be called with the lock held.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.log.term {
+		if err := n.log.setState(term, ""); err != nil {
+			log.Errorf("error updating term: %v", err)
+		}
+	}
+
+	if n.state == Leader {
+		n.failPending(ErrLeadershipLost)
+		n.triggers = make(map[string]chan struct{})
+	}
+
+	if leader != "" && leader != n.leader {
+		log.Infof("Following leader %s in term %d", leader, term)
+	}
+
+	n.state = Follower
+	n.leader = leader
+	n.resetDeadline()
+}
+
+// quorum returns the number of members that form a majority of the cluster. It must be called
+// with the lock held.
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+// peer returns the member of the cluster with an ID. It must be called with the lock held.
+func (n *Node) peer(id string) (Peer, bool) {
+	for _, p := range n.peers {
+		if p.ID == id {
+			return p, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+// configAt returns the members of the cluster as of an entry of the log, along with the index of
+// the configuration entry they come from. It must be called with the lock held.
+func (n *Node) configAt(index uint64) ([]Peer, uint64) {
+	for i := index; i > n.log.snapIndex; i-- {
+		if e := &n.log.entries[i-n.log.snapIndex-1]; e.Type == EntryConfig {
+			peers, err := decodePeers(e.Data)
+			if err != nil {
+				log.Errorf("error decoding configuration entry %d: %v", i, err)
+				continue
+			}
+
+			return peers, i
+		}
+	}
+
+	return n.log.snapPeers, 0
+}
+
+// updateConfig makes the last configuration of the log the current one. It must be called with
+// the lock held whenever entries are added to or removed from the log.
+func (n *Node) updateConfig() {
+	n.peers, n.configIndex = n.configAt(n.log.lastIndex())
+	if n.state == Leader {
+		n.startReplication()
+	}
+}
+
+func encodePeers(peers []Peer) []byte {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(peers)
+	return buf.Bytes()
+}
+
+func decodePeers(b []byte) ([]Peer, error) {
+	var peers []Peer
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&peers)
+	return peers, err
+}
+
+// handleRequestVote grants a vote to a candidate whose log is at least as up to date as that of
+// the node, if the node has not voted for another candidate in the term.
+func (n *Node) handleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.closed {
+		return &RequestVoteResponse{Term: n.log.term}
+	}
+
+	if req.Term > n.log.term {
+		n.becomeFollower(req.Term, "")
+	}
+
+	resp := &RequestVoteResponse{Term: n.log.term}
+	if req.Term < n.log.term {
+		return resp
+	}
+
+	upToDate := req.LastLogTerm > n.log.lastTerm() ||
+		(req.LastLogTerm == n.log.lastTerm() && req.LastLogIndex >= n.log.lastIndex())
+
+	if (n.log.vote == "" || n.log.vote == req.CandidateID) && upToDate {
+		if err := n.log.setState(req.Term, req.CandidateID); err != nil {
+			log.Errorf("error recording vote: %v", err)
+			return resp
+		}
+
+		resp.VoteGranted = true
+		n.resetDeadline()
+	}
+
+	return resp
+}
+
+// handleAppendEntries appends the entries sent by the leader to the log, replacing any entries
+// that conflict with them, provided that the log matches that of the leader up to the entries.
+func (n *Node) handleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	resp := &AppendEntriesResponse{Term: n.log.term}
+	if n.closed || req.Term < n.log.term {
+		return resp
+	}
+
+	n.becomeFollower(req.Term, req.LeaderID)
+	resp.Term = n.log.term
+
+	// Entries that are included in the snapshot are already committed.
+	entries := req.Entries
+	prevIndex, prevTerm := req.PrevLogIndex, req.PrevLogTerm
+	if prevIndex < n.log.snapIndex {
+		if skip := n.log.snapIndex - prevIndex; uint64(len(entries)) > skip {
+			entries = entries[skip:]
+		} else {
+			entries = nil
+		}
+
+		prevIndex, prevTerm = n.log.snapIndex, n.log.snapTerm
+	}
+
+	if prevIndex > n.log.lastIndex() {
+		resp.ConflictIndex = n.log.lastIndex() + 1
+		return resp
+	}
+
+	if term, _ := n.log.entryTerm(prevIndex); term != prevTerm {
+		// The leader skips the whole term of the conflicting entry, instead of going back one
+		// entry at a time.
+		index := prevIndex
+		for index > n.log.snapIndex+1 {
+			if t, _ := n.log.entryTerm(index - 1); t != term {
+				break
+			}
+
+			index--
+		}
+
+		resp.ConflictIndex = index
+		return resp
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.log.lastIndex() {
+			if term, _ := n.log.entryTerm(e.Index); term == e.Term {
+				continue
+			}
+
+			if e.Index <= n.commitIndex {
+				log.Errorf("leader %s sent entry %d conflicting with a committed entry", req.LeaderID, e.Index)
+				return resp
+			}
+
+			if err := n.log.truncate(e.Index); err != nil {
+				log.Errorf("error truncating log: %v", err)
+				return resp
+			}
+		}
+
+		if err := n.log.append(entries[i:]...); err != nil {
+			log.Errorf("error appending to log: %v", err)
+			return resp
+		}
+
+		n.updateConfig()
+		break
+	}
+
+	if lastNew := prevIndex + uint64(len(entries)); req.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+
+		n.applyCond.Broadcast()
+	}
+
+	resp.Success = true
+	return resp
+}
+
+// handleInstallSnapshot replaces the store and the log with a snapshot sent by the leader, unless
+// the log already holds the entries it includes.
+func (n *Node) handleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.applyMtx.Lock()
+	defer n.applyMtx.Unlock()
+
+	n.mtx.Lock()
+	resp := &InstallSnapshotResponse{Term: n.log.term}
+	if n.closed || req.Term < n.log.term {
+		n.mtx.Unlock()
+		return resp, nil
+	}
+
+	n.becomeFollower(req.Term, req.LeaderID)
+	resp.Term = n.log.term
+
+	if req.LastIndex <= n.commitIndex {
+		n.mtx.Unlock()
+		return resp, nil
+	}
+
+	meta, err := n.installSnapshot(req)
+	n.mtx.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The store is restored without the lock held, so that the node keeps answering heartbeats.
+	// Entries are not applied meanwhile, since applyMtx is held.
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	// Entries after the snapshot may have been committed while it was restored.
+	if n.commitIndex < meta.Index {
+		n.commitIndex = meta.Index
+	}
+
+	n.lastApplied = meta.Index
+
+	// The deadline is reset again, since restoring the snapshot may have taken a while.
+	n.resetDeadline()
+	return resp, nil
+}
+
+// installSnapshot replaces the snapshot and the log of the node with the snapshot that it
+// received, returning its metadata. The store is left to be restored from the snapshot. It must
+// be called with the lock held.
+func (n *Node) installSnapshot(req *InstallSnapshotRequest) (*snapshotMeta, error) {
+	log.Infof("Installing snapshot from %s at entry %d", req.LeaderID, req.LastIndex)
+
+	// The snapshot is marked as being restored before it replaces the current one, so that it is
+	// restored again if the node stops before it is done.
+	path := n.log.snapshotPath()
+	if err := writeFileSync(path+".install", req.Data); err != nil {
+		return nil, err
+	}
+
+	meta, err := readSnapshotMeta(path + ".install")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileSync(filepath.Join(n.log.dir, restoreFileName), nil); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path+".install", path); err != nil {
+		return nil, err
+	}
+
+	if err := n.log.compact(meta.Index, meta.Term, meta.Peers); err != nil {
+		return nil, err
+	}
+
+	n.updateConfig()
+	return meta, nil
+}
+
+// restore restores the snapshot to the store, and removes the mark that it is being restored.
+func (n *Node) restore() error {
+	if err := restoreSnapshot(n.keys, n.log.snapshotPath()); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(n.log.dir, restoreFileName))
+}
+
+// applyEntries applies the committed entries to the store in order, and takes a snapshot once
+// enough of them have been applied since the last one.
+func (n *Node) applyEntries() {
+	defer n.wg.Done()
+
+	for {
+		n.mtx.Lock()
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+
+		closed := n.closed
+		n.mtx.Unlock()
+
+		if closed {
+			return
+		}
+
+		n.applyMtx.Lock()
+
+		// A snapshot may have been installed in the meantime.
+		n.mtx.Lock()
+		entries := n.log.slice(n.lastApplied+1, n.commitIndex+1)
+		n.mtx.Unlock()
+
+		for _, e := range entries {
+			var r result
+			if e.Type == EntryCommand {
+				r = n.applyCommand(&e)
+			}
+
+			n.mtx.Lock()
+			n.lastApplied = e.Index
+			if p, ok := n.pending[e.Index]; ok {
+				delete(n.pending, e.Index)
+				if p.term != e.Term {
+					r = result{err: ErrLeadershipLost}
+				}
+
+				p.done <- r
+			}
+
+			n.mtx.Unlock()
+		}
+
+		n.mtx.Lock()
+		snapshot := n.lastApplied-n.log.snapIndex >= n.conf.SnapshotThreshold
+		n.mtx.Unlock()
+
+		if snapshot {
+			if err := n.snapshot(); err != nil {
+				log.Errorf("error taking snapshot: %v", err)
+			}
+		}
+
+		n.applyMtx.Unlock()
+	}
+}
+
+// applyCommand applies the write of a command entry to the store.
+func (n *Node) applyCommand(e *Entry) result {
+	o, err := decodeOp(e.Data)
+	if err != nil {
+		return result{err: err}
+	}
+
+	ok, err := o.apply(n.keys)
+	if err != nil {
+		log.Errorf("error applying entry %d: %v", e.Index, err)
+	}
+
+	return result{ok: ok, err: err}
+}
+
+// snapshot saves the keys of the store as a snapshot, and discards the entries of the log that it
+// includes. It must be called with applyMtx held, so that the store holds exactly the entries up to
+// the last applied one.
+func (n *Node) snapshot() error {
+	n.mtx.Lock()
+	meta := &snapshotMeta{Index: n.lastApplied}
+	meta.Term, _ = n.log.entryTerm(meta.Index)
+	meta.Peers, _ = n.configAt(meta.Index)
+	path := n.log.snapshotPath()
+	n.mtx.Unlock()
+
+	it := n.keys.Scan(nil)
+	defer it.Close()
+
+	if err := writeSnapshot(path, meta, it); err != nil {
+		return err
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	log.Infof("Took snapshot at entry %d", meta.Index)
+	return n.log.compact(meta.Index, meta.Term, meta.Peers)
+}
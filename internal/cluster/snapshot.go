@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"os"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+)
+
+// A snapshot is a file that holds the live keys of the store as of an entry of the log, so that
+// the entries up to it can be discarded. It is a stream of gob values: a snapshotMeta, followed by
+// a snapshotRecord for every key.
+
+// snapshotMeta describes the entry of the log that a snapshot was taken at.
+type snapshotMeta struct {
+	Index uint64
+	Term  uint64
+
+	// Peers are the members of the cluster as of the entry.
+	Peers []Peer
+}
+
+// snapshotRecord is a key of the store in a snapshot.
+type snapshotRecord struct {
+	Key    []byte
+	Value  []byte
+	Expiry int64
+}
+
+// restoreBatchSize is the number of keys that are written to the store at a time when a
+// snapshot is restored.
+const restoreBatchSize = 1000
+
+// writeSnapshot writes the keys that an iterator visits as a snapshot taken at an entry, replacing
+// the snapshot at the path once it has been synchronized to disk.
+func writeSnapshot(path string, meta *snapshotMeta, it *keychain.Iterator) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+
+	err = enc.Encode(meta)
+	for err == nil && it.Next() {
+		var value []byte
+		if value, err = it.Value(); err == nil {
+			err = enc.Encode(&snapshotRecord{Key: it.Key(), Value: value, Expiry: it.Expiry()})
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// readSnapshotMeta reads the metadata of the snapshot at a path.
+func readSnapshotMeta(path string) (*snapshotMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var meta snapshotMeta
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&meta); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// restoreSnapshot replaces the keys of the store with those of the snapshot at a path. Keys that
+// have expired since the snapshot was taken are skipped.
+func restoreSnapshot(keys *keychain.Keychain, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+
+	var meta snapshotMeta
+	if err := dec.Decode(&meta); err != nil {
+		return err
+	}
+
+	if err := keys.Clear(); err != nil {
+		return err
+	}
+
+	var batch keychain.Batch
+	for {
+		var r snapshotRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if r.Expiry != 0 {
+			if ttl := time.Until(time.Unix(0, r.Expiry)); ttl > 0 {
+				if err := keys.SetWithTTL(r.Key, r.Value, ttl); err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		batch.Set(r.Key, r.Value)
+		if batch.Len() == restoreBatchSize {
+			if err := keys.Write(&batch); err != nil {
+				return err
+			}
+
+			batch.Reset()
+		}
+	}
+
+	return keys.Write(&batch)
+}
@@ -0,0 +1,280 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultRPCTimeout is the timeout of the RPCs sent by a TCPTransport, when no other timeout is
+// configured.
+const DefaultRPCTimeout = time.Second
+
+// RequestVoteRequest is sent by candidates to gather votes.
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteResponse is the reply to a RequestVoteRequest.
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest is sent by the leader to replicate entries of its log, and as a heartbeat.
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse is the reply to an AppendEntriesRequest.
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+
+	// ConflictIndex is the index that the leader should send entries from next, if the entries
+	// were rejected because the log of the follower does not match that of the leader.
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest is sent by the leader to a follower whose next entries have already been
+// discarded from the log of the leader. Data is the whole snapshot file.
+type InstallSnapshotRequest struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Data      []byte
+}
+
+// InstallSnapshotResponse is the reply to an InstallSnapshotRequest.
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Transport sends RPCs to the other nodes of the cluster, by their address.
+type Transport interface {
+	RequestVote(addr string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// errRPCTimeout is returned by a TCPTransport when an RPC times out.
+var errRPCTimeout = errors.New("cluster: rpc timed out")
+
+// TCPTransport is a Transport that sends RPCs over TCP connections with net/rpc, to nodes serving
+// them with Node.Serve. A connection to each node is kept open.
+type TCPTransport struct {
+	timeout time.Duration
+
+	mtx     sync.Mutex
+	clients map[string]*rpc.Client
+	closed  bool
+}
+
+// NewTCPTransport returns a transport whose RPCs fail if they do not complete within the timeout.
+// If the timeout is zero, then DefaultRPCTimeout is used.
+func NewTCPTransport(timeout time.Duration) *TCPTransport {
+	if timeout == 0 {
+		timeout = DefaultRPCTimeout
+	}
+
+	return &TCPTransport{timeout: timeout, clients: make(map[string]*rpc.Client)}
+}
+
+// RequestVote sends a RequestVoteRequest to the node at addr.
+func (t *TCPTransport) RequestVote(addr string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	var resp RequestVoteResponse
+	return &resp, t.call(addr, "Raft.RequestVote", req, &resp)
+}
+
+// AppendEntries sends an AppendEntriesRequest to the node at addr.
+func (t *TCPTransport) AppendEntries(addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	var resp AppendEntriesResponse
+	return &resp, t.call(addr, "Raft.AppendEntries", req, &resp)
+}
+
+// InstallSnapshot sends an InstallSnapshotRequest to the node at addr.
+func (t *TCPTransport) InstallSnapshot(addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	var resp InstallSnapshotResponse
+	return &resp, t.call(addr, "Raft.InstallSnapshot", req, &resp)
+}
+
+// Close closes the connections of the transport. RPCs in progress fail.
+func (t *TCPTransport) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.closed = true
+	for addr, client := range t.clients {
+		client.Close()
+		delete(t.clients, addr)
+	}
+
+	return nil
+}
+
+// call sends an RPC, dropping the connection to the node if the RPC fails for any reason other
+// than an error returned by the node.
+func (t *TCPTransport) call(addr string, method string, req interface{}, resp interface{}) error {
+	client, err := t.client(addr)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case call := <-client.Go(method, req, resp, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-timer.C:
+		err = errRPCTimeout
+	}
+
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		t.drop(addr, client)
+	}
+
+	return err
+}
+
+// client returns the connection to the node at addr, connecting to it if necessary.
+func (t *TCPTransport) client(addr string) (*rpc.Client, error) {
+	t.mtx.Lock()
+	client, ok := t.clients[addr]
+	closed := t.closed
+	t.mtx.Unlock()
+
+	if closed {
+		return nil, rpc.ErrShutdown
+	} else if ok {
+		return client, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client = rpc.NewClient(conn)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	// Another RPC may have connected in the meantime, or the transport may have been closed.
+	if existing, ok := t.clients[addr]; ok || t.closed {
+		client.Close()
+		if t.closed {
+			return nil, rpc.ErrShutdown
+		}
+
+		return existing, nil
+	}
+
+	t.clients[addr] = client
+	return client, nil
+}
+
+// drop closes the connection to the node at addr, if it is still the current one.
+func (t *TCPTransport) drop(addr string, client *rpc.Client) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.clients[addr] == client {
+		delete(t.clients, addr)
+	}
+
+	client.Close()
+}
+
+// service exposes the RPC handlers of a node to net/rpc.
+type service struct {
+	n *Node
+}
+
+func (s *service) RequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	*resp = *s.n.handleRequestVote(req)
+	return nil
+}
+
+func (s *service) AppendEntries(req *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	*resp = *s.n.handleAppendEntries(req)
+	return nil
+}
+
+func (s *service) InstallSnapshot(req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	r, err := s.n.handleInstallSnapshot(req)
+	if err != nil {
+		return err
+	}
+
+	*resp = *r
+	return nil
+}
+
+// Serve accepts connections from the other nodes of the cluster on the listener and serves their
+// RPCs, until the node is closed. It always returns a non-nil error, which is ErrClosed if the
+// node was closed.
+func (n *Node) Serve(lis net.Listener) error {
+	n.mtx.Lock()
+	if n.closed {
+		n.mtx.Unlock()
+		lis.Close()
+		return ErrClosed
+	}
+
+	n.listeners[lis] = struct{}{}
+	n.mtx.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			n.mtx.Lock()
+			closed := n.closed
+			delete(n.listeners, lis)
+			n.mtx.Unlock()
+
+			if closed {
+				return ErrClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				n.mtx.Lock()
+				n.listeners[lis] = struct{}{}
+				n.mtx.Unlock()
+				continue
+			}
+
+			lis.Close()
+			return err
+		}
+
+		n.mtx.Lock()
+		if n.closed {
+			n.mtx.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+
+		n.conns[conn] = struct{}{}
+		n.mtx.Unlock()
+
+		go func() {
+			n.rpc.ServeConn(conn)
+
+			n.mtx.Lock()
+			delete(n.conns, conn)
+			n.mtx.Unlock()
+		}()
+	}
+}
@@ -4,6 +4,19 @@ type Entry struct {
 	FileID    uint64
 	ValueSize int64
 	ValuePos  int64
+	Timestamp int64
+	Expiry    int64
+
+	// Seq is the sequence number of the write that produced the entry, and Prev is the entry it
+	// replaced, if that is still needed by a snapshot. Neither is stored on disk.
+	Seq  uint64
+	Prev *Entry
+}
+
+// Expired reports whether the entry has an expiry time that is at or before now, which is given
+// in nanoseconds since the Unix epoch.
+func (e *Entry) Expired(now int64) bool {
+	return e.Expiry != 0 && e.Expiry <= now
 }
 
 func NewEntry(fileID uint64, valueSize int64, valuePos int64) *Entry {
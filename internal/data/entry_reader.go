@@ -1,62 +1,129 @@
 package data
 
 import (
-	"bufio"
-	"encoding/binary"
 	"io"
-	"io/ioutil"
 )
 
+// EntryReader reads the entries of a data file, which describe where the value of each record is
+// located, without keeping the values themselves. The entries of a batch are only returned once
+// the whole batch has been read.
 type EntryReader struct {
-	rd     *bufio.Reader
-	offset int64
-	fileID uint64
+	rd      *recordReader
+	fileID  uint64
+	offset  int64
+	pending []pendingEntry
+}
+
+// maxPendingPrealloc is the maximum number of entries of a batch that are allocated up front, so
+// that a damaged batch marker does not allocate memory for entries that are not there.
+const maxPendingPrealloc = 1024
+
+type pendingEntry struct {
+	key   []byte
+	entry *Entry
 }
 
 func NewEntryReader(rd io.Reader, fileID uint64) *EntryReader {
 	return &EntryReader{
-		rd:     bufio.NewReader(rd),
-		offset: 0,
+		rd:     newRecordReader(rd),
 		fileID: fileID,
 	}
 }
 
 func (r *EntryReader) ReadEntry() (key []byte, entry *Entry, err error) {
-	var keySize int64
-	if err = binary.Read(r.rd, binary.BigEndian, &keySize); err != nil {
-		return
+	if len(r.pending) == 0 {
+		if err := r.readPending(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	r.offset += 8
+	p := r.pending[0]
+	r.pending = r.pending[1:]
 
-	var valueSize int64
-	if err = binary.Read(r.rd, binary.BigEndian, &valueSize); err != nil {
-		return
+	return p.key, p.entry, nil
+}
+
+// readPending reads either a single record, or all of the records of a batch.
+func (r *EntryReader) readPending() error {
+	if err := r.rd.readVersion(); err != nil {
+		return err
 	}
 
-	r.offset += 8
+	// The first record starts after the file header, if there is one.
+	if r.offset == 0 {
+		r.offset = r.rd.offset
+	}
 
-	key = make([]byte, keySize)
-	n, err := io.ReadFull(r.rd, key)
+	key, entry, marker, err := r.readEntry()
 	if err != nil {
-		return
+		return err
+	}
+
+	if marker == nil {
+		r.pending = append(r.pending, pendingEntry{key: key, entry: entry})
+		r.offset = r.rd.offset
+		return nil
+	}
+
+	if marker.ValueSize < 0 {
+		return ErrCorrupted
+	}
+
+	// The number of entries is only trusted as far as the entries are actually there.
+	n := marker.ValueSize
+	if n > maxPendingPrealloc {
+		n = maxPendingPrealloc
 	}
 
-	r.offset += int64(n)
-	valuePos := r.offset
+	pending := make([]pendingEntry, 0, n)
+	for i := int64(0); i < marker.ValueSize; i++ {
+		key, entry, nested, err := r.readEntry()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
 
-	n2, err := io.CopyN(ioutil.Discard, r.rd, valueSize)
+		if nested != nil {
+			return ErrCorrupted
+		}
+
+		pending = append(pending, pendingEntry{key: key, entry: entry})
+	}
+
+	r.pending = pending
+	r.offset = r.rd.offset
+
+	// An empty batch has no entries to return, so move on to the next record.
+	if len(pending) == 0 {
+		return r.readPending()
+	}
+
+	return nil
+}
+
+// readEntry reads the next record, returning it as a batch marker if it is one.
+func (r *EntryReader) readEntry() (key []byte, entry *Entry, marker *Item, err error) {
+	item, valuePos, err := r.rd.readRecord(false)
 	if err != nil {
-		return
+		return nil, nil, nil, err
 	}
 
-	r.offset += n2
+	if item.IsBatchMarker() {
+		return nil, nil, item, nil
+	}
 
 	entry = &Entry{
 		FileID:    r.fileID,
-		ValueSize: valueSize,
+		ValueSize: item.ValueSize,
 		ValuePos:  valuePos,
+		Timestamp: item.Timestamp,
+		Expiry:    item.Expiry,
 	}
 
-	return
+	return item.Key, entry, nil, nil
+}
+
+// Offset returns the offset just past the last record that was read successfully. Records that
+// belong to a batch are only counted once the whole batch has been read.
+func (r *EntryReader) Offset() int64 {
+	return r.offset
 }
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Version0 is the original data file format. Version 0 data files have no file header, and
+	// their records consist of only the key size, value size, key and value.
+	Version0 = 0
+
+	// Version1 data files start with a file header, and each record is prefixed with a CRC32
+	// checksum of the rest of the record and the time at which it was written.
+	Version1 = 1
+
+	// Version2 records additionally hold the time at which the key expires.
+	Version2 = 2
+
+	// CurrentVersion is the format new data files are written in.
+	CurrentVersion = Version2
+)
+
+// FileHeaderSize is the size of the header at the start of versioned data files, which consists
+// of the magic bytes followed by the format version.
+const FileHeaderSize = 8
+
+// magic identifies a versioned data file.
+var magic = []byte("KCHN")
+
+// ErrCorrupted is returned when a record in a data file does not match its checksum.
+var ErrCorrupted = errors.New("data: corrupted record")
+
+// HeaderSize returns the size of the fixed-size portion of a record in the specified format.
+func HeaderSize(version int) int64 {
+	switch version {
+	case Version0:
+		return 2 * 8
+	case Version1:
+		return 4 + 3*8
+	default:
+		return 4 + 4*8
+	}
+}
+
+// recordHeader holds the fields of the fixed-size portion of a record.
+type recordHeader struct {
+	timestamp int64
+	expiry    int64
+	keySize   int64
+	valueSize int64
+}
+
+// parseHeader parses the fixed-size portion of a record in the specified format. The checksum,
+// if there is one, is not included.
+func parseHeader(version int, b []byte) recordHeader {
+	switch version {
+	case Version0:
+		return recordHeader{
+			keySize:   int64(binary.BigEndian.Uint64(b)),
+			valueSize: int64(binary.BigEndian.Uint64(b[8:])),
+		}
+	case Version1:
+		return recordHeader{
+			timestamp: int64(binary.BigEndian.Uint64(b[4:])),
+			keySize:   int64(binary.BigEndian.Uint64(b[12:])),
+			valueSize: int64(binary.BigEndian.Uint64(b[20:])),
+		}
+	default:
+		return recordHeader{
+			timestamp: int64(binary.BigEndian.Uint64(b[4:])),
+			expiry:    int64(binary.BigEndian.Uint64(b[12:])),
+			keySize:   int64(binary.BigEndian.Uint64(b[20:])),
+			valueSize: int64(binary.BigEndian.Uint64(b[28:])),
+		}
+	}
+}
+
+// ValueOffset returns the offset of the value from the start of a record in the specified format.
+func ValueOffset(version int, keyLen int) int64 {
+	return HeaderSize(version) + int64(keyLen)
+}
+
+// RecordSize returns the number of bytes a record with the given key and value lengths occupies
+// in a data file of the specified format.
+func RecordSize(version int, keyLen int, valueLen int) int64 {
+	return ValueOffset(version, keyLen) + int64(valueLen)
+}
+
+// ReadVersion returns the format of a data file, given its first bytes. An empty data file is in
+// the current format, since that is the format it will be written in. Formats newer than the
+// current one are rejected.
+func ReadVersion(r io.ReaderAt) (int, error) {
+	header := make([]byte, FileHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if n == 0 && err == io.EOF {
+		return CurrentVersion, nil
+	}
+
+	if n < FileHeaderSize || !bytes.Equal(header[:len(magic)], magic) {
+		return Version0, nil
+	}
+
+	version := int(binary.BigEndian.Uint32(header[len(magic):]))
+	if version > CurrentVersion {
+		return 0, fmt.Errorf("data: unsupported data file version %d", version)
+	}
+
+	return version, nil
+}
+
+// ReadValueAt reads the value of the record for the key whose value is located at the specified
+// position. For versioned data files, the whole record is read so that its checksum can be
+// verified, and ErrCorrupted is returned if it does not match.
+func ReadValueAt(r io.ReaderAt, version int, key []byte, valuePos int64, valueSize int64) ([]byte, error) {
+	if version == Version0 {
+		value := make([]byte, valueSize)
+		if _, err := r.ReadAt(value, valuePos); err != nil {
+			return nil, err
+		}
+
+		return value, nil
+	}
+
+	offset := ValueOffset(version, len(key))
+	record := make([]byte, offset+valueSize)
+	if _, err := r.ReadAt(record, valuePos-offset); err != nil {
+		if err == io.EOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(record) != crc32.ChecksumIEEE(record[4:]) {
+		return nil, ErrCorrupted
+	}
+
+	keySize := parseHeader(version, record).keySize
+	if keySize != int64(len(key)) || !bytes.Equal(record[HeaderSize(version):offset], key) {
+		return nil, ErrCorrupted
+	}
+
+	return record[offset:], nil
+}
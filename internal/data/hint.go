@@ -0,0 +1,111 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrCorruptHint is returned when a hint record does not match its checksum.
+var ErrCorruptHint = errors.New("data: corrupt hint record")
+
+// hintHeaderSize is the size of the fixed-size portion of a hint record: the checksum, followed
+// by the timestamp, expiry, key size, value size and value position. Hint files are rebuilt from
+// their data files whenever they fail to verify, so older hint layouts are simply replaced.
+const hintHeaderSize = 4 + 5*8
+
+// HintWriter writes hint records, which describe where the values of the keys in a data file
+// are located, so that the data file does not have to be scanned in full.
+type HintWriter struct {
+	wr  *bufio.Writer
+	buf []byte
+}
+
+func NewHintWriter(wr io.Writer) *HintWriter {
+	return &HintWriter{
+		wr:  bufio.NewWriter(wr),
+		buf: make([]byte, hintHeaderSize),
+	}
+}
+
+func (w *HintWriter) WriteHint(key []byte, entry *Entry) error {
+	binary.BigEndian.PutUint64(w.buf[4:], uint64(entry.Timestamp))
+	binary.BigEndian.PutUint64(w.buf[12:], uint64(entry.Expiry))
+	binary.BigEndian.PutUint64(w.buf[20:], uint64(len(key)))
+	binary.BigEndian.PutUint64(w.buf[28:], uint64(entry.ValueSize))
+	binary.BigEndian.PutUint64(w.buf[36:], uint64(entry.ValuePos))
+
+	crc := crc32.ChecksumIEEE(w.buf[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, key)
+	binary.BigEndian.PutUint32(w.buf, crc)
+
+	if _, err := w.wr.Write(w.buf); err != nil {
+		return err
+	}
+
+	_, err := w.wr.Write(key)
+	return err
+}
+
+func (w *HintWriter) Flush() error {
+	return w.wr.Flush()
+}
+
+// HintReader reads the hint records written by a HintWriter.
+type HintReader struct {
+	rd     *bufio.Reader
+	fileID uint64
+	buf    []byte
+}
+
+func NewHintReader(rd io.Reader, fileID uint64) *HintReader {
+	return &HintReader{
+		rd:     bufio.NewReader(rd),
+		fileID: fileID,
+		buf:    make([]byte, hintHeaderSize),
+	}
+}
+
+// ReadHint reads the next hint record. At the end of the hint file, io.EOF is returned. If the
+// hint file ends in the middle of a record, then io.ErrUnexpectedEOF is returned.
+func (r *HintReader) ReadHint() (key []byte, entry *Entry, err error) {
+	if _, err = io.ReadFull(r.rd, r.buf); err != nil {
+		return
+	}
+
+	keySize := int64(binary.BigEndian.Uint64(r.buf[20:]))
+	if keySize < 0 {
+		return nil, nil, ErrCorruptHint
+	}
+
+	// The key size has not been verified yet, so the key is read without allocating the
+	// full size up front.
+	var buf bytes.Buffer
+	if _, err = io.CopyN(&buf, r.rd, keySize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+
+	key = buf.Bytes()
+
+	crc := crc32.ChecksumIEEE(r.buf[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, key)
+	if crc != binary.BigEndian.Uint32(r.buf) {
+		return nil, nil, ErrCorruptHint
+	}
+
+	entry = &Entry{
+		FileID:    r.fileID,
+		ValueSize: int64(binary.BigEndian.Uint64(r.buf[28:])),
+		ValuePos:  int64(binary.BigEndian.Uint64(r.buf[36:])),
+		Timestamp: int64(binary.BigEndian.Uint64(r.buf[4:])),
+		Expiry:    int64(binary.BigEndian.Uint64(r.buf[12:])),
+	}
+
+	return
+}
@@ -5,6 +5,11 @@ type Item struct {
 	Key       []byte
 	ValueSize int64
 	Value     []byte
+	Timestamp int64
+
+	// Expiry is the time, in nanoseconds since the Unix epoch, at which the item expires, or
+	// zero if it never does.
+	Expiry int64
 }
 
 func NewItem(key []byte, value []byte) *Item {
@@ -34,3 +39,20 @@ func NewItemDeleteMarker(key []byte) *Item {
 		Value:     nil,
 	}
 }
+
+// batchKeySize is the key size that marks a record as the start of a batch.
+const batchKeySize = -2
+
+// NewBatchMarker returns the item that precedes a batch of the specified number of items. The
+// items of a batch are only applied if all of them were written.
+func NewBatchMarker(count int) *Item {
+	return &Item{
+		KeySize:   batchKeySize,
+		ValueSize: int64(count),
+	}
+}
+
+// IsBatchMarker reports whether the item marks the start of a batch.
+func (i *Item) IsBatchMarker() bool {
+	return i.KeySize == batchKeySize
+}
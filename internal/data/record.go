@@ -0,0 +1,152 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// recordReader reads the records of a data file sequentially, in whichever format the data file
+// was written in.
+type recordReader struct {
+	rd      *bufio.Reader
+	offset  int64
+	version int
+	started bool
+	header  []byte
+}
+
+func newRecordReader(rd io.Reader) *recordReader {
+	return &recordReader{
+		rd:     bufio.NewReader(rd),
+		header: make([]byte, HeaderSize(CurrentVersion)),
+	}
+}
+
+// readVersion determines the format of the data file from its file header, if it has one.
+func (r *recordReader) readVersion() error {
+	if r.started {
+		return nil
+	}
+
+	b, err := r.rd.Peek(FileHeaderSize)
+	if len(b) == 0 && err != nil {
+		return err
+	}
+
+	r.started = true
+	if len(b) < FileHeaderSize || !bytes.Equal(b[:len(magic)], magic) {
+		r.version = Version0
+		return nil
+	}
+
+	r.version = int(binary.BigEndian.Uint32(b[len(magic):]))
+	if r.version > CurrentVersion {
+		return fmt.Errorf("data: unsupported data file version %d", r.version)
+	}
+
+	if _, err := r.rd.Discard(FileHeaderSize); err != nil {
+		return err
+	}
+
+	r.offset = FileHeaderSize
+	return nil
+}
+
+// readRecord reads the next record. The value is only kept if withValue is set, but it is always
+// read in full so that the checksum of the record can be verified. At the end of the data file,
+// io.EOF is returned. If the data file ends in the middle of a record, then io.ErrUnexpectedEOF
+// is returned, and if the record does not match its checksum, then ErrCorrupted is returned. The
+// offset of the reader only advances past records that were read successfully.
+func (r *recordReader) readRecord(withValue bool) (item *Item, valuePos int64, err error) {
+	if err = r.readVersion(); err != nil {
+		return
+	}
+
+	header := r.header[:HeaderSize(r.version)]
+	if _, err = io.ReadFull(r.rd, header); err != nil {
+		return
+	}
+
+	fields := parseHeader(r.version, header)
+	item = &Item{
+		KeySize:   fields.keySize,
+		ValueSize: fields.valueSize,
+		Timestamp: fields.timestamp,
+		Expiry:    fields.expiry,
+	}
+
+	h := crc32.NewIEEE()
+	if r.version != Version0 {
+		h.Write(header[4:])
+	}
+
+	// A batch marker is made up of just the header, with the value size holding the number of
+	// items in the batch.
+	if item.IsBatchMarker() && r.version != Version0 {
+		if item.ValueSize < 0 || h.Sum32() != binary.BigEndian.Uint32(header) {
+			return nil, 0, ErrCorrupted
+		}
+
+		r.offset += int64(len(header))
+		return item, 0, nil
+	}
+
+	if item.KeySize < 0 || item.ValueSize < -1 {
+		return nil, 0, ErrCorrupted
+	}
+
+	// The sizes have not been verified yet, so neither the key nor the value are read by
+	// allocating their full size up front.
+	var key bytes.Buffer
+	if _, err = io.CopyN(io.MultiWriter(&key, h), r.rd, item.KeySize); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+
+	item.Key = key.Bytes()
+
+	if item.ValueSize >= 0 {
+		var value bytes.Buffer
+		var dst io.Writer = ioutil.Discard
+		if withValue {
+			dst = &value
+		}
+
+		if _, err = io.CopyN(io.MultiWriter(dst, h), r.rd, item.ValueSize); err != nil {
+			return nil, 0, unexpectedEOF(err)
+		}
+
+		if withValue {
+			item.Value = value.Bytes()
+			if item.Value == nil {
+				item.Value = []byte{}
+			}
+		}
+	}
+
+	if r.version != Version0 && h.Sum32() != binary.BigEndian.Uint32(header) {
+		return nil, 0, ErrCorrupted
+	}
+
+	valueSize := item.ValueSize
+	if valueSize < 0 {
+		valueSize = 0
+	}
+
+	valuePos = r.offset + ValueOffset(r.version, len(item.Key))
+	r.offset = valuePos + valueSize
+
+	return item, valuePos, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -3,30 +3,54 @@ package data
 import (
 	"bufio"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 )
 
+// Writer writes records in the current data file format.
 type Writer struct {
-	wr *bufio.Writer
+	wr     *bufio.Writer
+	header []byte
 }
 
 func NewWriter(wr io.Writer) *Writer {
+	return NewWriterFromBuffered(bufio.NewWriter(wr))
+}
+
+func NewWriterFromBuffered(wr *bufio.Writer) *Writer {
 	return &Writer{
-		wr: bufio.NewWriter(wr),
+		wr:     wr,
+		header: make([]byte, HeaderSize(CurrentVersion)),
 	}
 }
 
-func NewWriterFromBuffered(wr *bufio.Writer) *Writer {
-	return &Writer{wr: wr}
+// WriteHeader writes the file header, which must be at the start of every data file.
+func (w *Writer) WriteHeader() error {
+	if _, err := w.wr.Write(magic); err != nil {
+		return err
+	}
+
+	return binary.Write(w.wr, binary.BigEndian, uint32(CurrentVersion))
 }
 
 func (w *Writer) WriteItem(item *Item) error {
+	binary.BigEndian.PutUint64(w.header[4:], uint64(item.Timestamp))
+	binary.BigEndian.PutUint64(w.header[12:], uint64(item.Expiry))
+	binary.BigEndian.PutUint64(w.header[20:], uint64(item.KeySize))
+	binary.BigEndian.PutUint64(w.header[28:], uint64(item.ValueSize))
 
-	if err := binary.Write(w.wr, binary.BigEndian, item.KeySize); err != nil {
-		return err
+	crc := crc32.ChecksumIEEE(w.header[4:])
+	if item.KeySize > 0 {
+		crc = crc32.Update(crc, crc32.IEEETable, item.Key)
 	}
 
-	if err := binary.Write(w.wr, binary.BigEndian, item.ValueSize); err != nil {
+	if item.ValueSize > 0 && !item.IsBatchMarker() {
+		crc = crc32.Update(crc, crc32.IEEETable, item.Value)
+	}
+
+	binary.BigEndian.PutUint32(w.header, crc)
+
+	if _, err := w.wr.Write(w.header); err != nil {
 		return err
 	}
 
@@ -36,7 +60,7 @@ func (w *Writer) WriteItem(item *Item) error {
 		}
 	}
 
-	if item.ValueSize > 0 {
+	if item.ValueSize > 0 && !item.IsBatchMarker() {
 		if _, err := w.wr.Write(item.Value); err != nil {
 			return err
 		}
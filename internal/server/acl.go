@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultUser is the name of the user that connections are authenticated as when they connect,
+// and that AUTH with only a password authenticates as.
+const DefaultUser = "default"
+
+func init() {
+	register(&Command{Name: "auth", Arity: -2, Handler: auth, NoAuth: true})
+}
+
+// User is a user of the server, as defined in an ACL file. A user may run the commands that it is
+// allowed to, on the keys that match one of its key patterns.
+type User struct {
+	Name string
+
+	enabled bool
+
+	// nopass is set if the user can authenticate with any password.
+	nopass bool
+
+	// passwords are the SHA-256 hashes of the passwords of the user.
+	passwords [][sha256.Size]byte
+
+	// allCommands is whether commands are allowed by default, and commands holds the exceptions.
+	allCommands bool
+	commands    map[string]bool
+
+	// patterns are the key patterns of the user. A pattern that ends with '*' matches the keys
+	// that start with the rest of the pattern, and any other pattern matches a single key.
+	patterns []string
+}
+
+// ACL is a set of users, by name.
+type ACL struct {
+	users map[string]*User
+}
+
+// NewACL returns an ACL that only has the default user, which can run every command on every key.
+// If password is not empty, then the default user must authenticate with it.
+func NewACL(password string) *ACL {
+	rules := []string{"on", "allcommands", "allkeys"}
+	if password == "" {
+		rules = append(rules, "nopass")
+	} else {
+		rules = append(rules, ">"+password)
+	}
+
+	u, _ := newUser(DefaultUser, rules)
+	return &ACL{users: map[string]*User{DefaultUser: u}}
+}
+
+// LoadACL reads an ACL file. Each line of the file defines a user, in the same format as Redis:
+//
+//	user <name> [rule...]
+//
+// The rules are applied in order, starting from a user that is disabled and can run no commands:
+//
+//	on, off          enable or disable the user
+//	nopass           allow any password
+//	><password>      add a password
+//	#<sha256>        add a password by its hex-encoded SHA-256 hash
+//	resetpass        remove all passwords and nopass
+//	+<command>       allow a command
+//	-<command>       disallow a command
+//	+@all, allcommands  allow every command
+//	-@all, nocommands   disallow every command
+//	~<pattern>       allow the keys that match a pattern, where a trailing '*' matches any suffix
+//	allkeys          allow every key, the same as ~*
+//	resetkeys        disallow every key
+//
+// Commands that read or replace the whole store, such as PSYNC and REPLICAOF, also require access
+// to every key. Empty lines and lines that start with '#' are ignored. If the file does not define the default
+// user, then it is disabled.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads users in the format of an ACL file.
+func ParseACL(rd io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string]*User)}
+
+	sc := bufio.NewScanner(rd)
+	for lineno := 1; sc.Scan(); lineno++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("acl: line %d: expected 'user <name> [rule...]'", lineno)
+		}
+
+		if _, ok := acl.users[fields[1]]; ok {
+			return nil, fmt.Errorf("acl: line %d: duplicate user '%s'", lineno, fields[1])
+		}
+
+		u, err := newUser(fields[1], fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("acl: line %d: %v", lineno, err)
+		}
+
+		acl.users[u.Name] = u
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := acl.users[DefaultUser]; !ok {
+		acl.users[DefaultUser], _ = newUser(DefaultUser, nil)
+	}
+
+	return acl, nil
+}
+
+// clone returns a copy of the ACL that can be changed without affecting the original.
+func (acl *ACL) clone() *ACL {
+	c := &ACL{users: make(map[string]*User, len(acl.users))}
+	for name, u := range acl.users {
+		cu := *u
+		cu.passwords = append([][sha256.Size]byte(nil), u.passwords...)
+		cu.patterns = append([]string(nil), u.patterns...)
+		cu.commands = make(map[string]bool, len(u.commands))
+		for cmd, allowed := range u.commands {
+			cu.commands[cmd] = allowed
+		}
+
+		c.users[name] = &cu
+	}
+
+	return c
+}
+
+// SetPassword replaces the passwords of a user with a single password.
+func (acl *ACL) SetPassword(name, password string) error {
+	u, ok := acl.users[name]
+	if !ok {
+		return fmt.Errorf("acl: no such user '%s'", name)
+	}
+
+	return u.apply([]string{"resetpass", ">" + password})
+}
+
+// Authenticate returns the user with the specified name if the password is one of its passwords
+// and the user is enabled.
+func (acl *ACL) Authenticate(name, password string) (*User, bool) {
+	u, ok := acl.users[name]
+	if !ok || !u.enabled {
+		return nil, false
+	}
+
+	if u.nopass {
+		return u, true
+	}
+
+	hash := sha256.Sum256([]byte(password))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash[:], p[:]) == 1 {
+			return u, true
+		}
+	}
+
+	return nil, false
+}
+
+// defaultUser returns the user that new connections are authenticated as, or nil if connections
+// must authenticate with AUTH first.
+func (acl *ACL) defaultUser() *User {
+	if u := acl.users[DefaultUser]; u.enabled && u.nopass {
+		return u
+	}
+
+	return nil
+}
+
+func newUser(name string, rules []string) (*User, error) {
+	u := &User{Name: name, commands: make(map[string]bool)}
+	if err := u.apply(rules); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// apply applies rules to a user in order.
+func (u *User) apply(rules []string) error {
+	for _, rule := range rules {
+		switch {
+		case rule == "on":
+			u.enabled = true
+		case rule == "off":
+			u.enabled = false
+		case rule == "nopass":
+			u.nopass = true
+			u.passwords = nil
+		case rule == "resetpass":
+			u.nopass = false
+			u.passwords = nil
+		case rule == "allcommands" || rule == "+@all":
+			u.allCommands = true
+			u.commands = make(map[string]bool)
+		case rule == "nocommands" || rule == "-@all":
+			u.allCommands = false
+			u.commands = make(map[string]bool)
+		case rule == "allkeys":
+			u.patterns = []string{"*"}
+		case rule == "resetkeys":
+			u.patterns = nil
+		case strings.HasPrefix(rule, ">"):
+			u.nopass = false
+			u.passwords = append(u.passwords, sha256.Sum256([]byte(rule[1:])))
+		case strings.HasPrefix(rule, "#"):
+			b, err := hex.DecodeString(rule[1:])
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("invalid password hash '%s'", rule[1:])
+			}
+
+			var hash [sha256.Size]byte
+			copy(hash[:], b)
+
+			u.nopass = false
+			u.passwords = append(u.passwords, hash)
+		case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+			cmd, ok := Lookup([]byte(rule[1:]))
+			if !ok {
+				return fmt.Errorf("unknown command '%s'", rule[1:])
+			}
+
+			u.commands[cmd.Name] = rule[0] == '+'
+		case strings.HasPrefix(rule, "~"):
+			u.patterns = append(u.patterns, rule[1:])
+		default:
+			return fmt.Errorf("syntax error in rule '%s'", rule)
+		}
+	}
+
+	return nil
+}
+
+// CanRun reports whether the user is allowed to run a command.
+func (u *User) CanRun(cmd *Command) bool {
+	if allowed, ok := u.commands[cmd.Name]; ok {
+		return allowed
+	}
+
+	return u.allCommands
+}
+
+// CanAccess reports whether the user is allowed to access a key.
+func (u *User) CanAccess(key []byte) bool {
+	for _, pattern := range u.patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if bytes.HasPrefix(key, []byte(pattern[:len(pattern)-1])) {
+				return true
+			}
+		} else if string(key) == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanAccessAll reports whether the user is allowed to access every key.
+func (u *User) CanAccessAll() bool {
+	for _, pattern := range u.patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize checks that the user of the connection may run a command with the specified
+// arguments, returning the error reply to write if not.
+func (c *Conn) authorize(cmd *Command, args [][]byte) (string, bool) {
+	if cmd.NoAuth {
+		return "", true
+	}
+
+	if c.user == nil {
+		return "NOAUTH Authentication required.", false
+	}
+
+	if !c.user.CanRun(cmd) {
+		return "NOPERM this user has no permissions to run the '" + cmd.Name + "' command", false
+	}
+
+	if cmd.AllKeys && !c.user.CanAccessAll() {
+		return "NOPERM this user has no permissions to access every key, which the '" + cmd.Name + "' command requires", false
+	}
+
+	for _, key := range cmd.keys(args) {
+		if !c.user.CanAccess(key) {
+			return "NOPERM this user has no permissions to access one of the keys used as arguments", false
+		}
+	}
+
+	return "", true
+}
+
+// authenticate authenticates the connection as a user, returning the error reply to write if the
+// username or password is wrong.
+func (c *Conn) authenticate(name, password string) (string, bool) {
+	u, ok := c.srv.acl.Authenticate(name, password)
+	if !ok {
+		return "WRONGPASS invalid username-password pair or user is disabled.", false
+	}
+
+	c.user = u
+	return "", true
+}
+
+// auth handles AUTH [username] password, which authenticates the connection as a user. With only
+// a password, the connection is authenticated as the default user.
+func auth(c *Conn, args [][]byte) error {
+	if len(args) > 3 {
+		return c.writeError("ERR syntax error")
+	}
+
+	name, password := DefaultUser, string(args[1])
+	if len(args) == 3 {
+		name, password = string(args[1]), string(args[2])
+	} else if u := c.srv.acl.users[DefaultUser]; u.enabled && u.nopass {
+		return c.writeError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	if msg, ok := c.authenticate(name, password); !ok {
+		return c.writeError(msg)
+	}
+
+	return c.w.WriteSimpleString("OK")
+}
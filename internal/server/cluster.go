@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/cluster"
+)
+
+// writer applies the writes of commands. It is the store itself, or the cluster node when the
+// server is part of a cluster, in which case writes are replicated before they are applied.
+type writer interface {
+	Set(key []byte, value []byte) error
+	SetWithTTL(key []byte, value []byte, ttl time.Duration) error
+	Remove(key []byte) (bool, error)
+	Expire(key []byte, ttl time.Duration) (bool, error)
+	Persist(key []byte) (bool, error)
+}
+
+// redirect checks that the server can accept writes as the leader of its cluster, returning the
+// error reply to write if not. Clients are sent to the leader with
+//
+//	-MOVED 0 <host>:<port>
+//
+// in the same format as Redis Cluster. The slot is always 0, since every node holds every key.
+func (s *Server) redirect() (string, bool) {
+	if s.cluster.State() == cluster.Leader {
+		return "", true
+	}
+
+	leader, ok := s.cluster.Leader()
+	if !ok || leader.ClientAddr == "" {
+		return "CLUSTERDOWN The cluster has no leader", false
+	}
+
+	return "MOVED 0 " + leader.ClientAddr, false
+}
+
+// clusterInfo returns the fields of the cluster section of INFO.
+func clusterInfo(s *Server) [][2]string {
+	if s.cluster == nil {
+		return [][2]string{{"cluster_enabled", "0"}}
+	}
+
+	state, leaderID := "fail", ""
+	if leader, ok := s.cluster.Leader(); ok {
+		state, leaderID = "ok", leader.ID
+	}
+
+	return [][2]string{
+		{"cluster_enabled", "1"},
+		{"cluster_state", state},
+		{"cluster_node_id", s.cluster.ID()},
+		{"cluster_role", s.cluster.State().String()},
+		{"cluster_leader", leaderID},
+		{"cluster_term", strconv.FormatUint(s.cluster.Term(), 10)},
+		{"cluster_known_nodes", strconv.Itoa(len(s.cluster.Peers()))},
+		{"cluster_commit_index", strconv.FormatUint(s.cluster.CommitIndex(), 10)},
+		{"cluster_applied_index", strconv.FormatUint(s.cluster.AppliedIndex(), 10)},
+	}
+}
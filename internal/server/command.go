@@ -1 +1,315 @@
 package server
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+)
+
+// Handler executes a command on a connection and writes the reply. The arguments include the name
+// of the command, and there are as many of them as the arity of the command allows.
+type Handler func(c *Conn, args [][]byte) error
+
+// Command describes a command supported by the server.
+type Command struct {
+	Name string
+
+	// Arity is the number of arguments the command takes, including its name. A negative arity
+	// means that the command takes at least -Arity arguments.
+	Arity int
+
+	// FirstKey and LastKey are the positions of the first and last arguments that are keys, and
+	// KeyStep is the distance between keys. A negative LastKey counts from the end of the
+	// arguments, so that -1 is the last argument. A command without keys has a FirstKey of 0.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+
+	// Write is set for commands that modify the store, which replicas refuse to run.
+	Write bool
+
+	// AllKeys is set for commands that read or replace every key, such as PSYNC, which only users
+	// that may access every key can run.
+	AllKeys bool
+
+	// NoAuth is set for commands that can be run before authenticating, and that are not subject
+	// to the permissions of the user.
+	NoAuth bool
+
+	Handler Handler
+}
+
+// keys returns the arguments of the command that are keys.
+func (cmd *Command) keys(args [][]byte) [][]byte {
+	if cmd.FirstKey == 0 {
+		return nil
+	}
+
+	last := cmd.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+
+	var keys [][]byte
+	for i := cmd.FirstKey; i <= last && i < len(args); i += cmd.KeyStep {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
+
+var commands = map[string]*Command{}
+
+func register(cmd *Command) {
+	commands[cmd.Name] = cmd
+}
+
+func init() {
+	register(&Command{Name: "ping", Arity: -1, Handler: ping})
+	register(&Command{Name: "echo", Arity: 2, Handler: echo})
+	register(&Command{Name: "quit", Arity: 1, Handler: quit, NoAuth: true})
+	register(&Command{Name: "get", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: get})
+	register(&Command{Name: "mget", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: mget})
+	register(&Command{Name: "set", Write: true, Arity: -3, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: set})
+	register(&Command{Name: "del", Write: true, Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: del})
+	register(&Command{Name: "exists", Arity: -2, FirstKey: 1, LastKey: -1, KeyStep: 1, Handler: exists})
+	register(&Command{Name: "expire", Write: true, Arity: 3, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: expire})
+	register(&Command{Name: "ttl", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: ttl})
+	register(&Command{Name: "pttl", Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: pttl})
+	register(&Command{Name: "persist", Write: true, Arity: 2, FirstKey: 1, LastKey: 1, KeyStep: 1, Handler: persist})
+	register(&Command{Name: "keys", Arity: 2, Handler: keysCmd})
+}
+
+// Lookup returns the command with the specified name. Command names are case-insensitive.
+func Lookup(name []byte) (*Command, bool) {
+	cmd, ok := commands[strings.ToLower(string(name))]
+	return cmd, ok
+}
+
+func writeBool(c *Conn, b bool) error {
+	if b {
+		return c.w.WriteInteger(1)
+	}
+
+	return c.w.WriteInteger(0)
+}
+
+// ping handles PING [message].
+func ping(c *Conn, args [][]byte) error {
+	switch len(args) {
+	case 1:
+		return c.w.WriteSimpleString("PONG")
+	case 2:
+		return c.w.WriteBulkString(args[1])
+	default:
+		return c.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echo(c *Conn, args [][]byte) error {
+	return c.w.WriteBulkString(args[1])
+}
+
+func quit(c *Conn, args [][]byte) error {
+	c.quit = true
+	return c.w.WriteSimpleString("OK")
+}
+
+func get(c *Conn, args [][]byte) error {
+	value, err := c.srv.keys.Get(args[1])
+	if err != nil {
+		return err
+	}
+
+	return c.w.WriteBulkString(value)
+}
+
+// mget handles MGET key [key ...], replying with the value of each key, or a null bulk string for
+// the keys that do not exist.
+func mget(c *Conn, args [][]byte) error {
+	values := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		value, err := c.srv.keys.Get(key)
+		if err != nil {
+			return err
+		}
+
+		values = append(values, value)
+	}
+
+	if err := c.w.WriteArrayHeader(len(values)); err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if err := c.w.WriteBulkString(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func set(c *Conn, args [][]byte) error {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		var unit time.Duration
+		switch {
+		case bytes.EqualFold(args[i], []byte("ex")):
+			unit = time.Second
+		case bytes.EqualFold(args[i], []byte("px")):
+			unit = time.Millisecond
+		default:
+			return c.writeError("ERR syntax error")
+		}
+
+		if ttl != 0 || i+1 == len(args) {
+			return c.writeError("ERR syntax error")
+		}
+
+		i++
+		n, err := strconv.ParseInt(string(args[i]), 10, 64)
+		if err != nil {
+			return c.writeError("ERR value is not an integer or out of range")
+		}
+
+		if n <= 0 {
+			return c.writeError("ERR invalid expire time in 'set' command")
+		}
+
+		ttl = time.Duration(n) * unit
+	}
+
+	var err error
+	if ttl != 0 {
+		err = c.srv.writes.SetWithTTL(args[1], args[2], ttl)
+	} else {
+		err = c.srv.writes.Set(args[1], args[2])
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.w.WriteSimpleString("OK")
+}
+
+// del handles DEL key [key ...], replying with the number of keys that were removed.
+func del(c *Conn, args [][]byte) error {
+	var n int64
+	for _, key := range args[1:] {
+		ok, err := c.srv.writes.Remove(key)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			n++
+		}
+	}
+
+	return c.w.WriteInteger(n)
+}
+
+// exists handles EXISTS key [key ...], replying with the number of keys that exist. A key that is
+// specified more than once is counted more than once.
+func exists(c *Conn, args [][]byte) error {
+	var n int64
+	for _, key := range args[1:] {
+		if c.srv.keys.Has(key) {
+			n++
+		}
+	}
+
+	return c.w.WriteInteger(n)
+}
+
+// expire handles EXPIRE key seconds.
+func expire(c *Conn, args [][]byte) error {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return c.writeError("ERR value is not an integer or out of range")
+	}
+
+	ok, err := c.srv.writes.Expire(args[1], time.Duration(n)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	return writeBool(c, ok)
+}
+
+// ttl handles TTL key, replying with the remaining time to live in seconds, -1 if the key does not
+// expire, or -2 if it does not exist.
+func ttl(c *Conn, args [][]byte) error {
+	d, err := c.srv.keys.TTL(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch d {
+	case keychain.NoExpiry:
+		return c.w.WriteInteger(-1)
+	case keychain.KeyNotFound:
+		return c.w.WriteInteger(-2)
+	}
+
+	return c.w.WriteInteger(int64((d + time.Second/2) / time.Second))
+}
+
+// pttl handles PTTL key, which is TTL in milliseconds.
+func pttl(c *Conn, args [][]byte) error {
+	d, err := c.srv.keys.TTL(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch d {
+	case keychain.NoExpiry:
+		return c.w.WriteInteger(-1)
+	case keychain.KeyNotFound:
+		return c.w.WriteInteger(-2)
+	}
+
+	return c.w.WriteInteger(int64((d + time.Millisecond/2) / time.Millisecond))
+}
+
+func persist(c *Conn, args [][]byte) error {
+	ok, err := c.srv.writes.Persist(args[1])
+	if err != nil {
+		return err
+	}
+
+	return writeBool(c, ok)
+}
+
+// keysCmd handles KEYS pattern, replying with the keys that match the glob-style pattern, in
+// order.
+func keysCmd(c *Conn, args [][]byte) error {
+	it := c.srv.keys.Scan(nil)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Next() {
+		// Keys that the user may not access are left out, rather than failing the command.
+		if matchPattern(args[1], it.Key()) && c.user.CanAccess(it.Key()) {
+			keys = append(keys, it.Key())
+		}
+	}
+
+	if err := c.w.WriteArrayHeader(len(keys)); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := c.w.WriteBulkString(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
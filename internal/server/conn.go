@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Conn is a client connection to the server. It can be either a TCP connection or a Unix domain
+// socket connection.
+type Conn struct {
+	srv  *Server
+	conn net.Conn
+	r    *resp.Reader
+	w    *resp.Writer
+	id   uint64
+
+	// name is the name of the connection set by the client with HELLO.
+	name string
+
+	// user is the user that the connection is authenticated as, or nil if it has not
+	// authenticated yet.
+	user *User
+
+	// args holds the arguments of the command being executed, and is reused for every command.
+	args [][]byte
+
+	// quit is set by the QUIT command to close the connection once its reply has been sent.
+	quit bool
+}
+
+func newConn(srv *Server, conn net.Conn) *Conn {
+	r := resp.NewReaderLimits(conn, srv.limits)
+
+	// Commands are executed before the next one is read, and handlers copy whatever they keep
+	// of their arguments, so the buffers of the reader can be reused.
+	r.SetReuseBuffers(true)
+
+	return &Conn{
+		srv:  srv,
+		conn: conn,
+		r:    r,
+		w:    resp.NewWriter(conn),
+		id:   atomic.AddUint64(&srv.nextID, 1),
+		user: srv.acl.defaultUser(),
+	}
+}
+
+// serve reads commands from the connection and executes them until the client disconnects. Clients
+// may pipeline commands, sending several of them without waiting for the replies. All of the
+// commands that have been received are executed in order before the replies are flushed, so
+// that a pipeline is answered with as few writes as possible.
+func (c *Conn) serve() {
+	defer c.conn.Close()
+
+	for !c.quit {
+		// The replies are flushed before waiting for more commands.
+		if !c.r.HasMessage() {
+			if err := c.w.Flush(); err != nil {
+				log.Errorf("error writing reply to %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		}
+
+		v, err := c.r.ReadValue()
+		if err != nil {
+			// RESP parsing errors are fatal and cause the connection to be closed immediately.
+			if err != io.EOF {
+				c.writeError("ERR Protocol error: " + err.Error())
+				c.w.Flush()
+			}
+
+			return
+		}
+
+		// Null arrays are ignored.
+		if v.Type() == resp.Array && v.IsNull() {
+			continue
+		}
+
+		var execErr error
+		var ok bool
+		if c.args, ok = commandArgs(v, c.args[:0]); ok {
+			execErr = c.execute(c.args)
+		} else {
+			execErr = c.writeError("ERR Protocol error: expected an array of bulk strings")
+		}
+
+		if execErr != nil {
+			log.Errorf("error writing reply to %s: %v", c.conn.RemoteAddr(), execErr)
+			return
+		}
+	}
+
+	if err := c.w.Flush(); err != nil {
+		log.Errorf("error writing reply to %s: %v", c.conn.RemoteAddr(), err)
+	}
+}
+
+// execute runs a command and writes its reply. Errors in the command itself, such as an unknown
+// name or the wrong number of arguments, and errors returned by the store, are written as error
+// replies. The returned error is only non-nil if the reply could not be written.
+func (c *Conn) execute(args [][]byte) error {
+	if len(args) == 0 {
+		return c.writeError("ERR empty command")
+	}
+
+	cmd, ok := Lookup(args[0])
+	if !ok {
+		return c.writeError("ERR unknown command '" + string(args[0]) + "'")
+	}
+
+	if (cmd.Arity > 0 && len(args) != cmd.Arity) || (cmd.Arity < 0 && len(args) < -cmd.Arity) {
+		return c.writeError("ERR wrong number of arguments for '" + cmd.Name + "' command")
+	}
+
+	if msg, ok := c.authorize(cmd, args); !ok {
+		return c.writeError(msg)
+	}
+
+	if cmd.Write && c.srv.isReplica() {
+		return c.writeError("READONLY You can't write against a read only replica.")
+	}
+
+	if cmd.Write && c.srv.cluster != nil {
+		if msg, ok := c.srv.redirect(); !ok {
+			return c.writeError(msg)
+		}
+	}
+
+	// If the handler failed to write its reply, then writing the error reply fails as well, since
+	// the writer keeps returning the first error it encountered.
+	if err := cmd.Handler(c, args); err != nil {
+		return c.writeError("ERR " + err.Error())
+	}
+
+	return nil
+}
+
+// commandArgs appends the arguments of a command, which is sent as an array of bulk strings, to
+// args.
+func commandArgs(v resp.Value, args [][]byte) ([][]byte, bool) {
+	if v.Type() != resp.Array {
+		return args, false
+	}
+
+	elems, _ := v.AsArray()
+	for _, elem := range elems {
+		if elem.Type() != resp.BulkString || elem.IsNull() {
+			return args, false
+		}
+
+		arg, _ := elem.AsBytes()
+		args = append(args, arg)
+	}
+
+	return args, true
+}
+
+func (c *Conn) writeError(message string) error {
+	return c.w.WriteError(resp.NewRespError(message))
+}
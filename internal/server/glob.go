@@ -0,0 +1,99 @@
+package server
+
+// matchPattern reports whether s matches a glob-style pattern. In the pattern, '*' matches any
+// sequence of bytes, '?' matches any single byte, "[abc]" matches one of the bytes in the brackets,
+// "[^abc]" any byte that is not, "[a-c]" a range of bytes, and '\' escapes the next byte. Unlike
+// path.Match, '*' also matches '/', since keys are not paths.
+func matchPattern(pattern []byte, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+
+	return len(s) == 0
+}
+
+// matchClass reports whether b matches the bracket expression at the start of pattern, which
+// follows the opening bracket, and returns the rest of the pattern after the closing bracket. An
+// unterminated expression extends to the end of the pattern.
+func matchClass(pattern []byte, b byte) (bool, []byte) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			pattern = pattern[2:]
+		}
+
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		if lo <= b && b <= hi {
+			match = true
+		}
+	}
+
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	return match != negate, pattern
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+)
+
+func init() {
+	register(&Command{Name: "hello", Arity: -1, Handler: hello, NoAuth: true})
+	register(&Command{Name: "info", Arity: -1, Handler: info})
+	register(&Command{Name: "config", Arity: -2, Handler: config})
+}
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME clientname]], which switches the
+// connection to the requested version of the protocol, optionally authenticating it first, and
+// replies with information about the server. A connection that has not authenticated can only run
+// HELLO with AUTH.
+func hello(c *Conn, args [][]byte) error {
+	proto := c.w.Protocol()
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return c.writeError("ERR Protocol version is not an integer or out of range")
+		}
+
+		if v != resp.RESP2 && v != resp.RESP3 {
+			return c.writeError("NOPROTO unsupported protocol version")
+		}
+
+		proto = v
+	}
+
+	name := c.name
+	var user, password []byte
+	for i := 2; i < len(args); i++ {
+		switch {
+		case bytes.EqualFold(args[i], []byte("auth")) && i+2 < len(args):
+			user, password = args[i+1], args[i+2]
+			i += 2
+		case bytes.EqualFold(args[i], []byte("setname")) && i+1 < len(args):
+			i++
+			name = string(args[i])
+		default:
+			return c.writeError("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+		}
+	}
+
+	if user != nil {
+		if msg, ok := c.authenticate(string(user), string(password)); !ok {
+			return c.writeError(msg)
+		}
+	} else if c.user == nil {
+		return c.writeError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	c.name = name
+	c.w.SetProtocol(proto)
+
+	return c.w.WriteMap(resp.Map{
+		{Key: "server", Value: "keychain"},
+		{Key: "version", Value: Version},
+		{Key: "proto", Value: int64(proto)},
+		{Key: "id", Value: int64(c.id)},
+		{Key: "mode", Value: "standalone"},
+		{Key: "role", Value: c.srv.role()},
+		{Key: "modules", Value: []interface{}{}},
+	})
+}
+
+// infoSection is a section of the INFO reply, made up of fields in order.
+type infoSection struct {
+	name   string
+	fields func(s *Server) [][2]string
+}
+
+var infoSections = []infoSection{
+	{"server", func(s *Server) [][2]string {
+		return [][2]string{
+			{"keychain_version", Version},
+			{"process_id", strconv.Itoa(os.Getpid())},
+			{"uptime_in_seconds", strconv.FormatInt(int64(time.Since(s.started)/time.Second), 10)},
+		}
+	}},
+	{"clients", func(s *Server) [][2]string {
+		return [][2]string{
+			{"connected_clients", strconv.Itoa(s.numConns())},
+		}
+	}},
+	{"persistence", persistenceInfo},
+	{"replication", replicationInfo},
+	{"cluster", clusterInfo},
+}
+
+// info handles INFO [section], replying with information about the server in the same text
+// format as Redis.
+func info(c *Conn, args [][]byte) error {
+	if len(args) > 2 {
+		return c.writeError("ERR syntax error")
+	}
+
+	section := "default"
+	if len(args) == 2 {
+		section = strings.ToLower(string(args[1]))
+	}
+
+	var b strings.Builder
+	for _, sec := range infoSections {
+		if section != "default" && section != "all" && section != sec.name {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+
+		fmt.Fprintf(&b, "# %s\r\n", capitalize(sec.name))
+		for _, field := range sec.fields(c.srv) {
+			fmt.Fprintf(&b, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+
+	return c.w.WriteVerbatim(resp.Verbatim{Format: "txt", Text: b.String()})
+}
+
+// capitalize returns a section name with its first letter in upper case, as it is shown by INFO.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// configParams are the configuration parameters that can be read with CONFIG GET.
+var configParams = []struct {
+	name  string
+	value func(s *Server) string
+}{
+	{"proto-max-bulk-len", func(s *Server) string {
+		return strconv.FormatInt(s.limits.MaxBulkLength, 10)
+	}},
+	{"client-query-buffer-limit", func(s *Server) string {
+		return strconv.FormatInt(s.limits.MaxMessageSize, 10)
+	}},
+}
+
+// config handles CONFIG GET pattern, replying with a map of the configuration parameters that
+// match the glob-style pattern.
+func config(c *Conn, args [][]byte) error {
+	if !bytes.EqualFold(args[1], []byte("get")) {
+		return c.writeError("ERR unknown subcommand '" + string(args[1]) + "'")
+	}
+
+	if len(args) != 3 {
+		return c.writeError("ERR wrong number of arguments for 'config|get' command")
+	}
+
+	pattern := bytes.ToLower(args[2])
+
+	var m resp.Map
+	for _, param := range configParams {
+		if matchPattern(pattern, []byte(param.name)) {
+			m = append(m, resp.MapEntry{Key: []byte(param.name), Value: []byte(param.value(c.srv))})
+		}
+	}
+
+	return c.w.WriteMap(m)
+}
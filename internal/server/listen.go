@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on a Unix domain socket at the specified path. A socket file left behind by
+// a server that is no longer running is removed first, but a socket that a running server is
+// listening on, or any other kind of file, is left alone. If perm is non-zero, then the
+// permissions of the socket file are set to it.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	}
+
+	return lis, nil
+}
+
+// removeStaleSocket removes the socket file at the specified path if no server is listening on it.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if stat.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+
+	return os.Remove(path)
+}
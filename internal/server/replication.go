@@ -0,0 +1,770 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	log "github.com/sirupsen/logrus"
+)
+
+// A replica keeps a copy of the store of its primary. It connects to the primary and sends
+// PSYNC, to which the primary replies with
+//
+//	+FULLRESYNC <replid> <offset> <keys>
+//
+// followed by a snapshot of its live keys as <keys> SET commands, and then by every write to its
+// store as it happens, as SET and DEL commands. The writes of a batch are wrapped in MULTI and
+// EXEC. The offset is the sequence number of the last write in the snapshot, and every write that
+// follows advances it by one. The replica acknowledges the offset it has reached every second with
+// REPLCONF ACK <offset>. The primary sends PING every second, so that a replica that hears nothing
+// for a while can tell that the link is broken, and reconnect.
+
+// replicaAckInterval is the interval at which a replica acknowledges its offset to the primary.
+const replicaAckInterval = time.Second
+
+// replicaPingInterval is the interval at which a primary pings its replicas. It is a variable so
+// that tests can shorten it.
+var replicaPingInterval = time.Second
+
+// replicaTimeout is the time after which a replica that has not heard from its primary considers
+// the link broken. It is a variable so that tests can shorten it.
+var replicaTimeout = 5 * time.Second
+
+// replicaRetryInterval is the time a replica waits before connecting to its primary again after
+// the link breaks.
+const replicaRetryInterval = time.Second
+
+// replicaDialTimeout is the timeout for connecting to the primary.
+const replicaDialTimeout = 5 * time.Second
+
+func init() {
+	register(&Command{Name: "replicaof", Arity: 3, AllKeys: true, Handler: replicaof})
+	register(&Command{Name: "psync", Arity: 3, AllKeys: true, Handler: psync})
+	register(&Command{Name: "replconf", Arity: -1, Handler: replconf})
+	register(&Command{Name: "role", Arity: 1, Handler: role})
+}
+
+// replication is the replication state of a server, which is either a primary with any number of
+// replicas, or a replica of another server.
+type replication struct {
+	mtx sync.Mutex
+
+	// linkMtx serializes changes to the link, which is replaced without mtx held.
+	linkMtx sync.Mutex
+
+	// id identifies the history of the store that the server serves to its replicas.
+	id string
+
+	// replicas holds the replicas that are following the server, by their connection.
+	replicas map[*Conn]*replica
+
+	// link is the link to the primary if the server is a replica.
+	link *link
+
+	// user, password and tlsConfig are used by links to connect to the primary.
+	user      string
+	password  string
+	tlsConfig *tls.Config
+}
+
+// replica is a replica that is following the server.
+type replica struct {
+	addr string
+
+	// offset is the last offset that the replica acknowledged.
+	offset uint64
+}
+
+// link is the connection of a replica to its primary. It reconnects whenever the connection
+// breaks, until it is stopped.
+type link struct {
+	srv  *Server
+	addr string
+
+	// user and password authenticate the link with the primary if password is not empty, and
+	// tlsConfig is the TLS configuration for connecting to it, if it is not nil.
+	user      string
+	password  string
+	tlsConfig *tls.Config
+
+	mtx  sync.Mutex
+	conn net.Conn
+
+	// state is one of "connect", "connecting", "sync" and "connected", as reported by ROLE.
+	state string
+
+	// id and offset are the replication ID of the primary and the offset reached in its history.
+	id     string
+	offset uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReplicationID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ReplicaOf makes the server a replica of the server at the specified address, discarding its
+// data once it synchronizes with the primary. If addr is empty, then the server stops replicating
+// and becomes a primary, keeping its data.
+func (s *Server) ReplicaOf(addr string) {
+	s.repl.linkMtx.Lock()
+	defer s.repl.linkMtx.Unlock()
+
+	s.repl.mtx.Lock()
+	l := s.repl.link
+	s.repl.link = nil
+	s.repl.mtx.Unlock()
+
+	if l != nil {
+		l.close()
+	}
+
+	if addr == "" {
+		return
+	}
+
+	l = &link{
+		srv:       s,
+		addr:      addr,
+		user:      s.repl.user,
+		password:  s.repl.password,
+		tlsConfig: s.repl.tlsConfig,
+		state:     "connect",
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if cfg := l.tlsConfig; cfg != nil && cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		l.tlsConfig = cfg.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			l.tlsConfig.ServerName = host
+		} else {
+			l.tlsConfig.ServerName = addr
+		}
+	}
+
+	s.repl.mtx.Lock()
+	s.repl.link = l
+	s.repl.mtx.Unlock()
+
+	go l.run()
+}
+
+// role returns the role of the server in replication, as reported by HELLO.
+func (s *Server) role() string {
+	if s.isReplica() {
+		return "replica"
+	}
+
+	return "master"
+}
+
+// isReplica reports whether the server is a replica of another server.
+func (s *Server) isReplica() bool {
+	s.repl.mtx.Lock()
+	defer s.repl.mtx.Unlock()
+
+	return s.repl.link != nil
+}
+
+// run keeps the replica synchronized with the primary until the link is stopped.
+func (l *link) run() {
+	defer close(l.done)
+
+	for {
+		err := l.sync()
+
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+
+		log.Errorf("replication from %s failed: %v", l.addr, err)
+		l.setState("connect")
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// close stops the link and waits for it to finish.
+func (l *link) close() {
+	close(l.stop)
+
+	l.mtx.Lock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.mtx.Unlock()
+
+	<-l.done
+}
+
+func (l *link) setState(state string) {
+	l.mtx.Lock()
+	l.state = state
+	l.mtx.Unlock()
+}
+
+// status returns the state of the link and the offset reached.
+func (l *link) status() (string, uint64) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.state, l.offset
+}
+
+// sync connects to the primary, copies its snapshot and applies its writes until the connection
+// breaks.
+func (l *link) sync() error {
+	l.setState("connecting")
+
+	conn, err := net.DialTimeout("tcp", l.addr, replicaDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	// The connection is closed by close from now on.
+	l.mtx.Lock()
+	select {
+	case <-l.stop:
+		l.mtx.Unlock()
+		return nil
+	default:
+		l.conn = conn
+	}
+	l.mtx.Unlock()
+
+	var netConn net.Conn = conn
+	if l.tlsConfig != nil {
+		tlsConn := tls.Client(conn, l.tlsConfig)
+
+		// The handshake is bounded by the dial timeout as well.
+		tlsConn.SetDeadline(time.Now().Add(replicaDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	r := resp.NewReader(&timeoutConn{Conn: netConn, timeout: replicaTimeout})
+	w := resp.NewWriter(netConn)
+
+	if l.password != "" {
+		args := []interface{}{"AUTH", l.password}
+		if l.user != "" {
+			args = []interface{}{"AUTH", l.user, l.password}
+		}
+
+		if _, err := roundTrip(r, w, args...); err != nil {
+			return fmt.Errorf("error authenticating with primary: %v", err)
+		}
+	}
+
+	reply, err := roundTrip(r, w, "PSYNC", "?", "-1")
+	if err != nil {
+		return err
+	}
+
+	status, _ := reply.AsString()
+	fields := strings.Fields(status)
+	if len(fields) != 4 || fields[0] != "FULLRESYNC" {
+		return fmt.Errorf("unexpected reply to PSYNC: %q", status)
+	}
+
+	offset, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset in reply to PSYNC: %v", err)
+	}
+
+	n, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return fmt.Errorf("invalid number of keys in reply to PSYNC: %v", err)
+	}
+
+	l.setState("sync")
+
+	keys := l.srv.keys
+	if err := keys.Clear(); err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		args, err := readCommand(r)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.EqualFold(args[0], []byte("set")) {
+			return fmt.Errorf("unexpected command in snapshot: %q", args[0])
+		}
+
+		if err := applyWrite(keys, args, nil); err != nil {
+			return err
+		}
+	}
+
+	l.mtx.Lock()
+	l.state, l.id, l.offset = "connected", fields[1], offset
+	l.mtx.Unlock()
+
+	log.Infof("Synchronized with primary %s at offset %d", l.addr, offset)
+
+	acks := make(chan struct{})
+	defer close(acks)
+	go l.ack(w, acks)
+
+	// The writes of a batch are collected between MULTI and EXEC.
+	var batch *keychain.Batch
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToLower(string(args[0])) {
+		case "ping":
+			continue
+		case "multi":
+			batch = &keychain.Batch{}
+			continue
+		case "exec":
+			if batch == nil {
+				return errors.New("EXEC without MULTI")
+			}
+
+			err, batch = keys.Write(batch), nil
+		default:
+			if err = applyWrite(keys, args, batch); err == nil && batch != nil {
+				continue
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		l.mtx.Lock()
+		l.offset++
+		l.mtx.Unlock()
+	}
+}
+
+// timeoutConn is a connection that sets a read deadline before every read, so that reads fail once
+// the other side has been silent for longer than the timeout.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(p)
+}
+
+// roundTrip sends a command to the primary and reads the reply, returning error replies as errors.
+func roundTrip(r *resp.Reader, w *resp.Writer, args ...interface{}) (resp.Value, error) {
+	if err := w.WriteCommand(args...); err != nil {
+		return resp.Value{}, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return resp.Value{}, err
+	}
+
+	reply, err := r.ReadValue()
+	if err != nil {
+		return resp.Value{}, err
+	}
+
+	return reply, reply.Err()
+}
+
+// ack acknowledges the offset reached to the primary periodically, until done is closed.
+func (l *link) ack(w *resp.Writer, done chan struct{}) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		_, offset := l.status()
+		if err := w.WriteCommand("REPLCONF", "ACK", strconv.FormatUint(offset, 10)); err != nil {
+			return
+		}
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent by the primary.
+func readCommand(r *resp.Reader) ([][]byte, error) {
+	v, err := r.ReadValue()
+	if err != nil {
+		return nil, err
+	}
+
+	args, ok := commandArgs(v, nil)
+	if !ok || len(args) == 0 {
+		return nil, errors.New("expected a command from the primary")
+	}
+
+	return args, nil
+}
+
+// applyWrite applies a SET key value [PXAT milliseconds] or DEL key command sent by the primary to
+// the store, or adds it to the batch if there is one.
+func applyWrite(keys *keychain.Keychain, args [][]byte, batch *keychain.Batch) error {
+	switch {
+	case bytes.EqualFold(args[0], []byte("set")) && (len(args) == 3 || len(args) == 5):
+		if len(args) == 3 {
+			if batch != nil {
+				batch.Set(args[1], args[2])
+				return nil
+			}
+
+			return keys.Set(args[1], args[2])
+		}
+
+		ms, err := strconv.ParseInt(string(args[4]), 10, 64)
+		if err != nil || !bytes.EqualFold(args[3], []byte("pxat")) || batch != nil {
+			return fmt.Errorf("invalid SET from primary")
+		}
+
+		// A key that has already expired is removed instead.
+		ttl := time.Until(time.Unix(0, ms*int64(time.Millisecond)))
+		if ttl <= 0 {
+			_, err := keys.Remove(args[1])
+			return err
+		}
+
+		return keys.SetWithTTL(args[1], args[2], ttl)
+	case bytes.EqualFold(args[0], []byte("del")) && len(args) == 2:
+		if batch != nil {
+			batch.Delete(args[1])
+			return nil
+		}
+
+		_, err := keys.Remove(args[1])
+		return err
+	}
+
+	return fmt.Errorf("unexpected command from primary: %q", args[0])
+}
+
+// writeRecords writes records that the follower of the store received to a replica. The records
+// of a batch are wrapped in MULTI and EXEC.
+func writeRecords(w *resp.Writer, records []keychain.Record) error {
+	for i := 0; i < len(records); {
+		j := i + 1
+		for j < len(records) && records[j].Seq == records[i].Seq {
+			j++
+		}
+
+		if j-i > 1 {
+			if err := w.WriteCommand("MULTI"); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range records[i:j] {
+			if err := writeRecord(w, r.Key, r.Value, r.Expiry); err != nil {
+				return err
+			}
+		}
+
+		if j-i > 1 {
+			if err := w.WriteCommand("EXEC"); err != nil {
+				return err
+			}
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+// writeRecord writes a key with its value and expiry as a SET command, or as a DEL command if the
+// value is nil.
+func writeRecord(w *resp.Writer, key []byte, value []byte, expiry int64) error {
+	switch {
+	case value == nil:
+		return w.WriteCommand("DEL", key)
+	case expiry != 0:
+		ms := strconv.FormatInt(expiry/int64(time.Millisecond), 10)
+		return w.WriteCommand("SET", key, value, "PXAT", ms)
+	default:
+		return w.WriteCommand("SET", key, value)
+	}
+}
+
+// psync handles PSYNC replid offset, which is sent by a replica to start following the server.
+// A full resynchronization is always performed. The connection is used for replication from then
+// on, and is closed once replication stops.
+func psync(c *Conn, args [][]byte) error {
+	s := c.srv
+	c.quit = true
+
+	it, f := s.keys.Follow()
+	defer f.Close()
+
+	err := c.w.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d %d", s.repl.id, f.Seq(), it.Len()))
+	for err == nil && it.Next() {
+		var value []byte
+		if value, err = it.Value(); err == nil {
+			err = writeRecord(c.w, it.Key(), value, it.Expiry())
+		}
+	}
+
+	it.Close()
+	if err == nil {
+		err = c.w.Flush()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rep := &replica{addr: c.conn.RemoteAddr().String(), offset: f.Seq()}
+
+	s.repl.mtx.Lock()
+	s.repl.replicas[c] = rep
+	s.repl.mtx.Unlock()
+
+	defer func() {
+		s.repl.mtx.Lock()
+		delete(s.repl.replicas, c)
+		s.repl.mtx.Unlock()
+	}()
+
+	log.Infof("Replica %s synchronized at offset %d", rep.addr, f.Seq())
+
+	// The acknowledgements of the replica are read while the writes are sent. The follower is
+	// closed once the replica disconnects, which stops sending the writes.
+	go func() {
+		defer f.Close()
+
+		for {
+			args, err := readCommand(c.r)
+			if err != nil {
+				return
+			}
+
+			if len(args) == 3 && bytes.EqualFold(args[0], []byte("replconf")) && bytes.EqualFold(args[1], []byte("ack")) {
+				if offset, err := strconv.ParseUint(string(args[2]), 10, 64); err == nil {
+					atomic.StoreUint64(&rep.offset, offset)
+				}
+			}
+		}
+	}()
+
+	// The replica is pinged while there are no writes to send, and the writer is shared with the
+	// pings.
+	var wmtx sync.Mutex
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+		c.conn.SetWriteDeadline(time.Time{})
+	}()
+
+	go func() {
+		defer close(exited)
+		pingReplica(c, &wmtx, done)
+	}()
+
+	for {
+		records, err := f.Next()
+		if err == keychain.ErrFollowerClosed {
+			return nil
+		} else if err != nil {
+			log.Errorf("stopped replicating to %s: %v", rep.addr, err)
+			return nil
+		}
+
+		// Writes that a replica does not take for as long as it would take to notice a broken
+		// link fail, so that a replica that is gone is not waited for forever.
+		wmtx.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+		if err = writeRecords(c.w, records); err == nil {
+			err = c.w.Flush()
+		}
+		wmtx.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pingReplica sends PING to a replica periodically, until done is closed or writing fails.
+func pingReplica(c *Conn, wmtx *sync.Mutex, done chan struct{}) {
+	ticker := time.NewTicker(replicaPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		wmtx.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+		err := c.w.WriteCommand("PING")
+		if err == nil {
+			err = c.w.Flush()
+		}
+		wmtx.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// replconf handles REPLCONF option value ..., which replicas use to configure replication. The
+// options are accepted and ignored, since acknowledgements are read by PSYNC directly.
+func replconf(c *Conn, args [][]byte) error {
+	if len(args)%2 == 0 {
+		return c.writeError("ERR syntax error")
+	}
+
+	return c.w.WriteSimpleString("OK")
+}
+
+// replicaof handles REPLICAOF host port, which makes the server a replica of another server, and
+// REPLICAOF NO ONE, which makes it a primary again.
+func replicaof(c *Conn, args [][]byte) error {
+	if c.srv.cluster != nil {
+		return c.writeError("ERR REPLICAOF not allowed in cluster mode.")
+	}
+
+	if bytes.EqualFold(args[1], []byte("no")) && bytes.EqualFold(args[2], []byte("one")) {
+		c.srv.ReplicaOf("")
+		return c.w.WriteSimpleString("OK")
+	}
+
+	port, err := strconv.ParseUint(string(args[2]), 10, 16)
+	if err != nil {
+		return c.writeError("ERR Invalid master port")
+	}
+
+	c.srv.ReplicaOf(net.JoinHostPort(string(args[1]), strconv.FormatUint(port, 10)))
+	return c.w.WriteSimpleString("OK")
+}
+
+// role handles ROLE, which replies with the role of the server in replication, as Redis does.
+// A primary replies with its offset and its replicas, and a replica replies with its primary and
+// the state of its link.
+func role(c *Conn, args [][]byte) error {
+	s := c.srv
+
+	s.repl.mtx.Lock()
+	defer s.repl.mtx.Unlock()
+
+	if l := s.repl.link; l != nil {
+		host, port, _ := net.SplitHostPort(l.addr)
+		portNum, _ := strconv.ParseInt(port, 10, 64)
+		state, offset := l.status()
+
+		return c.w.WriteArray([]interface{}{"slave", host, portNum, state, int64(offset)})
+	}
+
+	replicas := make([]interface{}, 0, len(s.repl.replicas))
+	for _, rep := range s.repl.replicas {
+		host, port, _ := net.SplitHostPort(rep.addr)
+		offset := strconv.FormatUint(atomic.LoadUint64(&rep.offset), 10)
+		replicas = append(replicas, []interface{}{[]byte(host), []byte(port), []byte(offset)})
+	}
+
+	return c.w.WriteArray([]interface{}{"master", int64(s.keys.Seq()), replicas})
+}
+
+// replicationInfo returns the fields of the replication section of INFO.
+func replicationInfo(s *Server) [][2]string {
+	s.repl.mtx.Lock()
+	defer s.repl.mtx.Unlock()
+
+	if l := s.repl.link; l != nil {
+		host, port, _ := net.SplitHostPort(l.addr)
+		state, offset := l.status()
+
+		l.mtx.Lock()
+		id := l.id
+		l.mtx.Unlock()
+
+		status, syncing := "down", "0"
+		if state == "connected" {
+			status = "up"
+		} else if state == "sync" {
+			syncing = "1"
+		}
+
+		return [][2]string{
+			{"role", "slave"},
+			{"master_host", host},
+			{"master_port", port},
+			{"master_link_status", status},
+			{"master_sync_in_progress", syncing},
+			{"slave_repl_offset", strconv.FormatUint(offset, 10)},
+			{"master_replid", id},
+		}
+	}
+
+	fields := [][2]string{
+		{"role", "master"},
+		{"connected_slaves", strconv.Itoa(len(s.repl.replicas))},
+	}
+
+	i := 0
+	for _, rep := range s.repl.replicas {
+		host, port, _ := net.SplitHostPort(rep.addr)
+		offset := atomic.LoadUint64(&rep.offset)
+		fields = append(fields, [2]string{
+			"slave" + strconv.Itoa(i),
+			fmt.Sprintf("ip=%s,port=%s,state=online,offset=%d", host, port, offset),
+		})
+		i++
+	}
+
+	return append(fields,
+		[2]string{"master_replid", s.repl.id},
+		[2]string{"master_repl_offset", strconv.FormatUint(s.keys.Seq(), 10)},
+	)
+}
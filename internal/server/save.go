@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	register(&Command{Name: "save", Arity: 1, Handler: saveCmd})
+	register(&Command{Name: "bgsave", Arity: 1, Handler: bgsave})
+	register(&Command{Name: "lastsave", Arity: 1, Handler: lastsave})
+}
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+// persistence holds the state of the snapshots of the store written by SAVE and BGSAVE.
+type persistence struct {
+	// path is the file that snapshots are written to.
+	path string
+
+	mtx        sync.Mutex
+	inProgress bool
+	lastSave   time.Time
+	lastStatus string
+	wg         sync.WaitGroup
+}
+
+// begin marks a snapshot as in progress, unless another one already is.
+func (p *persistence) begin() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.path == "" {
+		return errors.New("no snapshot file is configured")
+	}
+
+	if p.inProgress {
+		return errSaveInProgress
+	}
+
+	p.inProgress = true
+	return nil
+}
+
+// end records the outcome of the snapshot in progress.
+func (p *persistence) end(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.inProgress = false
+	if err != nil {
+		p.lastStatus = "err"
+		return
+	}
+
+	p.lastSave = time.Now()
+	p.lastStatus = "ok"
+}
+
+// save writes the keys that an iterator over the store visits as a snapshot to the snapshot file.
+// The snapshot is written under a temporary name first, so that the previous snapshot is only
+// replaced by a complete one.
+func (s *Server) save(it *keychain.Iterator) error {
+	tmp := s.persist.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := it.WriteSnapshot(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.persist.path)
+}
+
+// saveCmd handles SAVE, which writes a snapshot of the store before replying.
+func saveCmd(c *Conn, args [][]byte) error {
+	if err := c.srv.persist.begin(); err != nil {
+		return err
+	}
+
+	it := c.srv.keys.Scan(nil)
+	err := c.srv.save(it)
+	it.Close()
+
+	c.srv.persist.end(err)
+	if err != nil {
+		return err
+	}
+
+	return c.w.WriteSimpleString("OK")
+}
+
+// bgsave handles BGSAVE, which writes a snapshot of the store in the background. The keys of the
+// snapshot are captured before replying, so the snapshot is of the store as it is when the command
+// is run.
+func bgsave(c *Conn, args [][]byte) error {
+	if !c.srv.trackSave() {
+		return ErrServerClosed
+	}
+
+	if err := c.srv.persist.begin(); err != nil {
+		c.srv.persist.wg.Done()
+		return err
+	}
+
+	it := c.srv.keys.Scan(nil)
+	go func(s *Server) {
+		defer s.persist.wg.Done()
+		defer it.Close()
+
+		err := s.save(it)
+		if err != nil {
+			log.Errorf("error writing snapshot to %s: %v", s.persist.path, err)
+		} else {
+			log.Infof("Background saving to %s terminated with success", s.persist.path)
+		}
+
+		s.persist.end(err)
+	}(c.srv)
+
+	return c.w.WriteSimpleString("Background saving started")
+}
+
+// trackSave adds a background snapshot to the ones that Close waits for, unless the server is
+// closed.
+func (s *Server) trackSave() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.persist.wg.Add(1)
+	return true
+}
+
+// lastsave handles LASTSAVE, replying with the Unix time of the last successful snapshot, or of
+// the start of the server if there has been none.
+func lastsave(c *Conn, args [][]byte) error {
+	c.srv.persist.mtx.Lock()
+	t := c.srv.persist.lastSave
+	c.srv.persist.mtx.Unlock()
+
+	return c.w.WriteInteger(t.Unix())
+}
+
+// persistenceInfo returns the fields of the persistence section of INFO.
+func persistenceInfo(s *Server) [][2]string {
+	s.persist.mtx.Lock()
+	defer s.persist.mtx.Unlock()
+
+	inProgress := "0"
+	if s.persist.inProgress {
+		inProgress = "1"
+	}
+
+	return [][2]string{
+		{"rdb_bgsave_in_progress", inProgress},
+		{"rdb_last_save_time", strconv.FormatInt(s.persist.lastSave.Unix(), 10)},
+		{"rdb_last_bgsave_status", s.persist.lastStatus},
+	}
+}
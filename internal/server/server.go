@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/cluster"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxBulkLength is the maximum length of a bulk string in a command, when no other length is
+// configured.
+const DefaultMaxBulkLength = 512 << 20
+
+// DefaultMaxQueryBufferSize is the maximum size in bytes of a command, when no other size is
+// configured.
+const DefaultMaxQueryBufferSize = 1 << 30
+
+// ErrServerClosed is returned by Serve once the server has been closed.
+var ErrServerClosed = errors.New("server: server closed")
+
+// Conf represents the configuration options for a server.
+type Conf struct {
+	// MaxBulkLength is the maximum length of a bulk string in a command. If it is zero, then
+	// DefaultMaxBulkLength is used.
+	MaxBulkLength int64
+
+	// MaxQueryBufferSize is the maximum number of bytes of a single command that are buffered
+	// before the command is executed. If it is zero, then DefaultMaxQueryBufferSize is used.
+	MaxQueryBufferSize int64
+
+	// ACL defines the users of the server. If it is nil, then the only user is the default user,
+	// which can run every command on every key.
+	ACL *ACL
+
+	// RequirePass is the password of the default user. If it is not empty, then clients must
+	// authenticate with AUTH before running commands.
+	RequirePass string
+
+	// ReplicaOf is the address of the primary that the server replicates, as host:port. If it is
+	// empty, then the server is a primary.
+	ReplicaOf string
+
+	// MasterUser and MasterAuth are the user and password that a replica authenticates with to
+	// its primary, if MasterAuth is not empty. If MasterUser is empty, then the password is that
+	// of the default user.
+	MasterUser string
+	MasterAuth string
+
+	// MasterTLSConfig is the TLS configuration for connecting to the primary. If it is nil, then
+	// TLS is not used. If it has no ServerName, then the host of the primary is used.
+	MasterTLSConfig *tls.Config
+
+	// Cluster is the node through which the store is replicated, if the server is part of a
+	// cluster. Writes are then only accepted by the leader, and other nodes redirect clients to
+	// it. It cannot be combined with ReplicaOf.
+	Cluster *cluster.Node
+
+	// SnapshotPath is the file that SAVE and BGSAVE write snapshots of the store to. If it is
+	// empty, then those commands fail.
+	SnapshotPath string
+}
+
+// Version is the version of the server reported to clients.
+const Version = "0.1.0"
+
+// Server serves a Keychain store to clients over RESP.
+type Server struct {
+	keys    *keychain.Keychain
+	writes  writer
+	cluster *cluster.Node
+	limits  resp.Limits
+	acl     *ACL
+	started time.Time
+
+	// nextID is the ID of the next connection.
+	nextID uint64
+
+	repl replication
+
+	persist persistence
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewConf returns a server for the specified store using the specified configuration. The store
+// is not closed when the server is.
+func NewConf(keys *keychain.Keychain, conf *Conf) *Server {
+	s := &Server{
+		keys:    keys,
+		writes:  keys,
+		started: time.Now(),
+		limits: resp.Limits{
+			MaxBulkLength:  DefaultMaxBulkLength,
+			MaxMessageSize: DefaultMaxQueryBufferSize,
+		},
+		acl: NewACL(""),
+		repl: replication{
+			id:       newReplicationID(),
+			replicas: make(map[*Conn]*replica),
+		},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*Conn]struct{}),
+	}
+
+	s.persist.lastSave = s.started
+	s.persist.lastStatus = "ok"
+
+	if conf != nil {
+		s.persist.path = conf.SnapshotPath
+
+		if conf.ACL != nil {
+			s.acl = conf.ACL
+		}
+
+		if conf.RequirePass != "" {
+			// The password is set on a copy, so that the ACL of the configuration is unchanged.
+			s.acl = s.acl.clone()
+			s.acl.SetPassword(DefaultUser, conf.RequirePass)
+		}
+
+		if conf.MaxBulkLength > 0 {
+			s.limits.MaxBulkLength = conf.MaxBulkLength
+		}
+
+		if conf.MaxQueryBufferSize > 0 {
+			s.limits.MaxMessageSize = conf.MaxQueryBufferSize
+		}
+
+		s.repl.user = conf.MasterUser
+		s.repl.password = conf.MasterAuth
+		s.repl.tlsConfig = conf.MasterTLSConfig
+
+		if conf.Cluster != nil {
+			s.cluster = conf.Cluster
+			s.writes = conf.Cluster
+		} else if conf.ReplicaOf != "" {
+			s.ReplicaOf(conf.ReplicaOf)
+		}
+	}
+
+	return s
+}
+
+// New returns a server for the specified store. The store is not closed when the server is.
+func New(keys *keychain.Keychain) *Server {
+	return NewConf(keys, nil)
+}
+
+// Serve accepts connections on the listener and serves each of them in its own goroutine, until
+// the server is closed. It always returns a non-nil error, which is ErrServerClosed if the server
+// was closed.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+
+	s.listeners[lis] = struct{}{}
+	s.mtx.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			delete(s.listeners, lis)
+			s.mtx.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("error accepting connection: %v", err)
+				s.mtx.Lock()
+				s.listeners[lis] = struct{}{}
+				s.mtx.Unlock()
+				continue
+			}
+
+			lis.Close()
+			return err
+		}
+
+		c := newConn(s, conn)
+		if !s.track(c) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.untrack(c)
+			c.serve()
+		}()
+	}
+}
+
+// ServeConn serves a single connection, returning once the client disconnects or the server is
+// closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	c := newConn(s, conn)
+	if !s.track(c) {
+		conn.Close()
+		return
+	}
+
+	defer s.untrack(c)
+	c.serve()
+}
+
+// Close stops accepting connections, closes the open connections and waits for them to finish,
+// along with any snapshot being written in the background. A replica stops replicating.
+func (s *Server) Close() error {
+	s.ReplicaOf("")
+
+	s.mtx.Lock()
+	s.closed = true
+
+	var firstErr error
+	for lis := range s.listeners {
+		if err := lis.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for c := range s.conns {
+		c.conn.Close()
+	}
+
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+	s.persist.wg.Wait()
+	return firstErr
+}
+
+// track adds a connection to the set of open connections, unless the server is closed.
+func (s *Server) track(c *Conn) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// numConns returns the number of open connections.
+func (s *Server) numConns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.conns)
+}
+
+// untrack removes a connection from the set of open connections once it has been closed.
+func (s *Server) untrack(c *Conn) {
+	s.mtx.Lock()
+	delete(s.conns, c)
+	s.mtx.Unlock()
+
+	s.wg.Done()
+}
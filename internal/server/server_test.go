@@ -0,0 +1,742 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/cluster"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer starts a server for a new store on a random local port, returning a connection to
+// it and a function that shuts everything down.
+func startServer(t *testing.T) (net.Conn, func()) {
+	return startServerConf(t, nil)
+}
+
+// startServerConf is like startServer, but uses the specified configuration for the server.
+func startServerConf(t *testing.T, conf *Conf) (net.Conn, func()) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	keys, err := keychain.Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	srv := NewConf(keys, conf)
+	go srv.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to server: %v", err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		srv.Close()
+		keys.Close()
+		os.RemoveAll(name)
+	}
+}
+
+func TestServer(t *testing.T) {
+	conn, stop := startServer(t)
+	defer stop()
+
+	rd := bufio.NewReader(conn)
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{"*2\r\n$4\r\nping\r\n$2\r\nhi\r\n", "$2\r\nhi\r\n"},
+		{"*2\r\n$4\r\nECHO\r\n$5\r\nhello\r\n", "$5\r\nhello\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", "+OK\r\n"},
+		{"*2\r\n$3\r\nGet\r\n$3\r\nfoo\r\n", "$3\r\nbar\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n", "$-1\r\n"},
+		{"*3\r\n$6\r\nEXISTS\r\n$3\r\nfoo\r\n$7\r\nmissing\r\n", ":1\r\n"},
+		{"*2\r\n$3\r\nTTL\r\n$3\r\nfoo\r\n", ":-1\r\n"},
+		{"*3\r\n$6\r\nEXPIRE\r\n$3\r\nfoo\r\n$3\r\n100\r\n", ":1\r\n"},
+		{"*2\r\n$3\r\nTTL\r\n$3\r\nfoo\r\n", ":100\r\n"},
+		{"*2\r\n$7\r\nPERSIST\r\n$3\r\nfoo\r\n", ":1\r\n"},
+		{"PTTL foo\r\n", ":-1\r\n"},
+		{"*5\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n$2\r\nEX\r\n$2\r\n10\r\n", "+OK\r\n"},
+		{"*2\r\n$3\r\nTTL\r\n$3\r\nbaz\r\n", ":10\r\n"},
+		{"MGET foo missing baz\r\n", "*3\r\n$3\r\nbar\r\n$-1\r\n$3\r\nqux\r\n"},
+		{"KEYS *\r\n", "*2\r\n$3\r\nbaz\r\n$3\r\nfoo\r\n"},
+		{"KEYS b?[x-z]\r\n", "*1\r\n$3\r\nbaz\r\n"},
+		{"*4\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n$2\r\nXX\r\n", "-ERR syntax error\r\n"},
+		{"*4\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n$7\r\nmissing\r\n", ":2\r\n"},
+		{"*2\r\n$3\r\nTTL\r\n$3\r\nfoo\r\n", ":-2\r\n"},
+		{"PTTL foo\r\n", ":-2\r\n"},
+		{"*1\r\n$3\r\nGET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"*1\r\n$5\r\nBOGUS\r\n", "-ERR unknown command 'BOGUS'\r\n"},
+		{"PING\r\n", "+PONG\r\n"},
+		{"SET foo \"hello world\"\r\n", "+OK\r\n"},
+		{"\r\nget foo\n", "$11\r\nhello world\r\n"},
+		{"DEL foo 'missing'\r\n", ":1\r\n"},
+		{"*1\r\n$4\r\nQUIT\r\n", "+OK\r\n"},
+	}
+
+	for i, tt := range tests {
+		if _, err := conn.Write([]byte(tt.command)); err != nil {
+			t.Fatalf("tests[%d]: failed to write command: %v", i, err)
+		}
+
+		reply := make([]byte, len(tt.expected))
+		if _, err := io.ReadFull(rd, reply); err != nil {
+			t.Fatalf("tests[%d]: failed to read reply: %v", i, err)
+		}
+
+		assert.Equal(t, tt.expected, string(reply), "tests[%d]", i)
+	}
+
+	// The server closes the connection after QUIT.
+	if _, err := rd.ReadByte(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "user:1/profile", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:1", "user:1", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, matchPattern([]byte(tt.pattern), []byte(tt.s)), "%q ~ %q", tt.pattern, tt.s)
+	}
+}
+
+// commander returns a function that sends a command on the connection and returns the reply.
+func commander(t *testing.T, conn net.Conn) func(args ...interface{}) interface{} {
+	r := resp.NewReader(conn)
+	w := resp.NewWriter(conn)
+
+	return func(args ...interface{}) interface{} {
+		if err := w.WriteCommand(args...); err != nil {
+			t.Fatalf("failed to write command: %v", err)
+		}
+
+		if err := w.Flush(); err != nil {
+			t.Fatalf("failed to write command: %v", err)
+		}
+
+		reply, err := r.ReadMessage(resp.GenericSliceParser)
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+
+		return reply
+	}
+}
+
+func TestHello(t *testing.T) {
+	conn, stop := startServerConf(t, &Conf{MaxBulkLength: 1024})
+	defer stop()
+
+	do := commander(t, conn)
+
+	// Connections start out with RESP2, where maps are flattened into arrays.
+	assert.Equal(t, []interface{}{[]byte("proto-max-bulk-len"), []byte("1024")}, do("CONFIG", "GET", "proto-*"))
+	assert.Equal(t, []byte(nil), do("GET", "missing"))
+
+	assert.Equal(t, resp.NewRespError("NOPROTO unsupported protocol version"), do("HELLO", "4"))
+
+	reply, ok := do("HELLO", "3", "SETNAME", "test").(resp.Map)
+	if !ok {
+		t.Fatalf("expected HELLO to reply with a map")
+	}
+
+	assert.Equal(t, resp.MapEntry{Key: "proto", Value: int64(3)}, reply[2])
+
+	assert.Equal(t, resp.Map{{Key: []byte("proto-max-bulk-len"), Value: []byte("1024")}}, do("CONFIG", "GET", "proto-*"))
+	assert.Equal(t, resp.Map{{Key: []byte("proto-max-bulk-len"), Value: []byte("1024")}}, do("CONFIG", "GET", "PROTO-*-[a-l]en"))
+	assert.Equal(t, nil, do("GET", "missing"))
+
+	info, ok := do("INFO", "server").(resp.Verbatim)
+	if !ok {
+		t.Fatalf("expected INFO to reply with a verbatim string")
+	}
+
+	assert.Equal(t, "txt", info.Format)
+	assert.Contains(t, info.Text, "# Server\r\nkeychain_version:"+Version+"\r\n")
+	assert.NotContains(t, info.Text, "# Clients")
+}
+
+func TestAuth(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# The default user gets its password from requirepass.
+user default on allcommands allkeys
+user alice on >secret +get +set +keys +psync +replicaof ~app:* ~config
+user bob off >secret allcommands allkeys
+user carol on #2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b allcommands allkeys -del
+`))
+	if err != nil {
+		t.Fatalf("could not parse ACL: %v", err)
+	}
+
+	conn, stop := startServerConf(t, &Conf{ACL: acl, RequirePass: "hunter2"})
+	defer stop()
+
+	// The password is only set on the ACL of the server, not on that of the configuration.
+	_, ok := acl.Authenticate(DefaultUser, "hunter2")
+	assert.False(t, ok)
+
+	do := commander(t, conn)
+
+	assert.Equal(t, resp.NewRespError("NOAUTH Authentication required."), do("GET", "foo"))
+	assert.Equal(t, resp.NewRespError("NOAUTH Authentication required."), do("PING"))
+	assert.Equal(t, resp.NewRespError("WRONGPASS invalid username-password pair or user is disabled."), do("AUTH", "wrong"))
+	assert.Equal(t, resp.NewRespError("WRONGPASS invalid username-password pair or user is disabled."), do("AUTH", "bob", "secret"))
+	assert.Equal(t, "OK", do("AUTH", "hunter2"))
+	assert.Equal(t, "OK", do("SET", "foo", "bar"))
+
+	// Users are limited to their commands and keys.
+	assert.Equal(t, "OK", do("AUTH", "alice", "secret"))
+	assert.Equal(t, "OK", do("SET", "app:1", "bar"))
+	assert.Equal(t, []byte("bar"), do("GET", "app:1"))
+	assert.Equal(t, []byte(nil), do("GET", "config"))
+	assert.Equal(t, resp.NewRespError("NOPERM this user has no permissions to access one of the keys used as arguments"), do("GET", "foo"))
+	assert.Equal(t, resp.NewRespError("NOPERM this user has no permissions to run the 'del' command"), do("DEL", "app:1"))
+	assert.Equal(t, []interface{}{[]byte("app:1")}, do("KEYS", "*"))
+
+	// Commands that read or replace the whole store need access to every key.
+	assert.Equal(t, resp.NewRespError("NOPERM this user has no permissions to access every key, which the 'psync' command requires"), do("PSYNC", "?", "-1"))
+	assert.Equal(t, resp.NewRespError("NOPERM this user has no permissions to access every key, which the 'replicaof' command requires"), do("REPLICAOF", "NO", "ONE"))
+
+	// The password of carol is "secret", given by its hash.
+	reply, ok := do("HELLO", "3", "AUTH", "carol", "secret").(resp.Map)
+	if !ok {
+		t.Fatalf("expected HELLO to reply with a map")
+	}
+
+	assert.Equal(t, resp.MapEntry{Key: "proto", Value: int64(3)}, reply[2])
+	assert.Equal(t, int64(2), do("EXISTS", "foo", "app:1", "missing"))
+	assert.Equal(t, resp.NewRespError("NOPERM this user has no permissions to run the 'del' command"), do("DEL", "foo"))
+
+	// A new connection must authenticate again, and HELLO without AUTH is not enough.
+	conn2, err := net.Dial("tcp", conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("could not connect to server: %v", err)
+	}
+
+	defer conn2.Close()
+
+	do2 := commander(t, conn2)
+
+	reply2, ok := do2("HELLO", "2").(resp.RespError)
+	assert.True(t, ok)
+	assert.True(t, strings.HasPrefix(reply2.Message(), "NOAUTH "))
+
+	_, err = ParseACL(strings.NewReader("user dave on +bogus"))
+	assert.EqualError(t, err, "acl: line 1: unknown command 'bogus'")
+}
+
+// eventually waits for a condition to hold, failing the test if it does not within a few seconds.
+func eventually(t *testing.T, cond func() bool, message string) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", message)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primaryConn, stopPrimary := startServer(t)
+	defer stopPrimary()
+
+	replicaConn, stopReplica := startServer(t)
+	defer stopReplica()
+
+	primary := commander(t, primaryConn)
+	replica := commander(t, replicaConn)
+
+	assert.Equal(t, "OK", primary("SET", "a", "1"))
+	assert.Equal(t, "OK", primary("SET", "b", "2", "EX", "100"))
+	assert.Equal(t, "OK", primary("SET", "c", "3"))
+	assert.Equal(t, int64(1), primary("DEL", "c"))
+
+	// The data of the replica is replaced by that of the primary.
+	assert.Equal(t, "OK", replica("SET", "x", "y"))
+
+	host, port, _ := net.SplitHostPort(primaryConn.RemoteAddr().String())
+	assert.Equal(t, "OK", replica("REPLICAOF", host, port))
+
+	eventually(t, func() bool {
+		return bytes.Equal([]byte("1"), asBytes(replica("GET", "a")))
+	}, "initial sync")
+
+	assert.Equal(t, []byte("2"), replica("GET", "b"))
+	assert.Equal(t, int64(100), replica("TTL", "b"))
+	assert.Equal(t, []byte(nil), replica("GET", "c"))
+	assert.Equal(t, []byte(nil), replica("GET", "x"))
+
+	assert.Equal(t, resp.NewRespError("READONLY You can't write against a read only replica."), replica("SET", "a", "2"))
+
+	// Writes to the primary are streamed to the replica.
+	assert.Equal(t, "OK", primary("SET", "d", "4"))
+	assert.Equal(t, int64(1), primary("DEL", "a"))
+	assert.Equal(t, int64(1), primary("EXPIRE", "d", "50"))
+
+	eventually(t, func() bool {
+		return replica("TTL", "d") == int64(50)
+	}, "streamed writes")
+
+	assert.Equal(t, []byte("4"), replica("GET", "d"))
+	assert.Equal(t, []byte(nil), replica("GET", "a"))
+
+	primaryRole := primary("ROLE").([]interface{})
+	assert.Equal(t, "master", primaryRole[0])
+
+	// The replica advances its offset once it has applied a write.
+	var replicaRole []interface{}
+	eventually(t, func() bool {
+		replicaRole = replica("ROLE").([]interface{})
+		return replicaRole[4] == primaryRole[1]
+	}, "replica offset")
+
+	assert.Equal(t, []interface{}{"slave", host, replicaRole[2], "connected", primaryRole[1]}, replicaRole)
+
+	// The replica acknowledges its offset to the primary.
+	eventually(t, func() bool {
+		role := primary("ROLE").([]interface{})
+		replicas := role[2].([]interface{})
+		return len(replicas) == 1 && string(replicas[0].([]interface{})[2].([]byte)) == strconv.FormatInt(role[1].(int64), 10)
+	}, "acknowledged offset")
+
+	info := string(asBytes(primary("INFO", "replication")))
+	assert.Contains(t, info, "role:master\r\nconnected_slaves:1\r\nslave0:ip=")
+
+	info = string(asBytes(replica("INFO", "replication")))
+	assert.Contains(t, info, "role:slave\r\nmaster_host:"+host+"\r\nmaster_port:"+port+"\r\nmaster_link_status:up\r\n")
+
+	// A replica that is promoted keeps its data and accepts writes.
+	assert.Equal(t, "OK", replica("REPLICAOF", "NO", "ONE"))
+	assert.Equal(t, "OK", replica("SET", "a", "5"))
+	assert.Equal(t, []byte("4"), replica("GET", "d"))
+	assert.Equal(t, "master", replica("ROLE").([]interface{})[0])
+
+	eventually(t, func() bool {
+		return len(primary("ROLE").([]interface{})[2].([]interface{})) == 0
+	}, "replica disconnected")
+}
+
+func TestReplicationTimeout(t *testing.T) {
+	defer func(ping, timeout time.Duration) {
+		replicaPingInterval, replicaTimeout = ping, timeout
+	}(replicaPingInterval, replicaTimeout)
+
+	replicaPingInterval, replicaTimeout = 20*time.Millisecond, 200*time.Millisecond
+
+	primaryConn, stopPrimary := startServer(t)
+	defer stopPrimary()
+
+	replicaConn, stopReplica := startServer(t)
+	defer stopReplica()
+
+	replica := commander(t, replicaConn)
+	host, port, _ := net.SplitHostPort(primaryConn.RemoteAddr().String())
+	assert.Equal(t, "OK", replica("REPLICAOF", host, port))
+
+	eventually(t, func() bool {
+		return replica("ROLE").([]interface{})[3] == "connected"
+	}, "initial sync")
+
+	// The pings of the primary keep an idle link up.
+	time.Sleep(3 * replicaTimeout)
+	assert.Equal(t, "connected", replica("ROLE").([]interface{})[3])
+
+	// A primary that goes silent, as if the connection had broken without either side noticing,
+	// is given up on.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	defer lis.Close()
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		r := resp.NewReader(conn)
+		if _, err := r.ReadValue(); err != nil {
+			return
+		}
+
+		conn.Write([]byte("+FULLRESYNC 0123456789 0 0\r\n"))
+		for {
+			if _, err := r.ReadValue(); err != nil {
+				return
+			}
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(lis.Addr().String())
+	assert.Equal(t, "OK", replica("REPLICAOF", host, port))
+
+	eventually(t, func() bool {
+		return replica("ROLE").([]interface{})[3] == "connected"
+	}, "sync with the silent primary")
+
+	eventually(t, func() bool {
+		return replica("ROLE").([]interface{})[3] != "connected"
+	}, "broken link")
+}
+
+func TestReplicationAuth(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader("user default on allcommands allkeys\nuser repl on >repl-secret allcommands allkeys\n"))
+	if err != nil {
+		t.Fatalf("could not parse ACL: %v", err)
+	}
+
+	primaryConn, stopPrimary := startServerConf(t, &Conf{ACL: acl, RequirePass: "secret"})
+	defer stopPrimary()
+
+	primary := commander(t, primaryConn)
+	assert.Equal(t, "OK", primary("AUTH", "secret"))
+	assert.Equal(t, "OK", primary("SET", "a", "1"))
+
+	addr := primaryConn.RemoteAddr().String()
+
+	authConn, stopAuth := startServerConf(t, &Conf{ReplicaOf: addr, MasterUser: "repl", MasterAuth: "repl-secret"})
+	defer stopAuth()
+
+	// A replica without the password of the primary cannot synchronize with it.
+	replicaConn, stopReplica := startServerConf(t, &Conf{ReplicaOf: addr, MasterAuth: "wrong"})
+	defer stopReplica()
+
+	authReplica := commander(t, authConn)
+	eventually(t, func() bool {
+		return bytes.Equal([]byte("1"), asBytes(authReplica("GET", "a")))
+	}, "initial sync")
+
+	replica := commander(t, replicaConn)
+	assert.Equal(t, []byte(nil), replica("GET", "a"))
+	assert.NotEqual(t, "connected", replica("ROLE").([]interface{})[3])
+	assert.Equal(t, 1, len(primary("ROLE").([]interface{})[2].([]interface{})))
+}
+
+// asBytes returns a reply as a byte slice, or nil if it is not a bulk string.
+func asBytes(reply interface{}) []byte {
+	b, _ := reply.([]byte)
+	return b
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The addresses of every node must be known before the nodes are started.
+	var raftListeners, listeners []net.Listener
+	var peers []cluster.Peer
+	for i := 1; i <= 3; i++ {
+		raftLis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+
+		raftListeners = append(raftListeners, raftLis)
+		listeners = append(listeners, lis)
+		peers = append(peers, cluster.Peer{
+			ID:         fmt.Sprintf("n%d", i),
+			Addr:       raftLis.Addr().String(),
+			ClientAddr: lis.Addr().String(),
+		})
+	}
+
+	var nodes []*cluster.Node
+	var cmds []func(args ...interface{}) interface{}
+	for i, p := range peers {
+		keys, err := keychain.Open(filepath.Join(dir, p.ID, "data"))
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+
+		defer keys.Close()
+
+		node, err := cluster.New(keys, &cluster.Conf{
+			ID:                p.ID,
+			Dir:               filepath.Join(dir, p.ID, "raft"),
+			Peers:             peers,
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   100 * time.Millisecond,
+		})
+
+		if err != nil {
+			t.Fatalf("could not start node: %v", err)
+		}
+
+		defer node.Close()
+		go node.Serve(raftListeners[i])
+
+		srv := NewConf(keys, &Conf{Cluster: node})
+		defer srv.Close()
+		go srv.Serve(listeners[i])
+
+		conn, err := net.Dial("tcp", p.ClientAddr)
+		if err != nil {
+			t.Fatalf("could not connect to server: %v", err)
+		}
+
+		defer conn.Close()
+
+		nodes = append(nodes, node)
+		cmds = append(cmds, commander(t, conn))
+	}
+
+	var leader int
+	eventually(t, func() bool {
+		for i, node := range nodes {
+			if _, ok := node.Leader(); !ok {
+				return false
+			}
+
+			if node.State() == cluster.Leader {
+				leader = i
+			}
+		}
+
+		return nodes[leader].State() == cluster.Leader
+	}, "leader election")
+
+	follower := (leader + 1) % len(nodes)
+
+	// Writes are redirected to the leader, and replicated to every node.
+	assert.Equal(t, resp.NewRespError("MOVED 0 "+peers[leader].ClientAddr), cmds[follower]("SET", "a", "1"))
+	assert.Equal(t, "OK", cmds[leader]("SET", "a", "1"))
+	assert.Equal(t, "OK", cmds[leader]("SET", "b", "2", "EX", "100"))
+	assert.Equal(t, int64(1), cmds[leader]("DEL", "b"))
+
+	for _, cmd := range cmds {
+		cmd := cmd
+		eventually(t, func() bool {
+			return bytes.Equal([]byte("1"), asBytes(cmd("GET", "a")))
+		}, "replicated write")
+
+		assert.Equal(t, []byte(nil), cmd("GET", "b"))
+	}
+
+	info := string(asBytes(cmds[follower]("INFO", "cluster")))
+	assert.Contains(t, info, "cluster_enabled:1\r\ncluster_state:ok\r\ncluster_node_id:"+peers[follower].ID+"\r\ncluster_role:follower\r\ncluster_leader:"+peers[leader].ID+"\r\n")
+	assert.Contains(t, info, "cluster_known_nodes:3\r\n")
+
+	assert.Equal(t, resp.NewRespError("ERR REPLICAOF not allowed in cluster mode."), cmds[follower]("REPLICAOF", "NO", "ONE"))
+}
+
+func TestPipelining(t *testing.T) {
+	conn, stop := startServer(t)
+	defer stop()
+
+	var commands, expected bytes.Buffer
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		fmt.Fprintf(&commands, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(key), key)
+		fmt.Fprintf(&commands, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+		fmt.Fprintf(&expected, "+OK\r\n$%d\r\n%s\r\n", len(key), key)
+	}
+
+	// The whole pipeline is sent before any of the replies are read.
+	go conn.Write(commands.Bytes())
+
+	reply := make([]byte, expected.Len())
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read replies: %v", err)
+	}
+
+	assert.Equal(t, expected.String(), string(reply))
+}
+
+func TestMaxBulkLength(t *testing.T) {
+	conn, stop := startServerConf(t, &Conf{MaxBulkLength: 16})
+	defer stop()
+
+	if _, err := conn.Write([]byte("*2\r\n$4\r\nECHO\r\n$1000000000\r\n")); err != nil {
+		t.Fatalf("failed to write command: %v", err)
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+
+	// The connection is closed after the protocol error.
+	assert.Equal(t, "-ERR Protocol error: invalid bulk string length: 1000000000\r\n", string(reply))
+}
+
+func TestListenUnix(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	path := filepath.Join(name, "keychain.sock")
+
+	// A socket file left behind by a server that crashed is removed.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := ListenUnix(path, 0700)
+	if err != nil {
+		t.Fatalf("could not listen on stale socket: %v", err)
+	}
+	defer lis.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat socket: %v", err)
+	}
+
+	assert.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	// A socket that a server is listening on is left alone.
+	if _, err := ListenUnix(path, 0); err == nil {
+		t.Fatalf("expected listening on a socket in use to fail")
+	}
+
+	// Other files are left alone as well.
+	other := filepath.Join(name, "data")
+	if err := ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	if _, err := ListenUnix(other, 0); err == nil {
+		t.Fatalf("expected listening on a regular file to fail")
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keychain.snapshot")
+	conn, stop := startServerConf(t, &Conf{SnapshotPath: path})
+	defer stop()
+
+	do := commander(t, conn)
+	started := do("LASTSAVE").(int64)
+	assert.InDelta(t, time.Now().Unix(), started, 5)
+
+	assert.Equal(t, "OK", do("SET", "a", "1"))
+	assert.Equal(t, "OK", do("SET", "b", "2", "EX", "100"))
+	assert.Equal(t, "OK", do("SAVE"))
+	assert.True(t, do("LASTSAVE").(int64) >= started)
+
+	assert.Equal(t, "OK", do("SET", "c", "3"))
+	assert.Equal(t, "Background saving started", do("BGSAVE"))
+
+	// Writes made after BGSAVE replies are not part of the snapshot.
+	assert.Equal(t, "OK", do("SET", "d", "4"))
+	eventually(t, func() bool {
+		return strings.Contains(string(asBytes(do("INFO", "persistence"))), "rdb_bgsave_in_progress:0\r\n")
+	}, "background save")
+
+	info := string(asBytes(do("INFO", "persistence")))
+	assert.Contains(t, info, "rdb_last_bgsave_status:ok\r\n")
+
+	// The snapshot can be restored into a new store.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open snapshot: %v", err)
+	}
+
+	defer f.Close()
+
+	restored := filepath.Join(dir, "restored")
+	if err := keychain.Restore(f, restored); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+
+	keys, err := keychain.Open(restored)
+	if err != nil {
+		t.Fatalf("could not open restored database: %v", err)
+	}
+
+	defer keys.Close()
+
+	for key, expected := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		value, err := keys.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+
+	value, err := keys.Get([]byte("d"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	ttl, err := keys.TTL([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 90*time.Second, "ttl of restored key is %v", ttl)
+
+	// Snapshots require a snapshot file.
+	conn2, stop2 := startServer(t)
+	defer stop2()
+
+	do2 := commander(t, conn2)
+	assert.Equal(t, resp.NewRespError("ERR no snapshot file is configured"), do2("SAVE"))
+	assert.Equal(t, resp.NewRespError("ERR no snapshot file is configured"), do2("BGSAVE"))
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig returns a TLS configuration for serving connections with the certificate in certFile
+// and keyFile. The certificates of clients are verified with the CA certificates in caFile, and
+// authClients is one of "yes", where clients must present a certificate, "optional", where the
+// certificate is verified if a client presents one, or "no", where clients are not asked for one.
+func TLSConfig(certFile, keyFile, caFile, authClients string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch authClients {
+	case "yes":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+		return cfg, nil
+	default:
+		return nil, fmt.Errorf("invalid client authentication %q, expected yes, optional or no", authClients)
+	}
+
+	if caFile == "" {
+		return nil, fmt.Errorf("a CA certificate file is required to authenticate clients")
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return cfg, nil
+}
+
+// ReplicaTLSConfig returns a TLS configuration for a replica connecting to its primary. The
+// certificate of the primary is verified with the CA certificates in caFile, or the system roots
+// if it is empty, and the replica presents the certificate in certFile and keyFile, if any.
+func ReplicaTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return cfg, nil
+}
@@ -3,3 +3,5 @@ package util
 var Nil = "(nil)"
 var Ok = "OK"
 var Integer = "(integer)"
+var Error = "(error)"
+var EmptyArray = "(empty array)"
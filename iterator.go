@@ -0,0 +1,229 @@
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+// ErrIteratorClosed is returned when reading a value from an iterator that has been closed.
+var ErrIteratorClosed = errors.New("keychain: iterator is closed")
+
+// IteratorOptions determines which keys an iterator visits, and in which order.
+type IteratorOptions struct {
+	// Prefix restricts the iterator to keys that start with it.
+	Prefix []byte
+
+	// Start restricts the iterator to keys that are greater than or equal to it.
+	Start []byte
+
+	// End restricts the iterator to keys that are less than it.
+	End []byte
+
+	// Reverse makes the iterator visit keys in descending order instead of ascending order.
+	Reverse bool
+}
+
+// Iterator iterates over the keys of a store in order. The keys and the locations of their values
+// are captured when the iterator is created, so the iterator sees a consistent view of the store
+// that is unaffected by later writes. Values are only read from disk when requested. An iterator
+// must be closed once it is no longer needed.
+type Iterator struct {
+	k        *Keychain
+	items    []hint
+	segments map[uint64]*segment
+	reverse  bool
+
+	// cur is the index of the current item, and next is the index of the item the next call to
+	// Next moves to.
+	cur  int
+	next int
+}
+
+// NewIterator returns an iterator over the keys of the store that match the options. Removed and
+// expired keys are skipped.
+func (k *Keychain) NewIterator(opts IteratorOptions) *Iterator {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	return k.newIterator(opts)
+}
+
+// newIterator is like NewIterator, but must be called with the lock held.
+func (k *Keychain) newIterator(opts IteratorOptions) *Iterator {
+	now := time.Now().UnixNano()
+
+	// visit adds a leaf to the items if it matches the options, and reports whether the leaves
+	// that follow it may still match.
+	var items []hint
+	visit := func(node art.Node) bool {
+		key := node.Key()
+		if opts.End != nil && bytes.Compare(key, opts.End) >= 0 {
+			return false
+		}
+
+		if opts.Start != nil && bytes.Compare(key, opts.Start) < 0 {
+			return true
+		}
+
+		if opts.Prefix != nil && !bytes.HasPrefix(key, opts.Prefix) {
+			return true
+		}
+
+		entry := node.Value().(*data.Entry)
+		if entry.ValueSize != -1 && !entry.Expired(now) {
+			items = append(items, hint{key: key, entry: *entry})
+		}
+
+		return true
+	}
+
+	if opts.Prefix != nil {
+		// A prefix scan only visits the subtree of the prefix, rather than every key. Returning
+		// false from its callback only skips the children of a node, so it cannot be stopped at
+		// the end of the range, and the keys past the end are skipped one by one instead.
+		k.entries.ForEachPrefix(opts.Prefix, func(node art.Node) bool {
+			if node.Kind() == art.Leaf {
+				visit(node)
+			}
+
+			return true
+		})
+	} else {
+		// The leaves are visited in order, so the traversal stops at the end of the range.
+		for it := k.entries.Iterator(); it.HasNext(); {
+			node, err := it.Next()
+			if err != nil || !visit(node) {
+				break
+			}
+		}
+	}
+
+	it := &Iterator{
+		k:        k,
+		items:    items,
+		segments: k.acquireSegments(),
+		reverse:  opts.Reverse,
+	}
+
+	it.rewind()
+	return it
+}
+
+// Scan returns an iterator over the keys of the store that start with the prefix, in ascending order.
+func (k *Keychain) Scan(prefix []byte) *Iterator {
+	return k.NewIterator(IteratorOptions{Prefix: prefix})
+}
+
+// Range returns an iterator over the keys of the store in the range [start, end), in ascending
+// order. A nil start or end leaves that side of the range unbounded.
+func (k *Keychain) Range(start []byte, end []byte) *Iterator {
+	return k.NewIterator(IteratorOptions{Start: start, End: end})
+}
+
+// rewind positions the iterator before its first key.
+func (it *Iterator) rewind() {
+	it.cur = -1
+	if it.reverse {
+		it.next = len(it.items) - 1
+	} else {
+		it.next = 0
+	}
+}
+
+// Next moves the iterator to the next key, and reports whether there is one. It must be called
+// before the first key is accessed.
+func (it *Iterator) Next() bool {
+	if it.next < 0 || it.next >= len(it.items) {
+		it.cur = -1
+		return false
+	}
+
+	it.cur = it.next
+	if it.reverse {
+		it.next--
+	} else {
+		it.next++
+	}
+
+	return true
+}
+
+// Seek positions the iterator so that the next call to Next moves to the first key that is greater
+// than or equal to the specified key, or less than or equal to it for a reverse iterator.
+func (it *Iterator) Seek(key []byte) {
+	it.cur = -1
+	if it.reverse {
+		it.next = sort.Search(len(it.items), func(i int) bool {
+			return bytes.Compare(it.items[i].key, key) > 0
+		}) - 1
+	} else {
+		it.next = sort.Search(len(it.items), func(i int) bool {
+			return bytes.Compare(it.items[i].key, key) >= 0
+		})
+	}
+}
+
+// Key returns the current key, or nil if the iterator is not positioned at a key. The returned
+// slice must not be modified.
+func (it *Iterator) Key() []byte {
+	if it.cur < 0 {
+		return nil
+	}
+
+	return it.items[it.cur].key
+}
+
+// Len returns the number of keys that the iterator visits.
+func (it *Iterator) Len() int {
+	return len(it.items)
+}
+
+// Expiry returns the time at which the current key expires, in nanoseconds since the Unix epoch,
+// or zero if it does not expire or the iterator is not positioned at a key.
+func (it *Iterator) Expiry() int64 {
+	if it.cur < 0 {
+		return 0
+	}
+
+	return it.items[it.cur].entry.Expiry
+}
+
+// Value reads the value of the current key from disk. The value is the one the key had when the
+// iterator was created.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.segments == nil {
+		return nil, ErrIteratorClosed
+	}
+
+	if it.cur < 0 {
+		return nil, nil
+	}
+
+	item := &it.items[it.cur]
+	seg, ok := it.segments[item.entry.FileID]
+	if !ok {
+		return nil, fmt.Errorf("data file %d does not exist", item.entry.FileID)
+	}
+
+	return data.ReadValueAt(seg.file, seg.version, item.key, item.entry.ValuePos, item.entry.ValueSize)
+}
+
+// Close releases the data files held by the iterator.
+func (it *Iterator) Close() error {
+	if it.segments == nil {
+		return nil
+	}
+
+	segments := it.segments
+	it.segments = nil
+	it.items = nil
+	it.cur = -1
+
+	return it.k.releaseSegments(segments)
+}
@@ -0,0 +1,128 @@
+package keychain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func collect(it *Iterator, t *testing.T) []string {
+	defer it.Close()
+
+	var keys []string
+	for it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			t.Fatalf("failed reading value: %v", err)
+		}
+
+		if !bytes.Equal(value, append([]byte("value-"), it.Key()...)) {
+			t.Fatalf("incorrect value for key %q: got=%q", it.Key(), value)
+		}
+
+		keys = append(keys, string(it.Key()))
+	}
+
+	return keys
+}
+
+func expectKeys(expected []string, got []string, t *testing.T) {
+	if len(expected) != len(got) {
+		t.Fatalf("incorrect keys: expected=%q, got=%q", expected, got)
+	}
+
+	for i := range expected {
+		if expected[i] != got[i] {
+			t.Fatalf("incorrect keys: expected=%q, got=%q", expected, got)
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{MaxFileSize: 128})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	for _, key := range []string{"b", "a", "ab", "abc", "ac", "c", "bb"} {
+		set(keys, []byte(key), []byte("value-"+key), t)
+	}
+	remove(keys, []byte("bb"), t)
+
+	expectKeys([]string{"a", "ab", "abc", "ac", "b", "c"}, collect(keys.Scan(nil), t), t)
+	expectKeys([]string{"a", "ab", "abc", "ac"}, collect(keys.Scan([]byte("a")), t), t)
+	expectKeys([]string{"ab", "abc", "ac", "b"}, collect(keys.Range([]byte("ab"), []byte("bb")), t), t)
+	expectKeys([]string{"c", "b", "ac", "abc", "ab", "a"}, collect(keys.NewIterator(IteratorOptions{Reverse: true}), t), t)
+
+	// Seeking positions the iterator at the nearest key in the direction of iteration.
+	it := keys.Scan(nil)
+	it.Seek([]byte("abd"))
+	expectKeys([]string{"ac", "b", "c"}, collect(it, t), t)
+
+	it = keys.NewIterator(IteratorOptions{Reverse: true})
+	it.Seek([]byte("abd"))
+	expectKeys([]string{"abc", "ab", "a"}, collect(it, t), t)
+
+	// The iterator is unaffected by writes and merges that happen after it is created.
+	it = keys.Scan([]byte("a"))
+	set(keys, []byte("aa"), []byte("value-aa"), t)
+	set(keys, []byte("a"), []byte("overwritten"), t)
+	if err := keys.Merge(); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	expectKeys([]string{"a", "ab", "abc", "ac"}, collect(it, t), t)
+}
+
+func TestScanPrefix(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	// The keys share prefixes longer than the prefixes that the tree stores in its nodes.
+	all := []string{
+		"a", "ab", "abc", "b",
+		"user:0000000001:name", "user:0000000001:email", "user:0000000002:name",
+		"user:00000000", "user:0000000012", "users", "session:1", "session:10",
+	}
+
+	for _, key := range all {
+		set(keys, []byte(key), []byte("value-"+key), t)
+	}
+
+	for _, prefix := range []string{
+		"", "a", "ab", "abc", "abcd", "b", "c", "u", "user:", "user:0000000001",
+		"user:0000000001:", "user:0000000001:n", "user:00000000", "user:00000001", "users",
+		"usex", "session:1", "session:2",
+	} {
+		var expected []string
+		for _, key := range all {
+			if strings.HasPrefix(key, prefix) {
+				expected = append(expected, key)
+			}
+		}
+
+		sort.Strings(expected)
+		expectKeys(expected, collect(keys.Scan([]byte(prefix)), t), t)
+	}
+}
@@ -2,170 +2,498 @@ package keychain
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/maybetheresloop/keychain/internal/data"
 	art "github.com/plar/go-adaptive-radix-tree"
 )
 
+// DefaultMaxFileSize is the size in bytes at which the active data file of a store is closed
+// and a new one is started, when no other size is configured.
+const DefaultMaxFileSize = 64 << 20
+
+// DefaultMergeInterval is the interval at which the dead bytes ratio of a store is checked when
+// only Conf.MergeRatio is configured.
+const DefaultMergeInterval = time.Minute
+
+// ErrCorrupted is returned when the record of a value does not match its checksum.
+var ErrCorrupted = data.ErrCorrupted
+
+// ErrClosed is returned when closing a store that has already been closed.
+var ErrClosed = errors.New("keychain: store is closed")
+
 // Conf represents the configuration options for a Keychain store.
 type Conf struct {
+	// Sync makes every write wait until it is synchronized to disk, as with SyncAlways. If it is
+	// false, then SyncPolicy is used instead.
 	Sync bool
+
+	// SyncPolicy determines when writes are synchronized to disk if Sync is false. If it is
+	// unset, then SyncAlways is used.
+	SyncPolicy SyncPolicy
+
+	// MaxFileSize is the size in bytes at which the active data file is rolled over to a new
+	// data file. If it is zero, then DefaultMaxFileSize is used.
+	MaxFileSize int64
+
+	// MergeInterval is the interval at which immutable data files are merged in the background.
+	// If it is zero and MergeRatio is set, then DefaultMergeInterval is used. If both are zero,
+	// then no background merging takes place and Merge must be called explicitly.
+	MergeInterval time.Duration
+
+	// MergeRatio is the fraction of dead bytes, out of all bytes in the data files, that the
+	// store must reach before a background merge is run. If it is zero, then a background merge
+	// is run on every interval.
+	MergeRatio float64
+
+	// RecoveryMode determines how damaged records found while opening the store are handled.
+	RecoveryMode RecoveryMode
 }
 
 // Keychain represents an instance of a Keychain store.
 type Keychain struct {
 	mtx         sync.RWMutex
-	readHandle  *os.File
+	dir         string
+	segments    map[uint64]*segment
+	activeID    uint64
 	writeHandle *os.File
 	writeBuffer *data.Writer
 	entries     art.Tree
 	counter     uint64
 	offset      int64
-	sync        bool
-}
+	maxFileSize int64
+	syncPolicy  SyncPolicy
 
-// Opens a Keychain store using the specified file path and configuration. If the file does not exist,
-// then it is created.
-func OpenConf(name string, conf *Conf) (*Keychain, error) {
+	// synced is the sequence number of the last append that is known to be on disk. It is only
+	// advanced with syncMtx held.
+	synced  uint64
+	syncMtx sync.Mutex
 
-	// Two handles to the file: one is used for reading, the other is used for writing.
-	writeHandle, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
+	// syncs receives the writers waiting for their records to be synchronized to disk.
+	syncs chan syncRequest
+
+	recoveryMode RecoveryMode
+
+	// recovered holds the damaged parts of data files that were discarded when the store was
+	// opened.
+	recovered []Damage
+
+	// txns holds the transactions that are in progress.
+	txns map[*Txn]struct{}
+
+	// followers holds the followers that receive the records appended to the log.
+	followers map[*Follower]struct{}
+
+	// activeHints holds the hints for the records in the active data file, which are written to
+	// its hint file once it becomes immutable.
+	activeHints []hint
+
+	// mergeMtx ensures that only one merge runs at a time.
+	mergeMtx sync.Mutex
+	done     chan struct{}
+	wg       sync.WaitGroup
+	hintWg   sync.WaitGroup
+
+	// closed is set once Close has been called. It is guarded by mtx.
+	closed bool
+}
+
+// Opens a Keychain store using the specified directory and configuration. If the directory does
+// not exist, then it is created.
+func OpenConf(dir string, conf *Conf) (*Keychain, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	readHandle, err := os.Open(name)
+	ids, err := listSegments(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	// Also want to get the size of the file, so that we can keep track of the offsets
-	// of values in the file.
-	stat, err := writeHandle.Stat()
-	if err != nil {
-		return nil, err
+	keys := &Keychain{
+		dir:         dir,
+		segments:    make(map[uint64]*segment, len(ids)+1),
+		entries:     art.New(),
+		maxFileSize: DefaultMaxFileSize,
+		syncPolicy:  SyncAlways,
+		syncs:       make(chan syncRequest),
+		done:        make(chan struct{}),
+		txns:        make(map[*Txn]struct{}),
+		followers:   make(map[*Follower]struct{}),
 	}
-	offset := stat.Size()
 
-	entries := art.New()
+	var mergeInterval time.Duration
+	var mergeRatio float64
+
+	if conf != nil {
+		keys.syncPolicy = conf.SyncPolicy
+		if conf.Sync {
+			keys.syncPolicy = SyncAlways
+		}
+
+		if conf.MaxFileSize > 0 {
+			keys.maxFileSize = conf.MaxFileSize
+		}
 
-	r := data.NewEntryReader(readHandle, 1)
+		keys.recoveryMode = conf.RecoveryMode
 
-	// Populate radix tree with entries from the database file.
-	var entry *data.Entry
-	var key []byte
-	for key, entry, err = r.ReadEntry(); err == nil; key, entry, err = r.ReadEntry() {
-		entries.Insert(key, art.Value(entry))
+		mergeInterval = conf.MergeInterval
+		mergeRatio = conf.MergeRatio
+		if mergeInterval == 0 && mergeRatio > 0 {
+			mergeInterval = DefaultMergeInterval
+		}
 	}
 
-	keys := &Keychain{
-		readHandle:  readHandle,
-		writeHandle: writeHandle,
-		writeBuffer: data.NewWriter(writeHandle),
-		entries:     entries,
-		offset:      offset,
-		sync:        false,
+	// Populate radix tree with entries from the data files, oldest first, so that newer entries
+	// replace older ones.
+	var hints []hint
+	for i, id := range ids {
+		seg, err := openSegment(dir, id)
+		if err != nil {
+			keys.closeSegments()
+			return nil, err
+		}
+
+		keys.segments[id] = seg
+		if hints, err = keys.loadSegment(seg, i == len(ids)-1); err != nil {
+			keys.closeSegments()
+			return nil, err
+		}
 	}
 
-	if conf != nil {
-		keys.sync = conf.Sync
+	// The newest data file, if any, becomes the active file that new items are appended to.
+	if len(ids) > 0 {
+		keys.activeID = ids[len(ids)-1]
+	}
+
+	if err := keys.openActive(); err != nil {
+		keys.closeSegments()
+		return nil, err
+	}
+
+	keys.activeHints = hints
+	keys.dropExpired()
+
+	// Data files in an older format are never appended to.
+	if keys.segments[keys.activeID].version != data.CurrentVersion {
+		if err := keys.rotate(); err != nil {
+			keys.Close()
+			return nil, err
+		}
+	}
+
+	// Everything loaded from the data files is treated as durable.
+	keys.synced = keys.counter
+
+	keys.wg.Add(1)
+	go keys.syncLoop()
+
+	if mergeInterval > 0 {
+		keys.wg.Add(1)
+		go keys.mergeLoop(mergeInterval, mergeRatio)
 	}
 
 	return keys, nil
 }
 
-// Opens a Keychain store using the specified file path. If the file does not exist, then
+// Opens a Keychain store using the specified directory. If the directory does not exist, then
 // it is created.
-func Open(name string) (*Keychain, error) {
-	return OpenConf(name, nil)
+func Open(dir string) (*Keychain, error) {
+	return OpenConf(dir, nil)
 }
 
-// append is used internally by appendItem* and does the actual appending and flushing of
-// the underlying buffer. Additionally, this will call Sync() on the underlying file
-// so that the new item is synchronized to disk.
-func (k *Keychain) append(item *data.Item) error {
-	if err := k.writeBuffer.WriteItem(item); err != nil {
+// loadSegment inserts all of the entries of a data file into the radix tree. The entries are
+// loaded from the hint file of the data file if it has a valid one, and otherwise the data file
+// is scanned in full. In the latter case, a hint file is written for the data file unless it is
+// the active one. The hints for all of the entries are returned.
+func (k *Keychain) loadSegment(seg *segment, active bool) ([]hint, error) {
+	hints, err := readHintFile(k.dir, seg.id)
+	if err != nil {
+		if hints, err = k.scanSegment(seg); err != nil {
+			return nil, err
+		}
+
+		// The hint file only speeds up opening the store, so failing to write it is not fatal.
+		if !active {
+			writeHintFile(k.dir, seg.id, hints)
+		}
+	}
+
+	for i := range hints {
+		entry := hints[i].entry
+		k.applyEntry(hints[i].key, &entry)
+	}
+
+	return hints, nil
+}
+
+// markDead records that the record of an entry no longer holds live data.
+func (k *Keychain) markDead(key []byte, entry *data.Entry) {
+	if seg, ok := k.segments[entry.FileID]; ok {
+		seg.dead += entrySize(seg.version, key, entry)
+	}
+}
+
+// deadRatio returns the fraction of bytes in the data files that belong to dead records.
+func (k *Keychain) deadRatio() float64 {
+	var size, dead int64
+	for _, seg := range k.segments {
+		size += seg.size
+		dead += seg.dead
+	}
+
+	if size == 0 {
+		return 0
+	}
+
+	return float64(dead) / float64(size)
+}
+
+// openActive opens the data file with the active ID for appending, creating it if necessary.
+func (k *Keychain) openActive() error {
+	name := segmentPath(k.dir, k.activeID)
+
+	// The active data file is appended to, so any hint file it has would become stale.
+	if err := os.Remove(hintPath(k.dir, k.activeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Two handles to the file: one is used for reading, the other is used for writing.
+	writeHandle, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
 		return err
 	}
 
+	if _, ok := k.segments[k.activeID]; !ok {
+		seg, err := openSegment(k.dir, k.activeID)
+		if err != nil {
+			writeHandle.Close()
+			return err
+		}
+
+		k.segments[k.activeID] = seg
+	}
+
+	// Also want to get the size of the file, so that we can keep track of the offsets
+	// of values in the file.
+	stat, err := writeHandle.Stat()
+	if err != nil {
+		writeHandle.Close()
+		return err
+	}
+
+	k.writeHandle = writeHandle
+	k.writeBuffer = data.NewWriter(writeHandle)
+	k.offset = stat.Size()
+
+	// New data files start with a file header.
+	if k.offset == 0 {
+		if err := k.writeBuffer.WriteHeader(); err != nil {
+			return err
+		}
+
+		if err := k.writeBuffer.Flush(); err != nil {
+			return err
+		}
+
+		k.offset = data.FileHeaderSize
+		k.segments[k.activeID].size = k.offset
+	}
+
+	return nil
+}
+
+// rotate closes the active data file, which becomes immutable, and starts a new active data file.
+func (k *Keychain) rotate() error {
+	return k.rotateTo(k.activeID + 1)
+}
+
+// rotateTo closes the active data file and starts a new active data file with the specified ID.
+// If the previous active data file is empty, then it is removed instead of becoming immutable.
+func (k *Keychain) rotateTo(id uint64) error {
 	if err := k.writeBuffer.Flush(); err != nil {
 		return err
 	}
 
-	// Sync the new items to the underlying storage.
+	if err := k.closeActive(); err != nil {
+		return err
+	}
+
+	if k.activeEmpty() {
+		seg := k.segments[k.activeID]
+		delete(k.segments, k.activeID)
+
+		if err := seg.file.Close(); err != nil {
+			return err
+		}
+
+		if err := os.Remove(segmentPath(k.dir, k.activeID)); err != nil {
+			return err
+		}
+	} else {
+		// The hint file for the now immutable data file is written in the background.
+		hints := k.activeHints
+		prevID := k.activeID
+
+		k.hintWg.Add(1)
+		go func() {
+			defer k.hintWg.Done()
+			writeHintFile(k.dir, prevID, hints)
+		}()
+	}
+
+	k.activeID = id
+	k.activeHints = nil
+	return k.openActive()
+}
+
+// closeActive synchronizes the active data file to disk and closes its write handle. It must be
+// called with the write lock held.
+func (k *Keychain) closeActive() error {
+	k.syncMtx.Lock()
+	defer k.syncMtx.Unlock()
+
 	if err := k.writeHandle.Sync(); err != nil {
 		return err
 	}
 
-	k.offset += int64(2*8 + len(item.Key))
-	if len(item.Value) > 0 {
-		k.offset += int64(len(item.Value))
+	if err := k.writeHandle.Close(); err != nil {
+		return err
 	}
 
+	atomic.StoreUint64(&k.synced, k.counter)
 	return nil
 }
 
-// appendItem appends a key-value pair to the end of the store file's log.
-func (k *Keychain) appendItem(key []byte, value []byte) error {
-	return k.append(data.NewItem(key, value))
+// closeSegments closes the read handles of all data files.
+func (k *Keychain) closeSegments() error {
+	var firstErr error
+	for _, seg := range k.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// append is used internally by appendItem* and does the actual appending and flushing of
+// the underlying buffer. The items are not synchronized to disk; callers wait for that with
+// waitSync, using the sequence number of the returned entries, once the lock is released. The
+// items are always written to the same data file, so if they would not fit in the active data
+// file, then a new active data file is started first. The entries describing where the items
+// were written are returned.
+func (k *Keychain) append(items ...*data.Item) ([]*data.Entry, error) {
+	var size int64
+	for _, item := range items {
+		size += data.RecordSize(data.CurrentVersion, len(item.Key), len(item.Value))
+	}
+
+	if !k.activeEmpty() && k.offset+size > k.maxFileSize {
+		if err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp := time.Now().UnixNano()
+	for _, item := range items {
+		item.Timestamp = timestamp
+		if err := k.writeBuffer.WriteItem(item); err != nil {
+			return nil, err
+		}
+	}
+
+	// The items are flushed to the file right away so that they can be read back.
+	if err := k.writeBuffer.Flush(); err != nil {
+		return nil, err
+	}
+
+	// All of the items appended together share a sequence number.
+	k.counter++
+	k.publish(k.counter, items)
+
+	entries := make([]*data.Entry, len(items))
+	for i, item := range items {
+		entries[i] = data.NewEntry(k.activeID, item.ValueSize, k.offset+data.ValueOffset(data.CurrentVersion, len(item.Key)))
+		entries[i].Timestamp = item.Timestamp
+		entries[i].Expiry = item.Expiry
+		entries[i].Seq = k.counter
+
+		itemSize := data.RecordSize(data.CurrentVersion, len(item.Key), len(item.Value))
+		k.offset += itemSize
+		k.segments[k.activeID].size += itemSize
+
+		// The hint outlives the call, so the key is copied in case the caller reuses its buffer.
+		if !item.IsBatchMarker() {
+			k.activeHints = append(k.activeHints, hint{key: append([]byte(nil), item.Key...), entry: *entries[i]})
+		}
+	}
+
+	return entries, nil
+}
+
+// appendItem appends a key-value pair to the end of the store's log.
+func (k *Keychain) appendItem(key []byte, value []byte) (*data.Entry, error) {
+	entries, err := k.append(data.NewItem(key, value))
+	if err != nil {
+		return nil, err
+	}
+
+	return entries[0], nil
 }
 
 // appendItemDelete appends a special delete marker for the specified key.
-func (k *Keychain) appendItemDelete(key []byte) error {
-	return k.append(data.NewItemDeleteMarker(key))
+func (k *Keychain) appendItemDelete(key []byte) (*data.Entry, error) {
+	entries, err := k.append(data.NewItemDeleteMarker(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return entries[0], nil
 }
 
 // Set inserts a key-value pair into the store. If the key already exists in the store, then
-// the previous value is overwritten.
+// the previous value is overwritten. A nil value is stored as an empty value.
 func (k *Keychain) Set(key []byte, value []byte) error {
-	k.mtx.Lock()
+	// A nil value would be encoded as a delete.
+	if value == nil {
+		value = []byte{}
+	}
 
-	v, found := k.entries.Search(key)
-	valuePos := k.offset + valueOffset(len(key))
-	valueSize := int64(len(value))
+	k.mtx.Lock()
 
 	// We insert the new value unconditionally, even if the key was already present
 	// in the database with the same value. Otherwise, we would have to do a disk seek
 	// to check the current value, and in this case we have decided to optimize for performance
 	// and not for space.
-	if err := k.appendItem(key, value); err != nil {
+	newEntry, err := k.appendItem(key, value)
+	if err != nil {
 		k.mtx.Unlock()
 		return err
 	}
 
-	// If the trie already contains the entry, simply update the existing entry. Otherwise,
-	// insert the new entry into the trie.
-	if found {
-		entry := v.(*data.Entry)
-		entry.ValuePos = valuePos
-		entry.ValueSize = valueSize
-
-		k.mtx.Unlock()
-		return nil
-	}
-
-	entry := data.NewEntry(0, valueSize, valuePos)
-	k.entries.Insert(key, art.Value(entry))
+	// If the trie already contains the entry, the existing entry is updated. Otherwise,
+	// the new entry is inserted into the trie.
+	seq := newEntry.Seq
+	k.applyEntry(key, newEntry)
 
 	k.mtx.Unlock()
-	return nil
+	return k.waitSync(seq)
 }
 
-// Reads a value of the given size at the offset.
-func (k *Keychain) readValue(offset int64, size int64) ([]byte, error) {
-	value := make([]byte, size)
-	n, err := k.readHandle.ReadAt(value, offset)
-	if err != nil {
-		return nil, err
-	}
-
-	if int64(n) != size {
-		return nil, errors.New("could not read full value")
+// Reads the value of an entry from the data file it is located in. The checksum of the record is
+// verified, and ErrCorrupted is returned if it does not match.
+func (k *Keychain) readValue(key []byte, entry *data.Entry) ([]byte, error) {
+	seg, ok := k.segments[entry.FileID]
+	if !ok {
+		return nil, fmt.Errorf("data file %d does not exist", entry.FileID)
 	}
 
-	return value, nil
+	return data.ReadValueAt(seg.file, seg.version, key, entry.ValuePos, entry.ValueSize)
 }
 
 // Get retrieves from the store the value corresponding to the specified key. If the key does not
@@ -181,11 +509,20 @@ func (k *Keychain) Get(key []byte) ([]byte, error) {
 	defer k.mtx.RUnlock()
 
 	entry := v.(*data.Entry)
-	if entry.ValueSize == -1 {
+	if entry.ValueSize == -1 || entry.Expired(time.Now().UnixNano()) {
 		return nil, nil
 	}
 
-	return k.readValue(entry.ValuePos, entry.ValueSize)
+	return k.readValue(key, entry)
+}
+
+// Has reports whether the store contains the specified key, without reading its value.
+func (k *Keychain) Has(key []byte) bool {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	_, ok := k.liveEntry(key, time.Now().UnixNano())
+	return ok
 }
 
 // Removes a key-value pair from the store. Returns true only if an item was removed.
@@ -195,15 +532,19 @@ func (k *Keychain) Remove(key []byte) (bool, error) {
 	v, found := k.entries.Search(key)
 	if found {
 		entry := v.(*data.Entry)
-		if entry.ValueSize != -1 {
-			defer k.mtx.Unlock()
-
-			if err := k.appendItemDelete(key); err != nil {
+		if entry.ValueSize != -1 && !entry.Expired(time.Now().UnixNano()) {
+			newEntry, err := k.appendItemDelete(key)
+			if err != nil {
+				k.mtx.Unlock()
 				return false, err
 			}
 
-			entry.ValueSize = -1
-			return true, nil
+			// The entry now refers to the delete marker, which is dead from the start.
+			seq := newEntry.Seq
+			k.applyEntry(key, newEntry)
+
+			k.mtx.Unlock()
+			return true, k.waitSync(seq)
 		}
 	}
 
@@ -216,23 +557,44 @@ func (k *Keychain) Flush() error {
 	return k.writeBuffer.Flush()
 }
 
-// Closes the store.
+// Closes the store. Closing a store that is already closed returns ErrClosed.
 func (k *Keychain) Close() error {
-	if err := k.Flush(); err != nil {
-		return err
+	k.mtx.Lock()
+	if k.closed {
+		k.mtx.Unlock()
+		return ErrClosed
 	}
 
-	if err := k.readHandle.Close(); err != nil {
+	k.closed = true
+	k.closeFollowers()
+	k.mtx.Unlock()
+
+	close(k.done)
+	k.wg.Wait()
+	k.hintWg.Wait()
+
+	if err := k.Flush(); err != nil {
 		return err
 	}
 
-	if err := k.writeHandle.Close(); err != nil {
+	if err := k.closeSegments(); err != nil {
 		return err
 	}
 
-	return nil
+	return k.closeActive()
+}
+
+// activeEmpty reports whether no items have been appended to the active data file.
+func (k *Keychain) activeEmpty() bool {
+	return k.offset <= data.FileHeaderSize
 }
 
-func valueOffset(keyLen int) int64 {
-	return int64(2*8 + keyLen)
+// entrySize returns the number of bytes the record of an entry occupies in a data file of the
+// specified format.
+func entrySize(version int, key []byte, entry *data.Entry) int64 {
+	if entry.ValueSize < 0 {
+		return data.RecordSize(version, len(key), 0)
+	}
+
+	return data.RecordSize(version, len(key), int(entry.ValueSize))
 }
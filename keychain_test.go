@@ -2,9 +2,14 @@ package keychain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/data"
 )
 
 func set(keys *Keychain, key []byte, value []byte, t *testing.T) {
@@ -32,18 +37,12 @@ func remove(keys *Keychain, key []byte, t *testing.T) {
 }
 
 func TestAllOperations(t *testing.T) {
-	f, err := ioutil.TempFile("/tmp", "keychain-test")
+	name, err := ioutil.TempDir("", "keychain-test")
 	if err != nil {
-		t.Fatalf("could not create temp file: %v", err)
+		t.Fatalf("could not create temp dir: %v", err)
 	}
 
-	name := f.Name()
-
-	if f.Close() != nil {
-		t.Fatalf("could not close temp file: %v", err)
-	}
-
-	defer os.Remove(name)
+	defer os.RemoveAll(name)
 
 	keys, err := Open(name)
 	if err != nil {
@@ -103,3 +102,274 @@ func TestAllOperations(t *testing.T) {
 		t.Fatalf("failed to close database: %v", err)
 	}
 }
+
+func TestRollover(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{MaxFileSize: 64})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		set(keys, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), t)
+	}
+	remove(keys, []byte("key3"), t)
+	set(keys, []byte("key5"), []byte("value55"), t)
+
+	ids, err := listSegments(name)
+	if err != nil {
+		t.Fatalf("could not list data files: %v", err)
+	}
+
+	if len(ids) < 2 {
+		t.Fatalf("expected multiple data files, got=%d", len(ids))
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := OpenConf(name, &Conf{MaxFileSize: 64})
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		expected := []byte(fmt.Sprintf("value%d", i))
+		switch i {
+		case 3:
+			expected = nil
+		case 5:
+			expected = []byte("value55")
+		}
+
+		getAndExpect(keys2, []byte(fmt.Sprintf("key%d", i)), expected, t)
+	}
+
+	if err := keys2.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
+
+func TestReusedKeyBuffer(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{MaxFileSize: 200})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	// The key buffer is overwritten after every Set, as a server reusing its read buffers does.
+	buf := make([]byte, 5)
+	for i := 0; i < 20; i++ {
+		copy(buf, fmt.Sprintf("key%02d", i))
+		set(keys, buf, []byte(fmt.Sprintf("value%d", i)), t)
+		copy(buf, "xxxxx")
+	}
+
+	ids, err := listSegments(name)
+	if err != nil || len(ids) < 2 {
+		t.Fatalf("expected multiple data files: ids=%v, err=%v", ids, err)
+	}
+
+	// The hint files of the immutable data files are used when the store is reopened.
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := OpenConf(name, &Conf{MaxFileSize: 200})
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		getAndExpect(keys2, []byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)), t)
+	}
+
+	if err := keys2.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
+
+func TestNilValue(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	// A nil value is stored as an empty value, rather than removing the key.
+	set(keys, []byte("key"), nil, t)
+	if err := keys.SetWithTTL([]byte("ttl"), nil, time.Hour); err != nil {
+		t.Fatalf("failed setting value: %v", err)
+	}
+
+	for _, key := range []string{"key", "ttl"} {
+		value, err := keys.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("failed getting value: %v", err)
+		}
+
+		if value == nil || len(value) != 0 {
+			t.Fatalf("expected empty value for '%s', got =%v", key, value)
+		}
+
+		if !keys.Has([]byte(key)) {
+			t.Fatalf("expected key '%s' to exist", key)
+		}
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	if err := keys.Close(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got=%v", err)
+	}
+}
+
+func TestCorruptedValue(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	set(keys, []byte("key"), []byte("value"), t)
+	set(keys, []byte("key2"), []byte("value2"), t)
+
+	// Flip a bit in the value of the first record.
+	f, err := os.OpenFile(segmentPath(name, 0), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("could not open data file: %v", err)
+	}
+
+	b := make([]byte, 1)
+	pos := int64(data.FileHeaderSize) + data.ValueOffset(data.CurrentVersion, 3)
+	if _, err := f.ReadAt(b, pos); err != nil {
+		t.Fatalf("could not read data file: %v", err)
+	}
+
+	b[0] ^= 0x01
+	if _, err := f.WriteAt(b, pos); err != nil {
+		t.Fatalf("could not write data file: %v", err)
+	}
+	f.Close()
+
+	if _, err := keys.Get([]byte("key")); err != ErrCorrupted {
+		t.Fatalf("expected ErrCorrupted, got=%v", err)
+	}
+
+	getAndExpect(keys, []byte("key2"), []byte("value2"), t)
+}
+
+func TestLegacyDataFile(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	// A version 0 record consists of the key size, value size, key and value.
+	var buf bytes.Buffer
+	for _, kv := range [][2]string{{"key", "value"}, {"key2", "value2"}} {
+		binary.Write(&buf, binary.BigEndian, int64(len(kv[0])))
+		binary.Write(&buf, binary.BigEndian, int64(len(kv[1])))
+		buf.WriteString(kv[0])
+		buf.WriteString(kv[1])
+	}
+
+	if err := ioutil.WriteFile(segmentPath(name, 0), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write data file: %v", err)
+	}
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	getAndExpect(keys, []byte("key"), []byte("value"), t)
+	getAndExpect(keys, []byte("key2"), []byte("value2"), t)
+
+	// New items are written to a new data file in the current format.
+	set(keys, []byte("key2"), []byte("value21"), t)
+	getAndExpect(keys, []byte("key2"), []byte("value21"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	getAndExpect(keys2, []byte("key"), []byte("value"), t)
+	getAndExpect(keys2, []byte("key2"), []byte("value21"), t)
+
+	if err := keys2.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
+
+func TestFutureDataFile(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	var buf bytes.Buffer
+	buf.WriteString("KCHN")
+	binary.Write(&buf, binary.BigEndian, uint32(data.CurrentVersion+1))
+
+	if err := ioutil.WriteFile(segmentPath(name, 0), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("could not write data file: %v", err)
+	}
+
+	if keys, err := Open(name); err == nil {
+		keys.Close()
+		t.Fatalf("expected opening a data file in a newer format to fail")
+	}
+}
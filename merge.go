@@ -0,0 +1,356 @@
+package keychain
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+// move records that the live record of a key was copied to a new location during a merge.
+type move struct {
+	key       []byte
+	oldFileID uint64
+	oldPos    int64
+	newFileID uint64
+	newPos    int64
+	size      int64
+}
+
+// mergeWriter writes the live records of merged data files into a range of new data files.
+type mergeWriter struct {
+	dir         string
+	maxFileSize int64
+	nextID      uint64
+	lastID      uint64
+
+	id     uint64
+	file   *os.File
+	wr     *data.Writer
+	offset int64
+	hints  []hint
+	ids    []uint64
+}
+
+// open starts a new output data file.
+func (w *mergeWriter) open() error {
+	f, err := os.OpenFile(segmentPath(w.dir, w.nextID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.id = w.nextID
+	w.nextID++
+	w.file = f
+	w.wr = data.NewWriter(f)
+	w.offset = data.FileHeaderSize
+	w.hints = nil
+	w.ids = append(w.ids, w.id)
+
+	return w.wr.WriteHeader()
+}
+
+// close flushes and syncs the current output data file, if any, closes it, and writes its
+// hint file.
+func (w *mergeWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	f := w.file
+	w.file = nil
+
+	if err := w.wr.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return writeHintFile(w.dir, w.id, w.hints)
+}
+
+// write appends a key-value pair to the output, returning the entry describing where it was
+// written. The timestamp and expiry of the original record are preserved. Once the last reserved
+// ID is reached, the output data file is allowed to grow past the maximum file size.
+func (w *mergeWriter) write(key []byte, value []byte, orig *data.Entry) (*data.Entry, error) {
+	size := data.RecordSize(data.CurrentVersion, len(key), len(value))
+	full := w.offset > data.FileHeaderSize && w.offset+size > w.maxFileSize
+	if w.file == nil || (full && w.nextID <= w.lastID) {
+		if err := w.close(); err != nil {
+			return nil, err
+		}
+
+		if err := w.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	item := data.NewItem(key, value)
+	item.Timestamp = orig.Timestamp
+	item.Expiry = orig.Expiry
+	if err := w.wr.WriteItem(item); err != nil {
+		return nil, err
+	}
+
+	entry := data.NewEntry(w.id, int64(len(value)), w.offset+data.ValueOffset(data.CurrentVersion, len(key)))
+	entry.Timestamp = item.Timestamp
+	entry.Expiry = item.Expiry
+
+	w.offset += size
+	w.hints = append(w.hints, hint{key: key, entry: *entry})
+
+	return entry, nil
+}
+
+// Merge compacts all of the immutable data files of the store. The live records of those data
+// files are rewritten into new data files, after which the old data files are deleted. Records
+// that have been overwritten or removed are discarded. Readers and writers are only blocked while
+// the entries of the store are updated to point to the new data files, and not while the data
+// files are being rewritten.
+func (k *Keychain) Merge() error {
+	k.mergeMtx.Lock()
+	defer k.mergeMtx.Unlock()
+
+	k.mtx.Lock()
+
+	// The active data file is included in the merge if it has any data in it.
+	inputs := make([]*segment, 0, len(k.segments))
+	for id, seg := range k.segments {
+		if id != k.activeID || !k.activeEmpty() {
+			inputs = append(inputs, seg)
+		}
+	}
+
+	if len(inputs) == 0 {
+		k.mtx.Unlock()
+		return nil
+	}
+
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].id < inputs[j].id })
+
+	// The new data files take IDs that are greater than the IDs of the data files being merged,
+	// but less than the ID of the new active data file, so that the order of the data files is
+	// preserved when the store is reopened. At most one output data file is needed per input data
+	// file, so that many IDs are reserved.
+	firstID := inputs[len(inputs)-1].id + 1
+	lastID := firstID + uint64(len(inputs)) - 1
+	if err := k.rotateTo(lastID + 1); err != nil {
+		k.mtx.Unlock()
+		return err
+	}
+
+	k.mtx.Unlock()
+
+	// Hint files still being written for the data files being merged would outlive them.
+	k.hintWg.Wait()
+
+	w := &mergeWriter{
+		dir:         k.dir,
+		maxFileSize: k.maxFileSize,
+		nextID:      firstID,
+		lastID:      lastID,
+	}
+
+	var moves []move
+	for _, seg := range inputs {
+		m, err := k.mergeSegment(seg, w)
+		if err != nil {
+			w.close()
+			k.removeFiles(w.ids)
+			return err
+		}
+
+		moves = append(moves, m...)
+	}
+
+	if err := w.close(); err != nil {
+		k.removeFiles(w.ids)
+		return err
+	}
+
+	outputs := make([]*segment, 0, len(w.ids))
+	for _, id := range w.ids {
+		seg, err := openSegment(k.dir, id)
+		if err != nil {
+			for _, seg := range outputs {
+				seg.file.Close()
+			}
+
+			k.removeFiles(w.ids)
+			return err
+		}
+
+		outputs = append(outputs, seg)
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	for _, seg := range outputs {
+		k.segments[seg.id] = seg
+	}
+
+	// Entries that were modified while the merge was running already point to a newer location,
+	// and are left as they are. Their copies in the new data files are dead.
+	for _, m := range moves {
+		v, found := k.entries.Search(m.key)
+		if found {
+			entry := v.(*data.Entry)
+			if entry.FileID == m.oldFileID && entry.ValuePos == m.oldPos {
+				entry.FileID = m.newFileID
+				entry.ValuePos = m.newPos
+				continue
+			}
+		}
+
+		k.segments[m.newFileID].dead += m.size
+	}
+
+	merged := make(map[uint64]bool, len(inputs))
+	for _, seg := range inputs {
+		merged[seg.id] = true
+	}
+
+	// The delete markers and expired records in the merged data files have been discarded, so
+	// the entries that refer to them can be removed as well. Transactions in progress still need
+	// them to detect conflicts, though.
+	now := time.Now().UnixNano()
+	var removed [][]byte
+	if len(k.txns) == 0 {
+		k.entries.ForEach(func(node art.Node) bool {
+			entry := node.Value().(*data.Entry)
+			if (entry.ValueSize == -1 || entry.Expired(now)) && merged[entry.FileID] {
+				removed = append(removed, node.Key())
+			}
+
+			return true
+		})
+	}
+
+	for _, key := range removed {
+		k.entries.Delete(key)
+	}
+
+	var firstErr error
+	for _, seg := range inputs {
+		for t := range k.txns {
+			t.pin(seg)
+		}
+
+		if err := k.retireSegment(seg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// mergeSegment copies the live records of an immutable data file to the merge output.
+func (k *Keychain) mergeSegment(seg *segment, w *mergeWriter) ([]move, error) {
+	f, err := os.Open(segmentPath(k.dir, seg.id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := data.NewEntryReader(f, seg.id)
+
+	var moves []move
+	for {
+		key, entry, err := r.ReadEntry()
+		if err == io.EOF {
+			return moves, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !k.isLive(key, entry) {
+			continue
+		}
+
+		value, err := data.ReadValueAt(seg.file, seg.version, key, entry.ValuePos, entry.ValueSize)
+		if err != nil {
+			return nil, err
+		}
+
+		newEntry, err := w.write(key, value, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		moves = append(moves, move{
+			key:       key,
+			oldFileID: entry.FileID,
+			oldPos:    entry.ValuePos,
+			newFileID: newEntry.FileID,
+			newPos:    newEntry.ValuePos,
+			size:      data.RecordSize(data.CurrentVersion, len(key), len(value)),
+		})
+	}
+}
+
+// isLive reports whether the entry read from a data file is the one the store currently refers to.
+func (k *Keychain) isLive(key []byte, entry *data.Entry) bool {
+	if entry.ValueSize == -1 || entry.Expired(time.Now().UnixNano()) {
+		return false
+	}
+
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	v, found := k.entries.Search(key)
+	if !found {
+		return false
+	}
+
+	cur := v.(*data.Entry)
+	return cur.FileID == entry.FileID && cur.ValuePos == entry.ValuePos && cur.ValueSize != -1
+}
+
+// removeFiles removes the data files with the specified IDs, ignoring any errors.
+func (k *Keychain) removeFiles(ids []uint64) {
+	for _, id := range ids {
+		removeSegmentFiles(k.dir, id)
+	}
+}
+
+// mergeLoop periodically merges the immutable data files of the store until it is closed. If a
+// ratio is specified, then the data files are only merged once the ratio of dead bytes reaches it.
+func (k *Keychain) mergeLoop(interval time.Duration, ratio float64) {
+	defer k.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+		}
+
+		k.mtx.RLock()
+		deadRatio := k.deadRatio()
+		k.mtx.RUnlock()
+
+		if ratio > 0 && deadRatio < ratio {
+			continue
+		}
+
+		// A failed merge leaves the store as it was, and is retried on the next interval.
+		k.Merge()
+	}
+}
@@ -0,0 +1,86 @@
+package keychain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	conf := &Conf{MaxFileSize: 128}
+	keys, err := OpenConf(name, conf)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	// Overwrite the same keys several times, so that most of the records are dead.
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			set(keys, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d-%d", i, round)), t)
+		}
+	}
+	remove(keys, []byte("key7"), t)
+
+	before, err := listSegments(name)
+	if err != nil {
+		t.Fatalf("could not list data files: %v", err)
+	}
+
+	if err := keys.Merge(); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	after, err := listSegments(name)
+	if err != nil {
+		t.Fatalf("could not list data files: %v", err)
+	}
+
+	if len(after) >= len(before) {
+		t.Fatalf("expected fewer data files after merge, before=%d, after=%d", len(before), len(after))
+	}
+
+	if ratio := keys.deadRatio(); ratio != 0 {
+		t.Fatalf("expected no dead bytes after merge, got ratio=%f", ratio)
+	}
+
+	expect := func(keys *Keychain) {
+		for i := 0; i < 10; i++ {
+			expected := []byte(fmt.Sprintf("value%d-4", i))
+			if i == 7 {
+				expected = nil
+			}
+
+			getAndExpect(keys, []byte(fmt.Sprintf("key%d", i)), expected, t)
+		}
+	}
+
+	expect(keys)
+
+	// Writes after the merge must take precedence over the merged data files on reopen.
+	set(keys, []byte("key1"), []byte("value1-5"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := OpenConf(name, conf)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	getAndExpect(keys2, []byte("key1"), []byte("value1-5"), t)
+	set(keys2, []byte("key1"), []byte("value1-4"), t)
+	expect(keys2)
+
+	if err := keys2.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
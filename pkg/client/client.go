@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+)
+
+const (
+	// DefaultDialTimeout is the timeout for connecting to the server, when no other timeout is
+	// configured.
+	DefaultDialTimeout = 5 * time.Second
+
+	// DefaultReadTimeout is the timeout for reading a reply, when no other timeout is configured.
+	DefaultReadTimeout = 3 * time.Second
+
+	// DefaultWriteTimeout is the timeout for writing a command, when no other timeout is
+	// configured.
+	DefaultWriteTimeout = 3 * time.Second
+
+	// DefaultPoolSize is the maximum number of connections to the server, when no other size is
+	// configured.
+	DefaultPoolSize = 10
+
+	// DefaultRetryBackoff is the time to wait before retrying a command, when no other time is
+	// configured.
+	DefaultRetryBackoff = 8 * time.Millisecond
+)
+
+const (
+	// NoExpiry is returned by TTL for keys that exist but do not expire.
+	NoExpiry time.Duration = -1
+
+	// KeyNotFound is returned by TTL for keys that do not exist.
+	KeyNotFound time.Duration = -2
+)
+
+// ErrClosed is returned when using a client that has been closed.
+var ErrClosed = errors.New("client: client is closed")
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Options represents the configuration options for a client.
+type Options struct {
+	// Network is the network of the server address, either "tcp" or "unix". If it is empty, then
+	// "tcp" is used.
+	Network string
+
+	// Addr is the address of the server.
+	Addr string
+
+	// DialTimeout is the timeout for connecting to the server. If it is zero, then
+	// DefaultDialTimeout is used.
+	DialTimeout time.Duration
+
+	// ReadTimeout and WriteTimeout are the timeouts for reading a reply and writing a command.
+	// If they are zero, then DefaultReadTimeout and DefaultWriteTimeout are used, and if they are
+	// negative, then there is no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// PoolSize is the maximum number of connections to the server. If it is zero, then
+	// DefaultPoolSize is used.
+	PoolSize int
+
+	// MaxRetries is the number of times a command is retried on a new connection after a
+	// network error. Commands are not retried by default.
+	MaxRetries int
+
+	// RetryBackoff is the time to wait before retrying a command. If it is zero, then
+	// DefaultRetryBackoff is used.
+	RetryBackoff time.Duration
+
+	// TLSConfig is the TLS configuration for connecting to the server. If it is nil, then TLS is
+	// not used. If it has no ServerName, then the host of Addr is used.
+	TLSConfig *tls.Config
+
+	// Username and Password are sent with AUTH on every new connection, if Password is not
+	// empty. If Username is empty, then the password is that of the default user.
+	Username string
+	Password string
+}
+
+// Client is a client for a Keychain server. It keeps a pool of connections to the server, and is
+// safe for concurrent use.
+type Client struct {
+	opts Options
+	pool *pool
+}
+
+// New returns a client for the server with the specified options. Connections are opened as
+// they are needed.
+func New(opts *Options) *Client {
+	c := &Client{opts: *opts}
+
+	if c.opts.Network == "" {
+		c.opts.Network = "tcp"
+	}
+
+	if c.opts.DialTimeout == 0 {
+		c.opts.DialTimeout = DefaultDialTimeout
+	}
+
+	if c.opts.ReadTimeout == 0 {
+		c.opts.ReadTimeout = DefaultReadTimeout
+	}
+
+	if c.opts.WriteTimeout == 0 {
+		c.opts.WriteTimeout = DefaultWriteTimeout
+	}
+
+	if c.opts.PoolSize <= 0 {
+		c.opts.PoolSize = DefaultPoolSize
+	}
+
+	if c.opts.RetryBackoff == 0 {
+		c.opts.RetryBackoff = DefaultRetryBackoff
+	}
+
+	if cfg := c.opts.TLSConfig; cfg != nil && cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		c.opts.TLSConfig = cfg.Clone()
+		if host, _, err := net.SplitHostPort(c.opts.Addr); err == nil {
+			c.opts.TLSConfig.ServerName = host
+		} else {
+			c.opts.TLSConfig.ServerName = c.opts.Addr
+		}
+	}
+
+	c.pool = newPool(&c.opts)
+	return c
+}
+
+// Close closes the connections to the server.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Do sends a command to the server and returns the reply. Arguments may be strings, byte slices
+// or integers. Error replies are returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...interface{}) (resp.Value, error) {
+	cmd := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string, []byte:
+			cmd[i] = v
+		case int:
+			cmd[i] = strconv.Itoa(v)
+		case int64:
+			cmd[i] = strconv.FormatInt(v, 10)
+		default:
+			cmd[i] = fmt.Sprint(v)
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.opts.RetryBackoff):
+			case <-ctx.Done():
+				return resp.Value{}, ctx.Err()
+			}
+		}
+
+		var reply resp.Value
+		if reply, err = c.do(ctx, cmd); err == nil || !retryable(err) || ctx.Err() != nil {
+			return reply, err
+		}
+	}
+
+	return resp.Value{}, err
+}
+
+// do sends a command on a connection from the pool and reads the reply.
+func (c *Client) do(ctx context.Context, cmd []interface{}) (resp.Value, error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return resp.Value{}, err
+	}
+
+	reply, err := c.pool.roundTrip(ctx, cn, cmd)
+
+	// Error replies leave the connection usable.
+	_, isReply := err.(Error)
+	c.pool.put(cn, err != nil && !isReply)
+
+	return reply, err
+}
+
+// contextErr returns the error of the context if it is done, since that is the cause of any
+// error on the connection. The deadline of the connection is the deadline of the context, and
+// can expire before the context notices, so a timeout past the deadline of the context is
+// reported as context.DeadlineExceeded as well.
+func contextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+	}
+
+	return err
+}
+
+// retryable reports whether a command that failed with the error can be retried on a new
+// connection.
+func retryable(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if ne, ok := err.(net.Error); ok {
+		return !ne.Timeout()
+	}
+
+	return false
+}
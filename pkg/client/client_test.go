@@ -0,0 +1,374 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maybetheresloop/keychain"
+	"github.com/maybetheresloop/keychain/internal/server"
+	"github.com/maybetheresloop/keychain/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// startServer starts a server for a new store on a random local port, returning its address and
+// a function that shuts everything down.
+func startServer(t *testing.T) (string, func()) {
+	return startServerConf(t, nil, nil)
+}
+
+// startServerConf is like startServer, but the server uses the specified configuration, and TLS
+// if config is not nil.
+func startServerConf(t *testing.T, config *tls.Config, conf *server.Conf) (string, func()) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	keys, err := keychain.Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	if config != nil {
+		lis = tls.NewListener(lis, config)
+	}
+
+	srv := server.NewConf(keys, conf)
+	go srv.Serve(lis)
+
+	return lis.Addr().String(), func() {
+		srv.Close()
+		keys.Close()
+		os.RemoveAll(name)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	c := New(&Options{Addr: addr})
+	defer c.Close()
+
+	ctx := context.Background()
+
+	assert.Nil(t, c.Ping(ctx))
+
+	echo, err := c.Echo(ctx, []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), echo)
+
+	assert.Nil(t, c.Set(ctx, []byte("foo"), []byte("bar")))
+
+	value, err := c.Get(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	value, err = c.Get(ctx, []byte("missing"))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	n, err := c.Exists(ctx, []byte("foo"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	ttl, err := c.TTL(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiry, ttl)
+
+	ok, err := c.Expire(ctx, []byte("foo"), time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ttl, err = c.TTL(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, ttl)
+
+	ok, err = c.Persist(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, c.SetWithTTL(ctx, []byte("baz"), []byte("qux"), 10*time.Second))
+
+	ttl, err = c.TTL(ctx, []byte("baz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Second, ttl)
+
+	n, err = c.Del(ctx, []byte("foo"), []byte("baz"), []byte("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	ttl, err = c.TTL(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, KeyNotFound, ttl)
+
+	// Error replies are returned as errors, and leave the connection usable.
+	_, err = c.Do(ctx, "BOGUS")
+	assert.Equal(t, Error("ERR unknown command 'BOGUS'"), err)
+
+	reply, err := c.Do(ctx, "ECHO", 42)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.BulkStringValue([]byte("42")), reply)
+}
+
+func TestPool(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	c := New(&Options{Addr: addr, PoolSize: 2})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, c.Ping(context.Background()))
+		}()
+	}
+
+	wg.Wait()
+
+	// No more connections than the size of the pool are opened.
+	assert.Equal(t, 0, len(c.pool.tokens))
+	assert.Equal(t, 2, len(c.pool.idle))
+}
+
+func TestRetry(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	c := New(&Options{Addr: addr, MaxRetries: 1})
+	defer c.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, c.Ping(ctx))
+
+	// Break the idle connection, as if the server had closed it.
+	cn := <-c.pool.idle
+	cn.netConn.Close()
+	c.pool.idle <- cn
+
+	assert.Nil(t, c.Ping(ctx))
+}
+
+func TestAuth(t *testing.T) {
+	acl, err := server.ParseACL(strings.NewReader("user default on allcommands allkeys\nuser app on >app-secret allcommands allkeys\n"))
+	if err != nil {
+		t.Fatalf("could not parse acl: %v", err)
+	}
+
+	addr, stop := startServerConf(t, nil, &server.Conf{ACL: acl, RequirePass: "secret"})
+	defer stop()
+
+	ctx := context.Background()
+
+	c := New(&Options{Addr: addr})
+	_, err = c.Get(ctx, []byte("foo"))
+	assert.NotNil(t, err)
+	c.Close()
+
+	c = New(&Options{Addr: addr, Password: "secret"})
+	assert.Nil(t, c.Set(ctx, []byte("foo"), []byte("bar")))
+	c.Close()
+
+	c = New(&Options{Addr: addr, Username: "app", Password: "app-secret"})
+	value, err := c.Get(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	c.Close()
+
+	// A wrong password is reported by every command, and does not leave connections behind.
+	c = New(&Options{Addr: addr, Password: "wrong", PoolSize: 1})
+	defer c.Close()
+
+	_, isReply := c.Ping(ctx).(Error)
+	assert.True(t, isReply)
+	assert.Equal(t, 1, len(c.pool.tokens))
+}
+
+func TestContext(t *testing.T) {
+	// The server accepts connections but never replies.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer lis.Close()
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := New(&Options{Addr: lis.Addr().String(), ReadTimeout: -1})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = c.Ping(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected the deadline to be exceeded, got %v", err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	assert.Equal(t, context.Canceled, c.Ping(ctx))
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close client: %v", err)
+	}
+
+	assert.Equal(t, ErrClosed, c.Ping(context.Background()))
+}
+
+// writeCert generates a key and a certificate signed by the parent, or a self-signed CA
+// certificate if the parent is nil, and writes them to <name>.pem and <name>-key.pem in dir.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	serverConfig, err := server.TLSConfig(path("server.pem"), path("server-key.pem"), path("ca.pem"), "yes")
+	if err != nil {
+		t.Fatalf("could not load server TLS config: %v", err)
+	}
+
+	addr, stop := startServerConf(t, serverConfig, nil)
+	defer stop()
+
+	ctx := context.Background()
+
+	config, err := TLSConfig(path("ca.pem"), path("client.pem"), path("client-key.pem"))
+	if err != nil {
+		t.Fatalf("could not load client TLS config: %v", err)
+	}
+
+	c := New(&Options{Addr: addr, TLSConfig: config})
+	defer c.Close()
+
+	assert.Nil(t, c.Set(ctx, []byte("foo"), []byte("bar")))
+
+	value, err := c.Get(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// The server requires a client certificate.
+	config, err = TLSConfig(path("ca.pem"), "", "")
+	if err != nil {
+		t.Fatalf("could not load client TLS config: %v", err)
+	}
+
+	noCert := New(&Options{Addr: addr, TLSConfig: config})
+	defer noCert.Close()
+
+	assert.NotNil(t, noCert.Ping(ctx))
+
+	// The client does not trust a server certificate from another CA.
+	config, err = TLSConfig("", path("client.pem"), path("client-key.pem"))
+	if err != nil {
+		t.Fatalf("could not load client TLS config: %v", err)
+	}
+
+	untrusted := New(&Options{Addr: addr, TLSConfig: config})
+	defer untrusted.Close()
+
+	assert.NotNil(t, untrusted.Ping(ctx))
+
+	// Plaintext clients cannot talk to the TLS listener.
+	plain := New(&Options{Addr: addr, ReadTimeout: time.Second})
+	defer plain.Close()
+
+	assert.NotNil(t, plain.Ping(ctx))
+
+	_, err = server.TLSConfig(path("server.pem"), path("server-key.pem"), "", "yes")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+func (c *Client) status(ctx context.Context, args ...interface{}) (string, error) {
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return reply.AsString()
+}
+
+func (c *Client) integer(ctx context.Context, args ...interface{}) (int64, error) {
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.AsInt()
+}
+
+func (c *Client) bulk(ctx context.Context, args ...interface{}) ([]byte, error) {
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.AsBytes()
+}
+
+func keyArgs(name string, keys [][]byte) []interface{} {
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, name)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	return args
+}
+
+// Ping checks that the server is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.status(ctx, "PING")
+	return err
+}
+
+// Echo returns the message sent back by the server.
+func (c *Client) Echo(ctx context.Context, message []byte) ([]byte, error) {
+	return c.bulk(ctx, "ECHO", message)
+}
+
+// Get retrieves the value of a key. If the key does not exist, then nil is returned.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return c.bulk(ctx, "GET", key)
+}
+
+// Set inserts a key-value pair, overwriting the previous value of the key.
+func (c *Client) Set(ctx context.Context, key []byte, value []byte) error {
+	_, err := c.status(ctx, "SET", key, value)
+	return err
+}
+
+// SetWithTTL inserts a key-value pair that expires after the specified duration, which is
+// rounded down to whole milliseconds.
+func (c *Client) SetWithTTL(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	_, err := c.status(ctx, "SET", key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+// Del removes keys, returning the number of keys that were removed.
+func (c *Client) Del(ctx context.Context, keys ...[]byte) (int64, error) {
+	return c.integer(ctx, keyArgs("DEL", keys)...)
+}
+
+// Exists returns the number of the specified keys that exist.
+func (c *Client) Exists(ctx context.Context, keys ...[]byte) (int64, error) {
+	return c.integer(ctx, keyArgs("EXISTS", keys)...)
+}
+
+// Expire sets the time after which a key expires, which is rounded down to whole seconds.
+// Returns true only if the key exists.
+func (c *Client) Expire(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	n, err := c.integer(ctx, "EXPIRE", key, int64(ttl/time.Second))
+	return n == 1, err
+}
+
+// TTL returns the remaining time before a key expires, in whole seconds. If the key exists but
+// does not expire, then NoExpiry is returned, and if the key does not exist, then KeyNotFound
+// is returned.
+func (c *Client) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	n, err := c.integer(ctx, "TTL", key)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n {
+	case -1:
+		return NoExpiry, nil
+	case -2:
+		return KeyNotFound, nil
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// Persist removes the expiry of a key. Returns true only if the key exists and had an expiry.
+func (c *Client) Persist(ctx context.Context, key []byte) (bool, error) {
+	n, err := c.integer(ctx, "PERSIST", key)
+	return n == 1, err
+}
@@ -0,0 +1,2 @@
+// Package client contains a client for a remote Keychain server.
+package client
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maybetheresloop/keychain/pkg/resp"
+)
+
+// conn is a connection to the server.
+type conn struct {
+	netConn net.Conn
+	r       *resp.Reader
+	w       *resp.Writer
+}
+
+// pool keeps idle connections to the server for reuse, and bounds the number of open connections.
+type pool struct {
+	opts *Options
+
+	// idle holds the idle connections, and tokens holds one token for every connection that may
+	// still be opened.
+	idle   chan *conn
+	tokens chan struct{}
+
+	mtx    sync.Mutex
+	closed bool
+}
+
+func newPool(opts *Options) *pool {
+	p := &pool{
+		opts:   opts,
+		idle:   make(chan *conn, opts.PoolSize),
+		tokens: make(chan struct{}, opts.PoolSize),
+	}
+
+	for i := 0; i < opts.PoolSize; i++ {
+		p.tokens <- struct{}{}
+	}
+
+	return p
+}
+
+// get returns an idle connection, or opens a new one if there are none. If the maximum number of
+// connections are open, then it waits for one of them to be returned to the pool.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	case <-p.tokens:
+		cn, err := p.dial(ctx)
+		if err != nil {
+			p.tokens <- struct{}{}
+			return nil, err
+		}
+
+		return cn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns a connection to the pool. A connection that failed is closed instead, since the
+// state of the protocol on it is unknown.
+func (p *pool) put(cn *conn, failed bool) {
+	if !failed && !p.isClosed() {
+		select {
+		case p.idle <- cn:
+			return
+		default:
+		}
+	}
+
+	cn.netConn.Close()
+	p.tokens <- struct{}{}
+}
+
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: p.opts.DialTimeout}
+	netConn, err := d.DialContext(ctx, p.opts.Network, p.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.opts.TLSConfig != nil {
+		tlsConn := tls.Client(netConn, p.opts.TLSConfig)
+
+		// The handshake is bounded by the dial timeout as well.
+		tlsConn.SetDeadline(deadline(ctx, p.opts.DialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, contextErr(ctx, err)
+		}
+
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	cn := &conn{
+		netConn: netConn,
+		r:       resp.NewReader(netConn),
+		w:       resp.NewWriter(netConn),
+	}
+
+	if p.opts.Password != "" {
+		args := []interface{}{"AUTH", p.opts.Password}
+		if p.opts.Username != "" {
+			args = []interface{}{"AUTH", p.opts.Username, p.opts.Password}
+		}
+
+		if _, err := p.roundTrip(ctx, cn, args); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// roundTrip sends a command on a connection and reads the reply.
+func (p *pool) roundTrip(ctx context.Context, cn *conn, cmd []interface{}) (resp.Value, error) {
+	// Cancelling the context interrupts the command by expiring the deadline of the connection.
+	// The deadline is set again before the connection is next used.
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		exited := make(chan struct{})
+		defer func() {
+			close(done)
+			<-exited
+		}()
+
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				cn.netConn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+	}
+
+	if err := cn.netConn.SetWriteDeadline(deadline(ctx, p.opts.WriteTimeout)); err != nil {
+		return resp.Value{}, err
+	}
+
+	if err := cn.w.WriteCommand(cmd...); err != nil {
+		return resp.Value{}, contextErr(ctx, err)
+	}
+
+	if err := cn.w.Flush(); err != nil {
+		return resp.Value{}, contextErr(ctx, err)
+	}
+
+	if err := cn.netConn.SetReadDeadline(deadline(ctx, p.opts.ReadTimeout)); err != nil {
+		return resp.Value{}, err
+	}
+
+	reply, err := cn.r.ReadValue()
+	if err != nil {
+		return resp.Value{}, contextErr(ctx, err)
+	}
+
+	if reply.Type() == resp.Error {
+		message, _ := reply.AsString()
+		return resp.Value{}, Error(message)
+	}
+
+	return reply, nil
+}
+
+func (p *pool) isClosed() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.closed
+}
+
+// close closes the idle connections. Connections in use are closed when they are returned.
+func (p *pool) close() error {
+	p.mtx.Lock()
+	p.closed = true
+	p.mtx.Unlock()
+
+	var firstErr error
+	for {
+		select {
+		case cn := <-p.idle:
+			if err := cn.netConn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		default:
+			return firstErr
+		}
+	}
+}
+
+// deadline returns the earlier of the time after the timeout and the deadline of the context. A
+// zero time means no deadline.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+
+	return t
+}
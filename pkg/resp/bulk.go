@@ -0,0 +1,173 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// BulkReader reads the contents of a bulk string as they are received, without holding the whole
+// bulk string in memory. It must be read to the end or closed before the next message is read,
+// otherwise the next read of the Reader discards the rest of the contents.
+type BulkReader struct {
+	r         *Reader
+	length    int64
+	remaining int64
+
+	// err is the error returned once the contents have been read, which is io.EOF if the bulk
+	// string was read successfully.
+	err error
+}
+
+// ReadArrayHeader reads the header of the next message, which must be an array, and returns its
+// length. The elements can then be read one at a time, for instance with ReadBulkReader. For a
+// null array, -1 is returned.
+func (r *Reader) ReadArrayHeader() (int64, error) {
+	r.reset()
+	r.size = 0
+
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(line) == 0 || line[0] != Array {
+		return 0, fmt.Errorf("resp: unexpected type, expected array, got %q", line)
+	}
+
+	length, err := parseInt(line[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if length < -1 {
+		return 0, &InvalidArrayLength{length: length}
+	}
+
+	if length > 0 {
+		r.pending = length
+	}
+
+	return length, nil
+}
+
+// ReadBulkReader reads the header of the next message or array element, which must be a bulk
+// string, and returns a BulkReader for its contents. For a null bulk string, nil is returned.
+func (r *Reader) ReadBulkReader() (*BulkReader, error) {
+	// A bulk string that is not an array element is a message of its own.
+	if r.pending > 0 {
+		r.pending--
+	} else {
+		r.reset()
+		r.size = 0
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != BulkString {
+		return nil, errors.New("resp: unexpected type, expected bulk string")
+	}
+
+	length, err := parseInt(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if length == -1 {
+		return nil, nil
+	} else if length < -1 || (r.limits.MaxBulkLength > 0 && length > r.limits.MaxBulkLength) {
+		return nil, &InvalidBulkStringLength{length: length}
+	}
+
+	if err := r.grow(length); err != nil {
+		return nil, err
+	}
+
+	r.bulk = &BulkReader{r: r, length: length, remaining: length}
+	return r.bulk, nil
+}
+
+// Len returns the length of the bulk string.
+func (b *BulkReader) Len() int64 {
+	return b.length
+}
+
+// Read reads up to len(p) bytes of the bulk string. It returns io.EOF once the whole bulk string
+// has been read.
+func (b *BulkReader) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, b.finish()
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.r.rd.Read(p)
+	b.remaining -= int64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		b.fail(err)
+	} else if b.remaining == 0 {
+		err = b.finish()
+	}
+
+	return n, err
+}
+
+// Close discards the rest of the bulk string.
+func (b *BulkReader) Close() error {
+	if b.remaining > 0 && b.err == nil {
+		n, err := io.CopyN(ioutil.Discard, b.r.rd, b.remaining)
+		b.remaining -= n
+
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			b.fail(err)
+			return err
+		}
+	}
+
+	if err := b.finish(); err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// finish reads the line terminator after the contents of the bulk string.
+func (b *BulkReader) finish() error {
+	if b.err != nil {
+		return b.err
+	}
+
+	// The bulk string is done, so reading the terminator must not close it again.
+	b.r.bulk = nil
+	b.err = io.EOF
+
+	line, err := b.r.readLine()
+	if err != nil {
+		b.err = err
+	} else if len(line) != 0 {
+		b.err = errors.New("incorrect number of bytes in bulk string")
+	}
+
+	return b.err
+}
+
+// fail records an error that occurred while reading the contents of the bulk string.
+func (b *BulkReader) fail(err error) {
+	b.err = err
+	b.r.bulk = nil
+}
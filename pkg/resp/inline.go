@@ -0,0 +1,144 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrUnbalancedQuotes is returned when an inline command has a quoted argument that is not
+// terminated, or that is not followed by a space.
+var ErrUnbalancedQuotes = errors.New("resp: unbalanced quotes in inline command")
+
+// SplitArgs splits an inline command into its arguments. Arguments are separated by whitespace,
+// and may be quoted with double quotes, in which case backslash escapes such as \n, \t, \" and
+// \xHH are interpreted, or with single quotes, in which case only \' is interpreted. A closing
+// quote must be followed by whitespace or the end of the line.
+func SplitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+
+		if i == len(line) {
+			return args, nil
+		}
+
+		var (
+			arg  = []byte{}
+			inq  bool // Inside double quotes.
+			insq bool // Inside single quotes.
+			done bool
+		)
+
+		for !done {
+			if inq {
+				if i == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescape(line[i]))
+				case line[i] == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if insq {
+				if i == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, arg)
+	}
+}
+
+// isInline reports whether a line that starts with the specified byte is an inline command rather
+// than a typed message.
+func isInline(b byte) bool {
+	switch b {
+	case SimpleString, Error, Integer, BulkString, Array,
+		Null, Boolean, Double, BigNumber, VerbatimString, MapType, SetType, PushType, AttributeType:
+		return false
+	}
+
+	return true
+}
+
+func isSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+
+	return false
+}
+
+func isHex(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
+
+// unescape returns the byte represented by a backslash escape inside double quotes.
+func unescape(b byte) byte {
+	switch b {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+
+	return b
+}
@@ -0,0 +1,66 @@
+package resp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		err      error
+	}{
+		{"", nil, nil},
+		{"   ", nil, nil},
+		{"PING", []string{"PING"}, nil},
+		{"GET foo", []string{"GET", "foo"}, nil},
+		{"SET  foo\tbar ", []string{"SET", "foo", "bar"}, nil},
+		{`SET foo "hello world"`, []string{"SET", "foo", "hello world"}, nil},
+		{`SET foo "a\"b\n\x41\x4"`, []string{"SET", "foo", "a\"b\nAx4"}, nil},
+		{`SET foo 'it\'s \n'`, []string{"SET", "foo", `it's \n`}, nil},
+		{`SET foo 'a\nb'`, []string{"SET", "foo", `a\nb`}, nil},
+		{`SET foo ""`, []string{"SET", "foo", ""}, nil},
+		{`SET foo"bar baz"`, []string{"SET", "foobar baz"}, nil},
+		{`SET foo "bar`, nil, ErrUnbalancedQuotes},
+		{`SET foo 'bar`, nil, ErrUnbalancedQuotes},
+		{`SET foo "bar"baz`, nil, ErrUnbalancedQuotes},
+		{`SET foo 'bar'baz`, nil, ErrUnbalancedQuotes},
+	}
+
+	for i, tt := range tests {
+		args, err := SplitArgs([]byte(tt.input))
+		assert.Equal(t, tt.err, err, "tests[%d]", i)
+
+		var s []string
+		for _, arg := range args {
+			s = append(s, string(arg))
+		}
+
+		assert.Equal(t, tt.expected, s, "tests[%d]", i)
+	}
+}
+
+func TestReadInline(t *testing.T) {
+	r := NewReader(strings.NewReader("SET foo \"bar baz\"\r\n\r\n  \nGET foo\n*1\r\n$4\r\nPING\r\n"))
+
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, ArrayValue(BulkStringValue([]byte("SET")), BulkStringValue([]byte("foo")), BulkStringValue([]byte("bar baz"))), v)
+
+	// Blank lines are skipped.
+	msg, err := r.ReadMessage(BulkStringSliceParser)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("foo")}, msg)
+
+	// An inline command reads the same as a command sent as an array of bulk strings.
+	v, err = r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, ArrayValue(BulkStringValue([]byte("PING"))), v)
+
+	r = NewReader(strings.NewReader("GET \"foo\r\n"))
+	_, err = r.ReadValue()
+	assert.Equal(t, ErrUnbalancedQuotes, err)
+}
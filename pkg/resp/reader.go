@@ -2,14 +2,61 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 )
 
+// ErrMessageTooLarge is returned when a message is larger than the maximum message size of a
+// Reader.
+var ErrMessageTooLarge = errors.New("resp: message too large")
+
+// maxPrealloc is the maximum number of elements that are allocated up front for an array, so that
+// a large array length does not allocate memory before its elements are actually received.
+const maxPrealloc = 1024
+
+// maxReuse is the length of the largest bulk string that is read into the reused buffer of a
+// Reader. Larger bulk strings are allocated on their own, so that the buffer does not keep them
+// alive.
+const maxReuse = 64 * 1024
+
+// maxArena is the largest size that the reused buffer of a Reader grows to.
+const maxArena = 1024 * 1024
+
+// Limits bounds the size of the messages accepted by a Reader. A zero field means no limit.
+type Limits struct {
+	// MaxBulkLength is the maximum length of a bulk string.
+	MaxBulkLength int64
+
+	// MaxMessageSize is the maximum number of bytes in a single message, including any nested
+	// messages.
+	MaxMessageSize int64
+}
+
 type Reader struct {
-	rd *bufio.Reader
+	rd     *bufio.Reader
+	limits Limits
+
+	// size is the number of bytes read so far for the current message.
+	size int64
+
+	// line holds a line that is longer than the buffer of rd while it is read in pieces.
+	line []byte
+
+	// reuse is set if the bulk strings and arrays of a message are read into buf and vals, which
+	// are reused for the next message.
+	reuse bool
+	buf   []byte
+	vals  []Value
+
+	// bulk is the bulk string being streamed, if any. It is discarded before the next read.
+	bulk *BulkReader
+
+	// pending is the number of elements left in an array whose header was read with
+	// ReadArrayHeader.
+	pending int64
 }
 
 type ArrayParser func(r *Reader, num int64) (interface{}, error)
@@ -17,15 +64,15 @@ type ArrayParser func(r *Reader, num int64) (interface{}, error)
 // Convenience function for parsing a slice of strings.
 func StringSliceParser(r *Reader, num int64) (interface{}, error) {
 
-	s := make([]string, 0, num)
+	s := make([]string, 0, prealloc(num))
 
 	for i := int64(0); i < num; i++ {
-		line, _, err := r.rd.ReadLine()
+		line, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
 
-		if line[0] == SimpleString {
+		if len(line) > 0 && line[0] == SimpleString {
 			s = append(s, string(line[1:]))
 		} else {
 			return nil, errors.New("resp: unexpected type, expected string")
@@ -36,15 +83,19 @@ func StringSliceParser(r *Reader, num int64) (interface{}, error) {
 }
 
 func BulkStringSliceParser(r *Reader, num int64) (interface{}, error) {
-	s := make([][]byte, 0, num)
+	s := make([][]byte, 0, prealloc(num))
 
 	for i := int64(0); i < num; i++ {
-		line, _, err := r.rd.ReadLine()
+		line, err := r.readLine()
 		if err != nil {
 			return nil, err
 		}
 
-		length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if len(line) == 0 || line[0] != BulkString {
+			return nil, errors.New("resp: unexpected type, expected bulk string")
+		}
+
+		length, err := parseInt(line[1:])
 		if err != nil {
 			return nil, err
 		}
@@ -60,28 +111,81 @@ func BulkStringSliceParser(r *Reader, num int64) (interface{}, error) {
 	return s, nil
 }
 
+// ReadMessage reads the next message. Arrays are parsed with the specified parser. An inline
+// command is returned as a [][]byte of its arguments, as BulkStringSliceParser would return it.
 func (r *Reader) ReadMessage(parser ArrayParser) (interface{}, error) {
-	line, _, err := r.rd.ReadLine()
+	line, args, err := r.readFirstLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if args != nil {
+		return args, nil
+	}
+
+	return r.parseMessage(line, parser)
+}
+
+func (r *Reader) readMessage(parser ArrayParser) (interface{}, error) {
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
 
+	return r.parseMessage(line, parser)
+}
+
+// readFirstLine reads the first line of a top-level message. If the line is an inline command
+// rather than a typed message, then its arguments are returned as well. Blank inline commands are
+// skipped.
+func (r *Reader) readFirstLine() ([]byte, [][]byte, error) {
+	r.reset()
+
+	for {
+		r.size = 0
+
+		line, err := r.readLine()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(line) > 0 && !isInline(line[0]) {
+			return line, nil, nil
+		}
+
+		args, err := SplitArgs(line)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(args) > 0 {
+			return line, args, nil
+		}
+	}
+}
+
+// parseMessage parses a message given its first line, reading the remainder of the message.
+func (r *Reader) parseMessage(line []byte, parser ArrayParser) (interface{}, error) {
+	if len(line) == 0 {
+		return nil, errors.New("resp: unexpected empty line")
+	}
+
 	switch line[0] {
 	case SimpleString:
 		return string(line[1:]), nil
 	case Error:
 		return NewRespError(string(line[1:])), nil
 	case Integer:
-		return strconv.ParseInt(string(line[1:]), 10, 64)
+		return parseInt(line[1:])
 	case BulkString:
-		length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		length, err := parseInt(line[1:])
 		if err != nil {
 			return nil, err
 		}
 
 		return r.readBulkString(length)
 	case Array:
-		length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		length, err := parseInt(line[1:])
 		if err != nil {
 			return nil, err
 		}
@@ -93,20 +197,91 @@ func (r *Reader) ReadMessage(parser ArrayParser) (interface{}, error) {
 		}
 
 		return parser(r, length)
+	case Null, Boolean, Double, BigNumber, VerbatimString, MapType, SetType, PushType, AttributeType:
+		return r.readRESP3(line, parser)
 	}
 
 	return nil, fmt.Errorf("resp: failed to parse %q", line)
 }
 
+// readLine reads a line, without the line terminator, and counts it towards the size of the
+// current message. The line is only valid until the next read.
+func (r *Reader) readLine() ([]byte, error) {
+	if r.bulk != nil {
+		if err := r.bulk.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	line, isPrefix, err := r.rd.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.grow(int64(len(line))); err != nil {
+		return nil, err
+	}
+
+	// A line that is longer than the buffer is returned in pieces.
+	if isPrefix {
+		if cap(r.line) > maxReuse {
+			r.line = nil
+		}
+
+		r.line = append(r.line[:0], line...)
+		for isPrefix {
+			if line, isPrefix, err = r.rd.ReadLine(); err != nil {
+				return nil, err
+			}
+
+			if err := r.grow(int64(len(line))); err != nil {
+				return nil, err
+			}
+
+			r.line = append(r.line, line...)
+		}
+
+		line = r.line
+	}
+
+	if err := r.grow(2); err != nil {
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// grow counts n bytes towards the size of the current message, failing if the message would
+// become too large.
+func (r *Reader) grow(n int64) error {
+	r.size += n
+	if r.limits.MaxMessageSize > 0 && r.size > r.limits.MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	return nil
+}
+
 func (r *Reader) readBulkString(length int64) ([]byte, error) {
-	b := make([]byte, length)
+	if length == -1 {
+		return nil, nil
+	} else if length < -1 || (r.limits.MaxBulkLength > 0 && length > r.limits.MaxBulkLength) {
+		return nil, &InvalidBulkStringLength{length: length}
+	}
+
+	// The size is checked before the bulk string is allocated.
+	if err := r.grow(length); err != nil {
+		return nil, err
+	}
+
+	b := r.alloc(length)
 
 	_, err := io.ReadFull(r.rd, b)
 	if err != nil {
 		return nil, err
 	}
 
-	line, _, err := r.rd.ReadLine()
+	line, err := r.readLine()
 	if err != nil {
 		return nil, err
 	}
@@ -119,34 +294,212 @@ func (r *Reader) readBulkString(length int64) ([]byte, error) {
 	return b, nil
 }
 
-//func (r *Reader) readArray(length int64) ([]interface{}, error) {
-//	s := make([]interface{}, length)
-//	for i := int64(0); i < length; i++ {
-//		item, err := r.ReadMessage()
-//		if err != nil {
-//			return nil, err
-//		}
-//
-//		s[i] = item
-//	}
-//
-//	return s, nil
-//}
-
 func GenericSliceParser(r *Reader, length int64) (interface{}, error) {
-	s := make([]interface{}, length)
+	s := make([]interface{}, 0, prealloc(length))
 	for i := int64(0); i < length; i++ {
-		item, err := r.ReadMessage(GenericSliceParser)
+		item, err := r.readMessage(GenericSliceParser)
 		if err != nil {
 			return nil, err
 		}
 
-		s[i] = item
+		s = append(s, item)
 	}
 
 	return s, nil
 }
 
+// Buffered returns the number of bytes that have been received but not read yet.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// HasMessage reports whether a complete message has been received but not read yet, so that
+// reading it does not block. If the buffered data is malformed, then true is returned, since
+// reading it fails without blocking.
+func (r *Reader) HasMessage() bool {
+	b, _ := r.rd.Peek(r.rd.Buffered())
+
+	i := 0
+	for i < len(b) && isInline(b[i]) {
+		n := bytes.IndexByte(b[i:], '\n')
+		if n < 0 {
+			return false
+		}
+
+		// Blank inline commands are skipped by the reader.
+		if len(bytes.TrimSpace(b[i:i+n])) > 0 {
+			return true
+		}
+
+		i += n + 1
+	}
+
+	_, ok := messageEnd(b, i)
+	return ok
+}
+
+// messageEnd returns the offset just past the end of the message that starts at the specified
+// offset, and whether the message is complete. Malformed messages are treated as complete.
+func messageEnd(b []byte, i int) (int, bool) {
+	n := bytes.Index(b[i:], []byte("\r\n"))
+	if n < 0 {
+		return 0, false
+	}
+
+	lineEnd := i + n + 2
+	if n == 0 {
+		return lineEnd, true
+	}
+
+	switch b[i] {
+	case BulkString, VerbatimString:
+		length, err := parseInt(b[i+1 : i+n])
+		if err != nil || length < 0 {
+			return lineEnd, true
+		}
+
+		end := int64(lineEnd) + length + 2
+		if end > int64(len(b)) {
+			return 0, false
+		}
+
+		return int(end), true
+	case Array, MapType, SetType, PushType, AttributeType:
+		length, err := parseInt(b[i+1 : i+n])
+		if err != nil || length < 0 {
+			return lineEnd, true
+		}
+
+		// Maps and attributes have a key and a value for every entry, and attributes are
+		// followed by the reply they belong to.
+		if b[i] == MapType || b[i] == AttributeType {
+			length *= 2
+		}
+
+		if b[i] == AttributeType {
+			length++
+		}
+
+		end := lineEnd
+		for j := int64(0); j < length; j++ {
+			var ok bool
+			if end, ok = messageEnd(b, end); !ok {
+				return 0, false
+			}
+		}
+
+		return end, true
+	default:
+		return lineEnd, true
+	}
+}
+
+// SetReuseBuffers sets whether the bulk strings and arrays of a message are read into buffers that
+// are reused for the next message, which avoids allocating memory for most messages. If set, then
+// the values returned by a read are only valid until the next read.
+func (r *Reader) SetReuseBuffers(reuse bool) {
+	r.reuse = reuse
+	r.buf, r.vals = nil, nil
+}
+
+// reset prepares the reused buffers for a new message.
+func (r *Reader) reset() {
+	r.pending = 0
+	r.buf = r.buf[:0]
+	r.vals = r.vals[:0]
+}
+
+// alloc returns a byte slice of the specified length for a bulk string.
+func (r *Reader) alloc(n int64) []byte {
+	if !r.reuse || n > maxReuse {
+		return make([]byte, n)
+	}
+
+	if r.buf == nil || int64(cap(r.buf)-len(r.buf)) < n {
+		// The values read so far keep the previous buffer alive.
+		r.buf = make([]byte, 0, arenaSize(cap(r.buf), int(n)))
+	}
+
+	start := len(r.buf)
+	r.buf = r.buf[:start+int(n)]
+	return r.buf[start:len(r.buf):len(r.buf)]
+}
+
+// allocValues returns an empty slice of values with the specified capacity for an array.
+func (r *Reader) allocValues(n int64) []Value {
+	if !r.reuse || n > maxPrealloc {
+		return make([]Value, 0, prealloc(n))
+	}
+
+	if int64(cap(r.vals)-len(r.vals)) < n {
+		r.vals = make([]Value, 0, arenaSize(cap(r.vals), maxPrealloc))
+	}
+
+	start := len(r.vals)
+	r.vals = r.vals[:start+int(n)]
+	return r.vals[start:start:len(r.vals)]
+}
+
+// arenaSize returns the size to grow a reused buffer of the specified capacity to, so that it has
+// room for at least n more elements.
+func arenaSize(capacity, n int) int {
+	size := 2 * capacity
+	if size < 4096 {
+		size = 4096
+	} else if size > maxArena {
+		size = maxArena
+	}
+
+	if size < n {
+		size = n
+	}
+
+	return size
+}
+
+// parseInt parses a decimal integer without converting it to a string first. Anything but a plain
+// decimal integer is handed to strconv, so that the errors are the same.
+func parseInt(b []byte) (int64, error) {
+	digits := b
+	neg := len(digits) > 0 && digits[0] == '-'
+	if neg {
+		digits = digits[1:]
+	}
+
+	if len(digits) == 0 || len(digits) > 18 {
+		return strconv.ParseInt(string(b), 10, 64)
+	}
+
+	var n int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return strconv.ParseInt(string(b), 10, 64)
+		}
+
+		n = n*10 + int64(c-'0')
+	}
+
+	if neg {
+		n = -n
+	}
+
+	return n, nil
+}
+
+// prealloc returns the number of elements to allocate up front for an array of the specified length.
+func prealloc(length int64) int64 {
+	if length > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return length
+}
+
 func NewReader(rd io.Reader) *Reader {
 	return &Reader{rd: bufio.NewReader(rd)}
 }
+
+// NewReaderLimits returns a reader that fails to read messages that exceed the limits.
+func NewReaderLimits(rd io.Reader, limits Limits) *Reader {
+	return &Reader{rd: bufio.NewReader(rd), limits: limits}
+}
@@ -2,6 +2,9 @@ package resp
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -118,6 +121,18 @@ func TestReadBulkString(t *testing.T) {
 	}
 }
 
+func TestReadNullBulkString(t *testing.T) {
+	r := NewReader(strings.NewReader("$-1\r\n"))
+
+	result, err := r.ReadMessage(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(nil), result)
+
+	r = NewReader(strings.NewReader("$-2\r\n"))
+	_, err = r.ReadMessage(nil)
+	assert.IsType(t, &InvalidBulkStringLength{}, err)
+}
+
 func compareRespTypes(expected interface{}, result interface{}, i int, t *testing.T) {
 	switch ev := expected.(type) {
 	case string:
@@ -175,3 +190,262 @@ func TestReadArray(t *testing.T) {
 		}
 	}
 }
+
+func TestReaderLimits(t *testing.T) {
+	limits := Limits{MaxBulkLength: 4, MaxMessageSize: 32}
+
+	r := NewReaderLimits(strings.NewReader("$4\r\nabcd\r\n$5\r\nabcde\r\n"), limits)
+	result, err := r.ReadMessage(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcd"), result)
+
+	_, err = r.ReadMessage(nil)
+	assert.IsType(t, &InvalidBulkStringLength{}, err)
+
+	// Every element counts towards the size of the message.
+	r = NewReaderLimits(strings.NewReader("*3\r\n$4\r\nabcd\r\n$4\r\nabcd\r\n$4\r\nabcd\r\n"), limits)
+	_, err = r.ReadMessage(BulkStringSliceParser)
+	assert.Equal(t, ErrMessageTooLarge, err)
+
+	// A large array length does not allocate memory up front.
+	r = NewReaderLimits(strings.NewReader("*1000000000000\r\n"), limits)
+	_, err = r.ReadMessage(BulkStringSliceParser)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHasMessage(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"", false},
+		{"+OK", false},
+		{"+OK\r\n", true},
+		{"$5\r\nhel", false},
+		{"$5\r\nhello\r\n", true},
+		{"*2\r\n$3\r\nGET\r\n", false},
+		{"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", true},
+		{"*2\r\n*1\r\n:1\r\n", false},
+		{"*-1\r\n", true},
+		{"\r\n", false},
+		{"PING", false},
+		{"PING\r\n", true},
+		{"PING\n", true},
+		{"\r\n  \r\n+OK\r\n", true},
+	}
+
+	for i, tt := range tests {
+		r := NewReader(strings.NewReader(tt.input))
+
+		// Fill the buffer without consuming anything.
+		r.rd.Peek(len(tt.input))
+
+		assert.Equal(t, tt.expected, r.HasMessage(), "tests[%d]", i)
+	}
+}
+
+func TestReadLongLine(t *testing.T) {
+	long := strings.Repeat("a", 10000)
+
+	r := NewReader(strings.NewReader("+" + long + "\r\nSET foo " + long + "\r\n:1\r\n"))
+
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, SimpleStringValue(long), v)
+
+	msg, err := r.ReadMessage(BulkStringSliceParser)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("foo"), []byte(long)}, msg)
+
+	v, err = r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, IntegerValue(1), v)
+
+	// A long line counts towards the size of the message as it is read.
+	r = NewReaderLimits(strings.NewReader("+"+long+"\r\n"), Limits{MaxMessageSize: 5000})
+	_, err = r.ReadValue()
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
+
+func TestBulkReader(t *testing.T) {
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$-1\r\n$11\r\nhello world\r\n$5\r\nabcde\r\n+OK\r\n"))
+
+	n, err := r.ReadArrayHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+
+	b, err := r.ReadBulkReader()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), b.Len())
+
+	contents, err := ioutil.ReadAll(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "SET", string(contents))
+
+	b, err = r.ReadBulkReader()
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+
+	// The contents are read in pieces.
+	b, err = r.ReadBulkReader()
+	assert.Nil(t, err)
+
+	p := make([]byte, 5)
+	_, err = io.ReadFull(b, p)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(p))
+
+	contents, err = ioutil.ReadAll(b)
+	assert.Nil(t, err)
+	assert.Equal(t, " world", string(contents))
+
+	// The rest of a bulk string that is not read is discarded by the next read.
+	b, err = r.ReadBulkReader()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), b.Len())
+
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, SimpleStringValue("OK"), v)
+
+	_, err = b.Read(p)
+	assert.Equal(t, io.EOF, err)
+
+	r = NewReaderLimits(strings.NewReader("$5\r\nabcde\r\n$3\r\nabcde\r\n"), Limits{MaxBulkLength: 4})
+	_, err = r.ReadBulkReader()
+	assert.IsType(t, &InvalidBulkStringLength{}, err)
+
+	r = NewReader(strings.NewReader("$3\r\nabcde\r\n"))
+	b, err = r.ReadBulkReader()
+	assert.Nil(t, err)
+	assert.NotNil(t, b.Close())
+}
+
+func TestReuseBuffers(t *testing.T) {
+	input := strings.Repeat("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", 2) + "*2\r\n$3\r\nGET\r\n$0\r\n\r\n"
+
+	r := NewReader(strings.NewReader(input))
+	r.SetReuseBuffers(true)
+
+	for i := 0; i < 2; i++ {
+		v, err := r.ReadValue()
+		assert.Nil(t, err)
+		assert.Equal(t, ArrayValue(BulkStringValue([]byte("SET")), BulkStringValue([]byte("foo")), BulkStringValue([]byte("bar"))), v)
+	}
+
+	// An empty bulk string is not mistaken for a null one.
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, ArrayValue(BulkStringValue([]byte("GET")), BulkStringValue([]byte{})), v)
+
+	// Reading a command does not allocate once the buffers have grown.
+	rd := &repeatReader{b: []byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n")}
+	r = NewReader(rd)
+	r.SetReuseBuffers(true)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := r.ReadValue(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestParseInt(t *testing.T) {
+	for _, s := range []string{"0", "-1", "123456789012345678", "-9223372036854775808", "9223372036854775807", "", "-", "+1", "1a", "99999999999999999999"} {
+		expected, expectedErr := strconv.ParseInt(s, 10, 64)
+		n, err := parseInt([]byte(s))
+		assert.Equal(t, expected, n, s)
+		assert.Equal(t, expectedErr, err, s)
+	}
+}
+
+// repeatReader reads the same bytes over and over.
+type repeatReader struct {
+	b []byte
+	i int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.i:])
+		n += c
+		r.i = (r.i + c) % len(r.b)
+	}
+
+	return n, nil
+}
+
+func benchmarkReadValue(b *testing.B, command string, reuse bool) {
+	r := NewReader(&repeatReader{b: []byte(command)})
+	r.SetReuseBuffers(reuse)
+
+	b.SetBytes(int64(len(command)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadValue(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadValue(b *testing.B) {
+	benchmarkReadValue(b, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", false)
+}
+
+func BenchmarkReadValueReuse(b *testing.B) {
+	benchmarkReadValue(b, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", true)
+}
+
+func BenchmarkReadInline(b *testing.B) {
+	benchmarkReadValue(b, "SET foo bar\r\n", true)
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	command := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	r := NewReader(&repeatReader{b: []byte(command)})
+
+	b.SetBytes(int64(len(command)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadMessage(BulkStringSliceParser); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func largeBulkString() string {
+	return "$1048576\r\n" + strings.Repeat("a", 1<<20) + "\r\n"
+}
+
+func BenchmarkReadLargeBulkString(b *testing.B) {
+	benchmarkReadValue(b, largeBulkString(), true)
+}
+
+func BenchmarkBulkReader(b *testing.B) {
+	message := largeBulkString()
+	r := NewReader(&repeatReader{b: []byte(message)})
+
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		br, err := r.ReadBulkReader()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, br); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadLongLine(b *testing.B) {
+	benchmarkReadValue(b, "+"+strings.Repeat("a", 10000)+"\r\n", true)
+}
@@ -6,6 +6,17 @@ const (
 	Integer      = byte(':')
 	BulkString   = byte('$')
 	Array        = byte('*')
+
+	// RESP3 types.
+	Null           = byte('_')
+	Boolean        = byte('#')
+	Double         = byte(',')
+	BigNumber      = byte('(')
+	VerbatimString = byte('=')
+	MapType        = byte('%')
+	SetType        = byte('~')
+	PushType       = byte('>')
+	AttributeType  = byte('|')
 )
 
 type RespError struct {
@@ -16,6 +27,11 @@ func NewRespError(message string) RespError {
 	return RespError{message: message}
 }
 
+// Message returns the message of the error, as sent over the wire.
+func (e RespError) Message() string {
+	return e.message
+}
+
 func (e *RespError) Error() string {
 	return "RESP error - " + e.message
 }
@@ -0,0 +1,386 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Versions of the protocol.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// MapEntry is a key-value pair of a RESP3 map.
+type MapEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Map is a RESP3 map. The order of its entries is preserved.
+type Map []MapEntry
+
+// Set is a RESP3 set.
+type Set []interface{}
+
+// Push is a RESP3 push message, which the server sends without a request.
+type Push []interface{}
+
+// Verbatim is a RESP3 verbatim string, which has a three letter format such as "txt" or "mkd".
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+// Attributed is a RESP3 reply that is preceded by attributes, which carry auxiliary data about
+// the reply.
+type Attributed struct {
+	Attributes Map
+	Value      interface{}
+}
+
+// readAggregate reads the elements of a RESP3 aggregate type with the specified number of
+// elements. Nested arrays are parsed with GenericSliceParser.
+func (r *Reader) readAggregate(length int64) ([]interface{}, error) {
+	s := make([]interface{}, 0, prealloc(length))
+	for i := int64(0); i < length; i++ {
+		item, err := r.readMessage(GenericSliceParser)
+		if err != nil {
+			return nil, err
+		}
+
+		s = append(s, item)
+	}
+
+	return s, nil
+}
+
+func (r *Reader) readMap(length int64) (Map, error) {
+	m := make(Map, 0, prealloc(length))
+	for i := int64(0); i < length; i++ {
+		kv, err := r.readAggregate(2)
+		if err != nil {
+			return nil, err
+		}
+
+		m = append(m, MapEntry{Key: kv[0], Value: kv[1]})
+	}
+
+	return m, nil
+}
+
+// readRESP3 reads the remainder of a message of one of the RESP3 types, given its first line.
+func (r *Reader) readRESP3(line []byte, parser ArrayParser) (interface{}, error) {
+	body := string(line[1:])
+
+	switch line[0] {
+	case Null:
+		return nil, nil
+	case Boolean:
+		switch body {
+		case "t":
+			return true, nil
+		case "f":
+			return false, nil
+		}
+
+		return nil, fmt.Errorf("resp: invalid boolean %q", body)
+	case Double:
+		return strconv.ParseFloat(body, 64)
+	case BigNumber:
+		n, ok := new(big.Int).SetString(body, 10)
+		if !ok {
+			return nil, fmt.Errorf("resp: invalid big number %q", body)
+		}
+
+		return n, nil
+	case VerbatimString:
+		length, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := r.readBulkString(length)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) < 4 || b[3] != ':' {
+			return nil, errors.New("resp: invalid verbatim string")
+		}
+
+		return Verbatim{Format: string(b[:3]), Text: string(b[4:])}, nil
+	}
+
+	length, err := strconv.ParseInt(body, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 {
+		return nil, &InvalidArrayLength{length: length}
+	}
+
+	switch line[0] {
+	case MapType:
+		return r.readMap(length)
+	case SetType:
+		s, err := r.readAggregate(length)
+		return Set(s), err
+	case PushType:
+		s, err := r.readAggregate(length)
+		return Push(s), err
+	case AttributeType:
+		attrs, err := r.readMap(length)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := r.readMessage(parser)
+		if err != nil {
+			return nil, err
+		}
+
+		return Attributed{Attributes: attrs, Value: value}, nil
+	}
+
+	return nil, fmt.Errorf("resp: failed to parse %q", line)
+}
+
+// SetProtocol sets the version of the protocol that the writer uses, either RESP2 or RESP3. With
+// RESP2, the RESP3 types are written as the closest RESP2 type instead, the same way Redis does.
+func (w *Writer) SetProtocol(version int) {
+	w.proto = version
+}
+
+// Protocol returns the version of the protocol that the writer uses.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+func (w *Writer) writeHeader(prefix byte, n int64) error {
+	if err := w.wr.WriteByte(prefix); err != nil {
+		return err
+	}
+
+	conv := strconv.AppendInt(w.miscBuf[:0], n, 10)
+	if _, err := w.wr.Write(conv); err != nil {
+		return err
+	}
+
+	return w.writeCRLF()
+}
+
+// WriteNull writes a null, which is a null bulk string with RESP2.
+func (w *Writer) WriteNull() error {
+	if w.proto < RESP3 {
+		_, err := w.wr.WriteString("$-1\r\n")
+		return err
+	}
+
+	_, err := w.wr.WriteString("_\r\n")
+	return err
+}
+
+// WriteBoolean writes a boolean, which is the integer 1 or 0 with RESP2.
+func (w *Writer) WriteBoolean(b bool) error {
+	if w.proto < RESP3 {
+		if b {
+			return w.WriteInteger(1)
+		}
+
+		return w.WriteInteger(0)
+	}
+
+	if b {
+		_, err := w.wr.WriteString("#t\r\n")
+		return err
+	}
+
+	_, err := w.wr.WriteString("#f\r\n")
+	return err
+}
+
+// WriteDouble writes a floating point number, which is a bulk string with RESP2.
+func (w *Writer) WriteDouble(f float64) error {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+
+	if w.proto < RESP3 {
+		return w.WriteBulkString([]byte(s))
+	}
+
+	if err := w.wr.WriteByte(Double); err != nil {
+		return err
+	}
+
+	if _, err := w.wr.WriteString(s); err != nil {
+		return err
+	}
+
+	return w.writeCRLF()
+}
+
+// WriteBigNumber writes an integer of arbitrary size, which is a bulk string with RESP2.
+func (w *Writer) WriteBigNumber(n *big.Int) error {
+	if w.proto < RESP3 {
+		return w.WriteBulkString([]byte(n.String()))
+	}
+
+	if err := w.wr.WriteByte(BigNumber); err != nil {
+		return err
+	}
+
+	if _, err := w.wr.WriteString(n.String()); err != nil {
+		return err
+	}
+
+	return w.writeCRLF()
+}
+
+// WriteVerbatim writes a verbatim string, which is a bulk string of its text with RESP2.
+func (w *Writer) WriteVerbatim(v Verbatim) error {
+	if w.proto < RESP3 {
+		return w.WriteBulkString([]byte(v.Text))
+	}
+
+	if len(v.Format) != 3 {
+		return fmt.Errorf("resp: invalid verbatim string format %q", v.Format)
+	}
+
+	if err := w.writeHeader(VerbatimString, int64(len(v.Text)+4)); err != nil {
+		return err
+	}
+
+	if _, err := w.wr.WriteString(v.Format); err != nil {
+		return err
+	}
+
+	if err := w.wr.WriteByte(':'); err != nil {
+		return err
+	}
+
+	if _, err := w.wr.WriteString(v.Text); err != nil {
+		return err
+	}
+
+	return w.writeCRLF()
+}
+
+// WriteMapHeader writes the header of a map with n entries, which must be followed by the keys
+// and values of the entries, alternately. With RESP2, a map is an array of twice the length.
+func (w *Writer) WriteMapHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(Array, int64(2*n))
+	}
+
+	return w.writeHeader(MapType, int64(n))
+}
+
+// WriteSetHeader writes the header of a set with n elements, which must be followed by the
+// elements. With RESP2, a set is an array.
+func (w *Writer) WriteSetHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(Array, int64(n))
+	}
+
+	return w.writeHeader(SetType, int64(n))
+}
+
+// WritePushHeader writes the header of a push message with n elements, which must be followed by
+// the elements. With RESP2, a push message is an array.
+func (w *Writer) WritePushHeader(n int) error {
+	if w.proto < RESP3 {
+		return w.writeHeader(Array, int64(n))
+	}
+
+	return w.writeHeader(PushType, int64(n))
+}
+
+// WriteArrayHeader writes the header of an array with n elements, which must be followed by the
+// elements.
+func (w *Writer) WriteArrayHeader(n int) error {
+	return w.writeHeader(Array, int64(n))
+}
+
+// WriteMap writes a map.
+func (w *Writer) WriteMap(m Map) error {
+	if err := w.WriteMapHeader(len(m)); err != nil {
+		return err
+	}
+
+	for _, kv := range m {
+		if err := w.WriteMessage(kv.Key); err != nil {
+			return err
+		}
+
+		if err := w.WriteMessage(kv.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeElements writes the elements of an aggregate type after its header.
+func (w *Writer) writeElements(s []interface{}) error {
+	for _, elem := range s {
+		if err := w.WriteMessage(elem); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteSet writes a set.
+func (w *Writer) WriteSet(s Set) error {
+	if err := w.WriteSetHeader(len(s)); err != nil {
+		return err
+	}
+
+	return w.writeElements(s)
+}
+
+// WritePush writes a push message.
+func (w *Writer) WritePush(p Push) error {
+	if err := w.WritePushHeader(len(p)); err != nil {
+		return err
+	}
+
+	return w.writeElements(p)
+}
+
+// WriteAttributed writes a reply preceded by its attributes. With RESP2, the attributes are
+// left out.
+func (w *Writer) WriteAttributed(a Attributed) error {
+	if w.proto >= RESP3 {
+		if err := w.writeHeader(AttributeType, int64(len(a.Attributes))); err != nil {
+			return err
+		}
+
+		for _, kv := range a.Attributes {
+			if err := w.WriteMessage(kv.Key); err != nil {
+				return err
+			}
+
+			if err := w.WriteMessage(kv.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.WriteMessage(a.Value)
+}
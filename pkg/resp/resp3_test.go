@@ -0,0 +1,97 @@
+package resp
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRESP3(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"_\r\n", nil},
+		{"#t\r\n", true},
+		{"#f\r\n", false},
+		{",3.5\r\n", 3.5},
+		{",-inf\r\n", math.Inf(-1)},
+		{"(3492890328409238509324850943850943825024385\r\n", bigInt("3492890328409238509324850943850943825024385")},
+		{"=15\r\ntxt:Some string\r\n", Verbatim{Format: "txt", Text: "Some string"}},
+		{"%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n*1\r\n:2\r\n", Map{
+			{Key: "first", Value: int64(1)},
+			{Key: []byte("second"), Value: []interface{}{int64(2)}},
+		}},
+		{"~2\r\n+a\r\n#t\r\n", Set{"a", true}},
+		{">2\r\n+message\r\n$2\r\nhi\r\n", Push{"message", []byte("hi")}},
+		{"|1\r\n+ttl\r\n:3600\r\n$3\r\nbar\r\n", Attributed{
+			Attributes: Map{{Key: "ttl", Value: int64(3600)}},
+			Value:      []byte("bar"),
+		}},
+	}
+
+	for i, tt := range tests {
+		r := NewReader(strings.NewReader(tt.input))
+
+		// Every complete message is recognized as such.
+		r.rd.Peek(len(tt.input))
+		assert.True(t, r.HasMessage(), "tests[%d]", i)
+
+		result, err := r.ReadMessage(GenericSliceParser)
+		assert.Nil(t, err, "tests[%d]", i)
+		assert.Equal(t, tt.expected, result, "tests[%d]", i)
+	}
+
+	for _, input := range []string{"#x\r\n", "(12a\r\n", "=3\r\ntxt\r\n", "%-1\r\n"} {
+		r := NewReader(strings.NewReader(input))
+		_, err := r.ReadMessage(GenericSliceParser)
+		assert.NotNil(t, err, "input %q", input)
+	}
+}
+
+func bigInt(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
+
+func TestWriteRESP3(t *testing.T) {
+	tests := []struct {
+		message interface{}
+		resp2   string
+		resp3   string
+	}{
+		{nil, "$-1\r\n", "_\r\n"},
+		{[]byte(nil), "$-1\r\n", "_\r\n"},
+		{true, ":1\r\n", "#t\r\n"},
+		{1.5, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{math.Inf(1), "$3\r\ninf\r\n", ",inf\r\n"},
+		{bigInt("12345678901234567890"), "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{Verbatim{Format: "txt", Text: "hi"}, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{Map{{Key: "a", Value: int64(1)}}, "*2\r\n+a\r\n:1\r\n", "%1\r\n+a\r\n:1\r\n"},
+		{Set{int64(1)}, "*1\r\n:1\r\n", "~1\r\n:1\r\n"},
+		{Push{"a"}, "*1\r\n+a\r\n", ">1\r\n+a\r\n"},
+		{Attributed{Attributes: Map{{Key: "a", Value: int64(1)}}, Value: "OK"}, "+OK\r\n", "|1\r\n+a\r\n:1\r\n+OK\r\n"},
+	}
+
+	for i, tt := range tests {
+		for _, proto := range []int{RESP2, RESP3} {
+			buf := new(bytes.Buffer)
+			wr := NewWriter(buf)
+			wr.SetProtocol(proto)
+
+			assert.Nil(t, wr.WriteMessage(tt.message), "tests[%d]", i)
+			assert.Nil(t, wr.Flush(), "tests[%d]", i)
+
+			expected := tt.resp2
+			if proto == RESP3 {
+				expected = tt.resp3
+			}
+
+			assert.Equal(t, expected, buf.String(), "tests[%d] with RESP%d", i, proto)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Value is a RESP value of any type, decoded by Reader.ReadValue and encoded by Writer.WriteValue.
+// The type of a value is one of the type prefixes, such as BulkString or Array, and determines
+// which of the accessors can be used. The zero value is a null.
+type Value struct {
+	typ     byte
+	null    bool
+	str     []byte
+	num     int64
+	float   float64
+	boolean bool
+	big     *big.Int
+	format  string
+	elems   []Value
+	attrs   []Pair
+}
+
+// Pair is a key-value pair of a map or of the attributes of a value.
+type Pair struct {
+	Key   Value
+	Value Value
+}
+
+// SimpleStringValue returns a simple string.
+func SimpleStringValue(s string) Value {
+	return Value{typ: SimpleString, str: []byte(s)}
+}
+
+// ErrorValue returns an error with the specified message.
+func ErrorValue(message string) Value {
+	return Value{typ: Error, str: []byte(message)}
+}
+
+// IntegerValue returns an integer.
+func IntegerValue(n int64) Value {
+	return Value{typ: Integer, num: n}
+}
+
+// BulkStringValue returns a bulk string. If b is nil, then the bulk string is null.
+func BulkStringValue(b []byte) Value {
+	return Value{typ: BulkString, str: b, null: b == nil}
+}
+
+// ArrayValue returns an array of the specified elements, which is empty and not null if there
+// are none.
+func ArrayValue(elems ...Value) Value {
+	if elems == nil {
+		elems = []Value{}
+	}
+
+	return Value{typ: Array, elems: elems}
+}
+
+// NullBulkStringValue returns the RESP2 null bulk string.
+func NullBulkStringValue() Value {
+	return Value{typ: BulkString, null: true}
+}
+
+// NullArrayValue returns the RESP2 null array.
+func NullArrayValue() Value {
+	return Value{typ: Array, null: true}
+}
+
+// NullValue returns the RESP3 null.
+func NullValue() Value {
+	return Value{typ: Null, null: true}
+}
+
+// BooleanValue returns a RESP3 boolean.
+func BooleanValue(b bool) Value {
+	return Value{typ: Boolean, boolean: b}
+}
+
+// DoubleValue returns a RESP3 floating point number.
+func DoubleValue(f float64) Value {
+	return Value{typ: Double, float: f}
+}
+
+// BigNumberValue returns a RESP3 integer of arbitrary size.
+func BigNumberValue(n *big.Int) Value {
+	return Value{typ: BigNumber, big: n}
+}
+
+// VerbatimValue returns a RESP3 verbatim string with the specified three letter format.
+func VerbatimValue(format string, text string) Value {
+	return Value{typ: VerbatimString, format: format, str: []byte(text)}
+}
+
+// MapValue returns a RESP3 map of the specified entries.
+func MapValue(pairs ...Pair) Value {
+	elems := make([]Value, 0, 2*len(pairs))
+	for _, p := range pairs {
+		elems = append(elems, p.Key, p.Value)
+	}
+
+	return Value{typ: MapType, elems: elems}
+}
+
+// SetValue returns a RESP3 set of the specified elements.
+func SetValue(elems ...Value) Value {
+	if elems == nil {
+		elems = []Value{}
+	}
+
+	return Value{typ: SetType, elems: elems}
+}
+
+// PushValue returns a RESP3 push message of the specified elements.
+func PushValue(elems ...Value) Value {
+	if elems == nil {
+		elems = []Value{}
+	}
+
+	return Value{typ: PushType, elems: elems}
+}
+
+// WithAttributes returns a copy of the value that is preceded by the specified RESP3 attributes.
+func (v Value) WithAttributes(attrs ...Pair) Value {
+	v.attrs = attrs
+	return v
+}
+
+// Type returns the type prefix of the value. The zero value has the type Null.
+func (v Value) Type() byte {
+	if v.typ == 0 {
+		return Null
+	}
+
+	return v.typ
+}
+
+// IsNull reports whether the value is a null bulk string, a null array, or a RESP3 null.
+func (v Value) IsNull() bool {
+	return v.typ == 0 || v.null
+}
+
+// Attributes returns the RESP3 attributes that preceded the value.
+func (v Value) Attributes() []Pair {
+	return v.attrs
+}
+
+// typeError returns the error for using an accessor on a value of the wrong type.
+func (v Value) typeError(want string) error {
+	return fmt.Errorf("resp: cannot use %s as %s", typeName(v.Type()), want)
+}
+
+func typeName(typ byte) string {
+	switch typ {
+	case SimpleString:
+		return "simple string"
+	case Error:
+		return "error"
+	case Integer:
+		return "integer"
+	case BulkString:
+		return "bulk string"
+	case Array:
+		return "array"
+	case Null:
+		return "null"
+	case Boolean:
+		return "boolean"
+	case Double:
+		return "double"
+	case BigNumber:
+		return "big number"
+	case VerbatimString:
+		return "verbatim string"
+	case MapType:
+		return "map"
+	case SetType:
+		return "set"
+	case PushType:
+		return "push"
+	}
+
+	return fmt.Sprintf("type %q", typ)
+}
+
+// AsBytes returns the contents of a simple string, bulk string or verbatim string, or the message
+// of an error. A null is returned as nil.
+func (v Value) AsBytes() ([]byte, error) {
+	switch v.Type() {
+	case SimpleString, Error, BulkString, VerbatimString:
+		return v.str, nil
+	case Null:
+		return nil, nil
+	}
+
+	return nil, v.typeError("bytes")
+}
+
+// AsString returns the contents of a simple string, bulk string or verbatim string, or the message
+// of an error.
+func (v Value) AsString() (string, error) {
+	b, err := v.AsBytes()
+	return string(b), err
+}
+
+// AsInt returns the value of an integer, or of a bulk string that holds an integer.
+func (v Value) AsInt() (int64, error) {
+	switch v.Type() {
+	case Integer:
+		return v.num, nil
+	case BulkString, SimpleString:
+		if !v.null {
+			return strconv.ParseInt(string(v.str), 10, 64)
+		}
+	}
+
+	return 0, v.typeError("integer")
+}
+
+// AsFloat returns the value of a double, an integer, or a bulk string that holds a number.
+func (v Value) AsFloat() (float64, error) {
+	switch v.Type() {
+	case Double:
+		return v.float, nil
+	case Integer:
+		return float64(v.num), nil
+	case BulkString, SimpleString:
+		if !v.null {
+			return strconv.ParseFloat(string(v.str), 64)
+		}
+	}
+
+	return 0, v.typeError("double")
+}
+
+// AsBool returns the value of a boolean, or of an integer, which is true if it is non-zero.
+func (v Value) AsBool() (bool, error) {
+	switch v.Type() {
+	case Boolean:
+		return v.boolean, nil
+	case Integer:
+		return v.num != 0, nil
+	}
+
+	return false, v.typeError("boolean")
+}
+
+// AsBigInt returns the value of a big number or an integer.
+func (v Value) AsBigInt() (*big.Int, error) {
+	switch v.Type() {
+	case BigNumber:
+		return v.big, nil
+	case Integer:
+		return big.NewInt(v.num), nil
+	}
+
+	return nil, v.typeError("big number")
+}
+
+// Format returns the format of a verbatim string, such as "txt".
+func (v Value) Format() string {
+	return v.format
+}
+
+// AsArray returns the elements of an array, set or push message. A null is returned as nil.
+func (v Value) AsArray() ([]Value, error) {
+	switch v.Type() {
+	case Array, SetType, PushType:
+		return v.elems, nil
+	case Null:
+		return nil, nil
+	}
+
+	return nil, v.typeError("array")
+}
+
+// AsMap returns the entries of a map, or of an array of alternating keys and values, which is how
+// maps are sent with RESP2.
+func (v Value) AsMap() ([]Pair, error) {
+	switch v.Type() {
+	case MapType, Array:
+		if v.null || len(v.elems)%2 != 0 {
+			break
+		}
+
+		pairs := make([]Pair, len(v.elems)/2)
+		for i := range pairs {
+			pairs[i] = Pair{Key: v.elems[2*i], Value: v.elems[2*i+1]}
+		}
+
+		return pairs, nil
+	}
+
+	return nil, v.typeError("map")
+}
+
+// Err returns the error if the value is an error, and nil otherwise.
+func (v Value) Err() error {
+	if v.typ != Error {
+		return nil
+	}
+
+	e := NewRespError(string(v.str))
+	return &e
+}
+
+// ReadValue reads the next message as a Value, however deeply it is nested.
+// An inline command is returned as an array of bulk strings, as if it had been sent as one.
+func (r *Reader) ReadValue() (Value, error) {
+	line, args, err := r.readFirstLine()
+	if err != nil {
+		return Value{}, err
+	}
+
+	if args != nil {
+		elems := make([]Value, len(args))
+		for i, arg := range args {
+			elems[i] = BulkStringValue(arg)
+		}
+
+		return ArrayValue(elems...), nil
+	}
+
+	return r.parseValue(line)
+}
+
+func (r *Reader) readValue() (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+
+	return r.parseValue(line)
+}
+
+// parseValue parses a message given its first line, reading the remainder of the message.
+func (r *Reader) parseValue(line []byte) (Value, error) {
+	if len(line) == 0 {
+		return Value{}, errors.New("resp: unexpected empty line")
+	}
+
+	typ, body := line[0], line[1:]
+
+	switch typ {
+	case SimpleString, Error:
+		str := r.alloc(int64(len(body)))
+		copy(str, body)
+		return Value{typ: typ, str: str}, nil
+	case Integer:
+		n, err := parseInt(body)
+		return IntegerValue(n), err
+	case Null:
+		return NullValue(), nil
+	case Boolean:
+		switch string(body) {
+		case "t":
+			return BooleanValue(true), nil
+		case "f":
+			return BooleanValue(false), nil
+		}
+
+		return Value{}, fmt.Errorf("resp: invalid boolean %q", body)
+	case Double:
+		f, err := strconv.ParseFloat(string(body), 64)
+		return DoubleValue(f), err
+	case BigNumber:
+		n, ok := new(big.Int).SetString(string(body), 10)
+		if !ok {
+			return Value{}, fmt.Errorf("resp: invalid big number %q", body)
+		}
+
+		return BigNumberValue(n), nil
+	case BulkString, VerbatimString:
+		length, err := parseInt(body)
+		if err != nil {
+			return Value{}, err
+		}
+
+		b, err := r.readBulkString(length)
+		if err != nil {
+			return Value{}, err
+		}
+
+		if typ == BulkString {
+			return BulkStringValue(b), nil
+		}
+
+		if len(b) < 4 || b[3] != ':' {
+			return Value{}, errors.New("resp: invalid verbatim string")
+		}
+
+		return VerbatimValue(string(b[:3]), string(b[4:])), nil
+	case Array, MapType, SetType, PushType, AttributeType:
+		length, err := parseInt(body)
+		if err != nil {
+			return Value{}, err
+		}
+
+		if typ == Array && length == -1 {
+			return NullArrayValue(), nil
+		} else if length < 0 {
+			return Value{}, &InvalidArrayLength{length: length}
+		}
+
+		n := length
+		if typ == MapType || typ == AttributeType {
+			n *= 2
+		}
+
+		elems := r.allocValues(n)
+		for i := int64(0); i < n; i++ {
+			elem, err := r.readValue()
+			if err != nil {
+				return Value{}, err
+			}
+
+			elems = append(elems, elem)
+		}
+
+		if typ != AttributeType {
+			return Value{typ: typ, elems: elems}, nil
+		}
+
+		// Attributes belong to the value that follows them.
+		v, err := r.readValue()
+		if err != nil {
+			return Value{}, err
+		}
+
+		attrs, _ := Value{typ: MapType, elems: elems}.AsMap()
+		return v.WithAttributes(attrs...), nil
+	}
+
+	return Value{}, fmt.Errorf("resp: failed to parse %q", line)
+}
+
+// WriteValue writes a Value, however deeply it is nested. With RESP2, the RESP3 types are written
+// as the closest RESP2 type instead.
+func (w *Writer) WriteValue(v Value) error {
+	if len(v.attrs) > 0 && w.proto >= RESP3 {
+		if err := w.writeHeader(AttributeType, int64(len(v.attrs))); err != nil {
+			return err
+		}
+
+		for _, p := range v.attrs {
+			if err := w.WriteValue(p.Key); err != nil {
+				return err
+			}
+
+			if err := w.WriteValue(p.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch v.Type() {
+	case SimpleString:
+		return w.WriteSimpleString(string(v.str))
+	case Error:
+		return w.WriteError(NewRespError(string(v.str)))
+	case Integer:
+		return w.WriteInteger(v.num)
+	case BulkString:
+		if v.null {
+			return w.WriteBulkString(nil)
+		}
+
+		return w.WriteBulkString(v.str)
+	case Null:
+		return w.WriteNull()
+	case Boolean:
+		return w.WriteBoolean(v.boolean)
+	case Double:
+		return w.WriteDouble(v.float)
+	case BigNumber:
+		return w.WriteBigNumber(v.big)
+	case VerbatimString:
+		return w.WriteVerbatim(Verbatim{Format: v.format, Text: string(v.str)})
+	}
+
+	var err error
+	switch v.Type() {
+	case Array:
+		if v.null {
+			return w.WriteArray(nil)
+		}
+
+		err = w.WriteArrayHeader(len(v.elems))
+	case MapType:
+		err = w.WriteMapHeader(len(v.elems) / 2)
+	case SetType:
+		err = w.WriteSetHeader(len(v.elems))
+	case PushType:
+		err = w.WritePushHeader(len(v.elems))
+	default:
+		return ErrInvalidType(v)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, elem := range v.elems {
+		if err := w.WriteValue(elem); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package resp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadValue(t *testing.T) {
+	input := "*4\r\n$3\r\nfoo\r\n*2\r\n:1\r\n*1\r\n+nested\r\n$-1\r\n*-1\r\n"
+	r := NewReader(strings.NewReader(input))
+
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, Array, v.Type())
+
+	elems, err := v.AsArray()
+	assert.Nil(t, err)
+	assert.Len(t, elems, 4)
+
+	b, err := elems[0].AsBytes()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), b)
+
+	inner, err := elems[1].AsArray()
+	assert.Nil(t, err)
+
+	n, err := inner[0].AsInt()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	innermost, err := inner[1].AsArray()
+	assert.Nil(t, err)
+
+	s, err := innermost[0].AsString()
+	assert.Nil(t, err)
+	assert.Equal(t, "nested", s)
+
+	// Null bulk strings and null arrays are told apart.
+	assert.True(t, elems[2].IsNull())
+	assert.Equal(t, BulkString, elems[2].Type())
+	assert.True(t, elems[3].IsNull())
+	assert.Equal(t, Array, elems[3].Type())
+
+	_, err = elems[0].AsArray()
+	assert.NotNil(t, err)
+
+	_, err = elems[1].AsInt()
+	assert.NotNil(t, err)
+}
+
+func TestReadValueErrors(t *testing.T) {
+	r := NewReader(strings.NewReader("-ERR bad\r\n|1\r\n+ttl\r\n:10\r\n$3\r\nbar\r\n%1\r\n+a\r\n#t\r\n"))
+
+	v, err := r.ReadValue()
+	assert.Nil(t, err)
+	assert.Equal(t, "RESP error - ERR bad", v.Err().Error())
+
+	v, err = r.ReadValue()
+	assert.Nil(t, err)
+	assert.Nil(t, v.Err())
+	assert.Equal(t, BulkStringValue([]byte("bar")).WithAttributes(Pair{Key: SimpleStringValue("ttl"), Value: IntegerValue(10)}), v)
+
+	v, err = r.ReadValue()
+	assert.Nil(t, err)
+
+	pairs, err := v.AsMap()
+	assert.Nil(t, err)
+	assert.Equal(t, []Pair{{Key: SimpleStringValue("a"), Value: BooleanValue(true)}}, pairs)
+}
+
+func TestWriteValue(t *testing.T) {
+	v := ArrayValue(
+		BulkStringValue([]byte("foo")),
+		ArrayValue(IntegerValue(1), ArrayValue()),
+		NullBulkStringValue(),
+		NullArrayValue(),
+		MapValue(Pair{Key: SimpleStringValue("a"), Value: DoubleValue(1.5)}),
+	)
+
+	tests := []struct {
+		proto    int
+		expected string
+	}{
+		{RESP2, "*5\r\n$3\r\nfoo\r\n*2\r\n:1\r\n*0\r\n$-1\r\n*-1\r\n*2\r\n+a\r\n$3\r\n1.5\r\n"},
+		{RESP3, "*5\r\n$3\r\nfoo\r\n*2\r\n:1\r\n*0\r\n_\r\n_\r\n%1\r\n+a\r\n,1.5\r\n"},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		wr := NewWriter(buf)
+		wr.SetProtocol(tt.proto)
+
+		assert.Nil(t, wr.WriteValue(v))
+		assert.Nil(t, wr.Flush())
+		assert.Equal(t, tt.expected, buf.String(), "RESP%d", tt.proto)
+	}
+
+	// Values survive a round trip through the writer and the reader.
+	buf := new(bytes.Buffer)
+	wr := NewWriter(buf)
+	assert.Nil(t, wr.WriteValue(v))
+	assert.Nil(t, wr.Flush())
+
+	got, err := NewReader(buf).ReadValue()
+	assert.Nil(t, err)
+
+	// The map is flattened into an array with RESP2.
+	elems, _ := v.AsArray()
+	elems[4] = ArrayValue(SimpleStringValue("a"), BulkStringValue([]byte("1.5")))
+	assert.Equal(t, ArrayValue(elems...), got)
+}
@@ -4,18 +4,24 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math/big"
 	"strconv"
 )
 
 type Writer struct {
 	wr      *bufio.Writer
 	miscBuf []byte
+
+	// proto is the version of the protocol, RESP2 or RESP3.
+	proto int
 }
 
+// NewWriter returns a writer that uses RESP2 until the protocol is changed with SetProtocol.
 func NewWriter(wr io.Writer) *Writer {
 	return &Writer{
 		wr:      bufio.NewWriter(wr),
 		miscBuf: make([]byte, 0, 64),
+		proto:   RESP2,
 	}
 }
 
@@ -50,14 +56,37 @@ func (w *Writer) WriteMessage(message interface{}) error {
 		return w.WriteInteger(int64(v))
 	case int64:
 		return w.WriteInteger(v)
-	//case []interface{}:
-	//	return w.WriteArray(v)
+	case []interface{}:
+		return w.WriteArray(v)
+	case nil:
+		return w.WriteNull()
+	case bool:
+		return w.WriteBoolean(v)
+	case float64:
+		return w.WriteDouble(v)
+	case *big.Int:
+		return w.WriteBigNumber(v)
+	case Verbatim:
+		return w.WriteVerbatim(v)
+	case Map:
+		return w.WriteMap(v)
+	case Set:
+		return w.WriteSet(v)
+	case Push:
+		return w.WritePush(v)
+	case Attributed:
+		return w.WriteAttributed(v)
+	case Value:
+		return w.WriteValue(v)
 	default:
 		return ErrInvalidType(message)
 	}
 }
 
 func (w *Writer) WriteArray(s []interface{}) error {
+	if s == nil && w.proto >= RESP3 {
+		return w.WriteNull()
+	}
 
 	if err := w.wr.WriteByte(Array); err != nil {
 		return err
@@ -90,7 +119,16 @@ func (w *Writer) WriteArray(s []interface{}) error {
 // of bulk strings. All of the supplied arguments will be converted to their representations
 // as a RESP bulk string.
 func (w *Writer) WriteCommand(args ...interface{}) error {
-	if err := w.WriteInteger(int64(len(args))); err != nil {
+	if err := w.wr.WriteByte(Array); err != nil {
+		return err
+	}
+
+	conv := strconv.AppendInt(w.miscBuf[:0], int64(len(args)), 10)
+	if _, err := w.wr.Write(conv); err != nil {
+		return err
+	}
+
+	if err := w.writeCRLF(); err != nil {
 		return err
 	}
 
@@ -147,6 +185,10 @@ func (w *Writer) WriteError(respError RespError) error {
 }
 
 func (w *Writer) WriteBulkString(b []byte) error {
+	if b == nil && w.proto >= RESP3 {
+		return w.WriteNull()
+	}
+
 	if err := w.wr.WriteByte(BulkString); err != nil {
 		return err
 	}
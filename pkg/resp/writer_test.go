@@ -72,3 +72,16 @@ func TestWriter_WriteArray(t *testing.T) {
 
 	assert.Equal(t, []byte("*4\r\n+simplestring\r\n-error\r\n:1\r\n$10\r\nbulkstring\r\n"), buf.Bytes())
 }
+
+func TestWriter_WriteCommand(t *testing.T) {
+	buf := new(bytes.Buffer)
+	wr := NewWriter(buf)
+
+	err := wr.WriteCommand("SET", []byte("foo"), "bar")
+	assert.Nil(t, err)
+
+	err = wr.Flush()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", buf.String())
+}
@@ -0,0 +1,129 @@
+package keychain
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// RecoveryMode determines what happens when a data file with a damaged record is found while a
+// store is being opened, such as one whose last record was only partially written because the
+// process crashed.
+type RecoveryMode int
+
+const (
+	// RecoveryTruncate truncates the data file back to the end of its last intact record. Any
+	// records after the damaged one are discarded as well.
+	RecoveryTruncate RecoveryMode = iota
+
+	// RecoveryStrict refuses to open the store, returning a *Damage error.
+	RecoveryStrict
+)
+
+// Damage describes a damaged record in a data file, along with the data following it.
+type Damage struct {
+	// File is the path of the data file.
+	File string
+
+	// Offset is the offset of the damaged record, which is the end of the last intact record.
+	Offset int64
+
+	// Size is the number of bytes from the damaged record to the end of the data file.
+	Size int64
+
+	// Err is the error that occurred while reading the damaged record.
+	Err error
+}
+
+func (d *Damage) Error() string {
+	return fmt.Sprintf("damaged record in %s at offset %d (%d bytes): %v", d.File, d.Offset, d.Size, d.Err)
+}
+
+// Recovered returns the damaged parts of data files that were discarded when the store was opened.
+func (k *Keychain) Recovered() []Damage {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	return append([]Damage(nil), k.recovered...)
+}
+
+// scanSegment reads the hints for all of the entries of a data file from the data file itself.
+// If the data file has a damaged record, then it is either truncated or an error is returned,
+// depending on the recovery mode of the store.
+func (k *Keychain) scanSegment(seg *segment) ([]hint, error) {
+	if _, err := seg.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	r := data.NewEntryReader(seg.file, seg.id)
+
+	var hints []hint
+	for {
+		key, entry, err := r.ReadEntry()
+		if err == io.EOF {
+			return hints, nil
+		}
+
+		if err == nil {
+			hints = append(hints, hint{key: key, entry: *entry})
+			continue
+		}
+
+		// Other errors, such as a data file in an unsupported format, are not damage that can be
+		// recovered from.
+		if err != io.ErrUnexpectedEOF && err != data.ErrCorrupted {
+			return nil, err
+		}
+
+		damage := Damage{
+			File:   segmentPath(k.dir, seg.id),
+			Offset: r.Offset(),
+			Size:   seg.size - r.Offset(),
+			Err:    err,
+		}
+
+		if k.recoveryMode == RecoveryStrict {
+			return nil, &damage
+		}
+
+		if err := k.truncateSegment(seg, damage.Offset); err != nil {
+			return nil, err
+		}
+
+		k.recovered = append(k.recovered, damage)
+		return hints, nil
+	}
+}
+
+// truncateSegment truncates a data file to the specified size.
+func (k *Keychain) truncateSegment(seg *segment, size int64) error {
+	name := segmentPath(k.dir, seg.id)
+	if err := os.Truncate(name, size); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	seg.size = size
+
+	// A data file truncated to nothing will be written in the current format.
+	if size == 0 {
+		seg.version = data.CurrentVersion
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+func TestRecoverTornWrite(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	set(keys, []byte("key"), []byte("value"), t)
+	set(keys, []byte("key2"), []byte("value2"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	path := segmentPath(name, 0)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat data file: %v", err)
+	}
+
+	// Simulate a crash in the middle of appending a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("could not open data file: %v", err)
+	}
+
+	if _, err := f.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05}); err != nil {
+		t.Fatalf("could not write data file: %v", err)
+	}
+	f.Close()
+
+	if _, err := OpenConf(name, &Conf{RecoveryMode: RecoveryStrict}); err == nil {
+		t.Fatalf("expected strict recovery to refuse to open the database")
+	} else if _, ok := err.(*Damage); !ok {
+		t.Fatalf("expected *Damage error, got=%v", err)
+	}
+
+	keys2, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	recovered := keys2.Recovered()
+	if len(recovered) != 1 {
+		t.Fatalf("expected one damaged data file, got=%d", len(recovered))
+	}
+
+	if recovered[0].Offset != stat.Size() || recovered[0].Size != 5 {
+		t.Fatalf("incorrect damage: expected offset=%d size=5, got offset=%d size=%d",
+			stat.Size(), recovered[0].Offset, recovered[0].Size)
+	}
+
+	// New items are appended after the last intact record.
+	set(keys2, []byte("key3"), []byte("value3"), t)
+
+	if err := keys2.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys3, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+
+	if len(keys3.Recovered()) != 0 {
+		t.Fatalf("expected no damaged data files")
+	}
+
+	getAndExpect(keys3, []byte("key"), []byte("value"), t)
+	getAndExpect(keys3, []byte("key2"), []byte("value2"), t)
+	getAndExpect(keys3, []byte("key3"), []byte("value3"), t)
+
+	if err := keys3.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
+
+func TestRecoverTornBatch(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	set(keys, []byte("key"), []byte("value"), t)
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// A batch marker that claims far more entries than the data file holds must not allocate
+	// memory for all of them.
+	f, err := os.OpenFile(segmentPath(name, 0), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("could not open data file: %v", err)
+	}
+
+	w := data.NewWriter(f)
+	if err := w.WriteItem(data.NewBatchMarker(1 << 40)); err != nil {
+		t.Fatalf("could not write batch marker: %v", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("could not write batch marker: %v", err)
+	}
+	f.Close()
+
+	keys2, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+	defer keys2.Close()
+
+	if len(keys2.Recovered()) != 1 {
+		t.Fatalf("expected one damaged data file, got=%d", len(keys2.Recovered()))
+	}
+
+	getAndExpect(keys2, []byte("key"), []byte("value"), t)
+}
@@ -0,0 +1,158 @@
+package keychain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// dataFileExt is the extension used for data files inside of a store directory.
+const dataFileExt = ".data"
+
+// hintFileExt is the extension used for the hint files that accompany immutable data files.
+const hintFileExt = ".hint"
+
+// segment represents a single data file of a Keychain store. All segments except for the
+// active one are immutable.
+type segment struct {
+	id      uint64
+	file    *os.File
+	version int
+
+	// size is the number of bytes in the data file, and dead is the number of those bytes that
+	// belong to records that have since been overwritten or removed.
+	size int64
+	dead int64
+
+	// refs is the number of iterators and other readers that hold on to the data file outside
+	// of the store's lock. A data file that is merged while it is still referenced is only
+	// closed and removed once it is released, at which point retired is set.
+	refs    int32
+	retired bool
+}
+
+// openSegment opens the data file with the specified ID for reading.
+func openSegment(dir string, id uint64) (*segment, error) {
+	f, err := os.Open(segmentPath(dir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	version, err := data.ReadVersion(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &segment{id: id, file: f, version: version, size: stat.Size()}, nil
+}
+
+// acquireSegments takes a reference to all of the data files of the store. It must be called
+// with at least the read lock held.
+func (k *Keychain) acquireSegments() map[uint64]*segment {
+	segments := make(map[uint64]*segment, len(k.segments))
+	for id, seg := range k.segments {
+		atomic.AddInt32(&seg.refs, 1)
+		segments[id] = seg
+	}
+
+	return segments
+}
+
+// releaseSegments releases the references taken by acquireSegments, removing any data files that
+// were retired in the meantime.
+func (k *Keychain) releaseSegments(segments map[uint64]*segment) error {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	var firstErr error
+	for _, seg := range segments {
+		if atomic.AddInt32(&seg.refs, -1) == 0 && seg.retired {
+			if err := k.removeSegment(seg); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// retireSegment removes a data file from the store. The data file is closed and removed once it
+// is no longer referenced. It must be called with the write lock held.
+func (k *Keychain) retireSegment(seg *segment) error {
+	delete(k.segments, seg.id)
+
+	seg.retired = true
+	if atomic.LoadInt32(&seg.refs) > 0 {
+		return nil
+	}
+
+	return k.removeSegment(seg)
+}
+
+// removeSegment closes a data file and removes it along with its hint file.
+func (k *Keychain) removeSegment(seg *segment) error {
+	if err := seg.file.Close(); err != nil {
+		return err
+	}
+
+	return removeSegmentFiles(k.dir, seg.id)
+}
+
+// segmentPath returns the path of the data file with the specified ID.
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", id, dataFileExt))
+}
+
+// hintPath returns the path of the hint file for the data file with the specified ID.
+func hintPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", id, hintFileExt))
+}
+
+// removeSegmentFiles removes the data file with the specified ID along with its hint file.
+func removeSegmentFiles(dir string, id uint64) error {
+	if err := os.Remove(hintPath(dir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(segmentPath(dir, id))
+}
+
+// listSegments returns the IDs of all of the data files in the directory, in ascending order.
+func listSegments(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, dataFileExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, dataFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
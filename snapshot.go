@@ -0,0 +1,217 @@
+package keychain
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// Snapshot writes a consistent snapshot of the store to w, holding every live key along with its
+// value and expiry. The keys are captured under the read lock when Snapshot is called, so writes
+// made while the snapshot is being written are not included, and do not wait for it. The snapshot
+// has the format of a data file, and a store can be created from it with Restore.
+func (k *Keychain) Snapshot(w io.Writer) error {
+	it := k.Scan(nil)
+	defer it.Close()
+
+	return it.WriteSnapshot(w)
+}
+
+// WriteSnapshot writes the keys that the iterator visits after its current position to w, in the
+// format of Snapshot. An iterator returned by Scan with a nil prefix captures the view of the store
+// that the snapshot holds, so that it can be written later, for example in the background.
+func (it *Iterator) WriteSnapshot(w io.Writer) error {
+	wr := data.NewWriter(w)
+	if err := wr.WriteHeader(); err != nil {
+		return err
+	}
+
+	for it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+
+		item := data.NewItem(it.Key(), value)
+		item.Timestamp = it.items[it.cur].entry.Timestamp
+		item.Expiry = it.Expiry()
+		if err := wr.WriteItem(item); err != nil {
+			return err
+		}
+	}
+
+	return wr.Flush()
+}
+
+// Restore creates a store in the directory from a snapshot written by Snapshot. The directory is
+// created if it does not exist, and must not already contain a store. Every record of the snapshot
+// is checked against its checksum before the store is created, so that a damaged snapshot leaves
+// no store behind. Keys that have expired since the snapshot was taken are dropped when the store
+// is opened.
+func Restore(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := checkEmpty(dir); err != nil {
+		return err
+	}
+
+	name := segmentPath(dir, 0)
+	tmp := name + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := restoreRecords(r, f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// restoreRecords copies the records of a snapshot to a new data file.
+func restoreRecords(r io.Reader, f *os.File) error {
+	rd := data.NewReader(r)
+	wr := data.NewWriter(f)
+	if err := wr.WriteHeader(); err != nil {
+		return err
+	}
+
+	for {
+		item, err := rd.ReadItem()
+		if err == io.EOF {
+			return wr.Flush()
+		}
+
+		if err != nil {
+			return fmt.Errorf("keychain: reading snapshot: %v", err)
+		}
+
+		if err := wr.WriteItem(item); err != nil {
+			return err
+		}
+	}
+}
+
+// Backup creates a copy of the store in the directory, which can be opened with Open. The
+// directory is created if it does not exist, and must not already contain a store. The data files
+// are captured under the read lock when Backup is called: immutable data files are hard-linked
+// into the directory, or copied if that is not possible, and the active data file is copied up to
+// its current size. Writes made while the backup is being created are not included, and do not
+// wait for it.
+func (k *Keychain) Backup(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := checkEmpty(dir); err != nil {
+		return err
+	}
+
+	k.mtx.RLock()
+	segments := k.acquireSegments()
+	activeID, activeSize := k.activeID, k.offset
+	k.mtx.RUnlock()
+
+	defer k.releaseSegments(segments)
+
+	for id, seg := range segments {
+		var err error
+		if id == activeID {
+			err = copyFile(segmentPath(dir, id), io.NewSectionReader(seg.file, 0, activeSize))
+		} else {
+			err = linkFile(segmentPath(dir, id), segmentPath(k.dir, id))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// checkEmpty returns an error if the directory contains a store.
+func checkEmpty(dir string) error {
+	ids, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		return fmt.Errorf("keychain: %s already contains a store", dir)
+	}
+
+	return nil
+}
+
+// linkFile creates a hard link to a file, falling back to copying the file if the link cannot be
+// created, for example because the link would be on another file system.
+func linkFile(name string, target string) error {
+	if err := os.Link(target, name); err == nil {
+		return nil
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return copyFile(name, f)
+}
+
+// copyFile creates a file with the contents of r, and synchronizes it to disk.
+func copyFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir synchronizes the entries of a directory to disk, so that the files created in it are
+// not lost.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
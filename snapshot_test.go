@@ -0,0 +1,178 @@
+package keychain
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFunc calls a function before the first write to an underlying writer.
+type writeFunc struct {
+	w      io.Writer
+	before func()
+}
+
+func (w *writeFunc) Write(p []byte) (int, error) {
+	if w.before != nil {
+		w.before()
+		w.before = nil
+	}
+
+	return w.w.Write(p)
+}
+
+func TestSnapshot(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(filepath.Join(name, "db"), &Conf{MaxFileSize: 256})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		set(keys, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), t)
+	}
+
+	remove(keys, []byte("key3"), t)
+	if err := keys.SetWithTTL([]byte("session"), []byte("value-session"), time.Hour); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	// Writes made while the snapshot is being written are not part of it, and do not wait for it.
+	var buf bytes.Buffer
+	err = keys.Snapshot(&writeFunc{w: &buf, before: func() {
+		set(keys, []byte("late"), []byte("value-late"), t)
+		set(keys, []byte("key5"), []byte("value55"), t)
+	}})
+
+	if err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	snapshot := buf.Bytes()
+	dir := filepath.Join(name, "restored")
+	if err := Restore(bytes.NewReader(snapshot), dir); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+
+	restored, err := Open(dir)
+	if err != nil {
+		t.Fatalf("could not open restored database: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		expected := []byte(fmt.Sprintf("value%d", i))
+		if i == 3 {
+			expected = nil
+		}
+
+		getAndExpect(restored, []byte(fmt.Sprintf("key%d", i)), expected, t)
+	}
+
+	getAndExpect(restored, []byte("late"), nil, t)
+	getAndExpect(restored, []byte("session"), []byte("value-session"), t)
+	if ttl, err := restored.TTL([]byte("session")); err != nil || ttl <= 59*time.Minute {
+		t.Fatalf("incorrect ttl for restored key: ttl=%v, err=%v", ttl, err)
+	}
+
+	if err := restored.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	// A directory that already contains a store is left alone.
+	if err := Restore(bytes.NewReader(snapshot), dir); err == nil {
+		t.Fatalf("expected restoring into an existing store to fail")
+	}
+
+	// A damaged snapshot leaves no store behind.
+	damaged := append([]byte(nil), snapshot...)
+	damaged[len(damaged)-1] ^= 0xff
+
+	dir = filepath.Join(name, "damaged")
+	if err := Restore(bytes.NewReader(damaged), dir); err == nil {
+		t.Fatalf("expected restoring a damaged snapshot to fail")
+	}
+
+	if ids, err := listSegments(dir); err != nil || len(ids) != 0 {
+		t.Fatalf("expected no data files after a failed restore: ids=%v, err=%v", ids, err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(filepath.Join(name, "db"), &Conf{MaxFileSize: 256})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		set(keys, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), t)
+	}
+
+	remove(keys, []byte("key3"), t)
+
+	ids, err := listSegments(filepath.Join(name, "db"))
+	if err != nil || len(ids) < 2 {
+		t.Fatalf("expected multiple data files: ids=%v, err=%v", ids, err)
+	}
+
+	dir := filepath.Join(name, "backup")
+	if err := keys.Backup(dir); err != nil {
+		t.Fatalf("failed to back up database: %v", err)
+	}
+
+	// Writes and merges after the backup do not affect it.
+	set(keys, []byte("late"), []byte("value-late"), t)
+	set(keys, []byte("key5"), []byte("value55"), t)
+	if err := keys.Merge(); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	if err := keys.Backup(dir); err == nil {
+		t.Fatalf("expected backing up into an existing store to fail")
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	backup, err := Open(dir)
+	if err != nil {
+		t.Fatalf("could not open backup: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		expected := []byte(fmt.Sprintf("value%d", i))
+		if i == 3 {
+			expected = nil
+		}
+
+		getAndExpect(backup, []byte(fmt.Sprintf("key%d", i)), expected, t)
+	}
+
+	getAndExpect(backup, []byte("late"), nil, t)
+
+	if err := backup.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+}
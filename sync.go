@@ -0,0 +1,111 @@
+package keychain
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SyncPolicy determines when the records appended to a store are synchronized to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways synchronizes every write to disk before it returns. Writers that run
+	// concurrently share a single synchronization. It is the zero value, so that writes are
+	// durable unless a store is configured otherwise.
+	SyncAlways SyncPolicy = iota
+
+	// SyncEverySecond synchronizes the active data file in the background once every second, so
+	// at most about a second of writes can be lost if the machine crashes.
+	SyncEverySecond
+
+	// SyncNever leaves synchronizing to the operating system, except when the active data file
+	// is rotated and when the store is closed.
+	SyncNever
+)
+
+// syncRequest is sent by a writer to the flusher to wait until its records are durable.
+type syncRequest struct {
+	seq  uint64
+	done chan error
+}
+
+// waitSync waits until the records with the specified sequence number are synchronized to disk,
+// if the sync policy requires it. It must be called without the lock held, so that other writers
+// can append their records in the meantime and share the same synchronization.
+func (k *Keychain) waitSync(seq uint64) error {
+	if k.syncPolicy != SyncAlways || atomic.LoadUint64(&k.synced) >= seq {
+		return nil
+	}
+
+	req := syncRequest{seq: seq, done: make(chan error, 1)}
+	select {
+	case k.syncs <- req:
+		return <-req.done
+	case <-k.done:
+		// The store is being closed, which synchronizes the active data file.
+		return nil
+	}
+}
+
+// syncLoop is the flusher, which synchronizes the active data file on behalf of waiting writers,
+// and once every second for SyncEverySecond.
+func (k *Keychain) syncLoop() {
+	defer k.wg.Done()
+
+	var tick <-chan time.Time
+	if k.syncPolicy == SyncEverySecond {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-tick:
+			k.Sync()
+		case req := <-k.syncs:
+			// Every writer waiting at this point has already appended its records, so a single
+			// synchronization covers all of them.
+			reqs := []syncRequest{req}
+		drain:
+			for {
+				select {
+				case req := <-k.syncs:
+					reqs = append(reqs, req)
+				default:
+					break drain
+				}
+			}
+
+			err := k.Sync()
+			for _, req := range reqs {
+				req.done <- err
+			}
+		}
+	}
+}
+
+// Sync synchronizes all of the records appended to the store so far to disk.
+func (k *Keychain) Sync() error {
+	k.mtx.RLock()
+	handle := k.writeHandle
+	seq := k.counter
+
+	// Holding syncMtx keeps the handle from being closed by a rotation until it has been synced.
+	k.syncMtx.Lock()
+	k.mtx.RUnlock()
+	defer k.syncMtx.Unlock()
+
+	if atomic.LoadUint64(&k.synced) >= seq {
+		return nil
+	}
+
+	if err := handle.Sync(); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&k.synced, seq)
+	return nil
+}
@@ -0,0 +1,128 @@
+package keychain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{Sync: true, MaxFileSize: 4096})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	const writers = 16
+	const perWriter = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+				if err := keys.Set(key, key); err != nil {
+					errs <- err
+					return
+				}
+
+				// Every write that returned must be on disk.
+				if synced := atomic.LoadUint64(&keys.synced); synced == 0 {
+					errs <- fmt.Errorf("write returned before being synced")
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+	defer keys2.Close()
+
+	for i := 0; i < writers; i++ {
+		for j := 0; j < perWriter; j++ {
+			key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+			getAndExpect(keys2, key, key, t)
+		}
+	}
+}
+
+func TestSyncEverySecond(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{SyncPolicy: SyncEverySecond})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	set(keys, []byte("key"), []byte("value"), t)
+
+	// The write returns without waiting for the background synchronization.
+	if atomic.LoadUint64(&keys.synced) != 0 {
+		t.Fatalf("expected write not to be synced yet")
+	}
+
+	getAndExpect(keys, []byte("key"), []byte("value"), t)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadUint64(&keys.synced) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected write to be synced in the background")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDefaultSyncPolicy(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	// A configuration that only sets other options keeps every write durable.
+	keys, err := OpenConf(name, &Conf{MaxFileSize: 4096})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	set(keys, []byte("key"), []byte("value"), t)
+
+	if atomic.LoadUint64(&keys.synced) == 0 {
+		t.Fatalf("expected write to be synced before returning")
+	}
+}
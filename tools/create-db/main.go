@@ -8,14 +8,14 @@ import (
 	"log"
 	"os"
 
-	"github.com/maybetheresloop/keychain/internal/data"
+	"github.com/maybetheresloop/keychain"
 )
 
 var fp string
 var out string
 
 const UsageFp = "CSV file to create database from"
-const UsageOut = "Database file to create"
+const UsageOut = "Database directory to create"
 
 func init() {
 	flag.StringVar(&out, "o", "keychain.db", UsageOut)
@@ -28,11 +28,10 @@ func init() {
 func main() {
 	flag.Parse()
 
-	outFile, err := os.Create(out)
+	keys, err := keychain.Open(out)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer outFile.Close()
 
 	var in io.Reader
 	if fp == "" {
@@ -44,7 +43,6 @@ func main() {
 	}
 
 	r := csv.NewReader(bufio.NewReader(in))
-	w := data.NewWriter(outFile)
 
 	count := 0
 
@@ -61,13 +59,13 @@ func main() {
 			log.Fatal("record must have at least two fields")
 		}
 
-		if err := w.WriteItem(data.NewItem([]byte(record[0]), []byte(record[1]))); err != nil {
+		if err := keys.Set([]byte(record[0]), []byte(record[1])); err != nil {
 			log.Fatal(err)
 		}
 		count += 1
 	}
 
-	if err := w.Flush(); err != nil {
+	if err := keys.Close(); err != nil {
 		log.Fatal(err)
 	}
 
@@ -1,36 +1,100 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/maybetheresloop/keychain/internal/data"
 )
 
+var dir string
+
+const UsageDir = "Database directory to read"
+
+// dataFileExt is the extension of the data files of a database directory.
+const dataFileExt = ".data"
+
+func init() {
+	flag.StringVar(&dir, "d", "keychain.db", UsageDir)
+	flag.StringVar(&dir, "dir", "keychain.db", UsageDir)
+}
+
 func main() {
-	f, err := os.Open("keychain.db")
-	f2, err := os.Open("keychain.db")
+	flag.Parse()
+
+	ids, err := listDataFiles(dir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	r := data.NewEntryReader(f, 0)
+	for _, id := range ids {
+		if err := readDataFile(filepath.Join(dir, fmt.Sprintf("%d%s", id, dataFileExt))); err != nil {
+			log.Fatalf("error reading data file %d: %v", id, err)
+		}
+	}
+}
+
+// listDataFiles returns the IDs of the data files in the directory, in ascending order.
+func listDataFiles(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, dataFileExt) {
+			continue
+		}
 
-	var entry *data.Entry
-	var key []byte
-	for key, entry, err = r.ReadEntry(); err == nil; key, entry, err = r.ReadEntry() {
-		fmt.Printf("key: %q, value size: %d, value offset: %d\n", string(key), entry.ValueSize, entry.ValuePos)
-		value := make([]byte, entry.ValueSize)
-		if _, err := f2.ReadAt(value, entry.ValuePos); err != nil {
-			log.Fatalf("error reading value: %v", err)
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, dataFileExt), 10, 64)
+		if err != nil {
+			continue
 		}
 
-		fmt.Printf("%q", string(value))
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// readDataFile prints the records of a data file, in whichever format it was written in.
+func readDataFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+
+	fmt.Printf("%s:\n", path)
+
+	r := data.NewReader(f)
+	for {
+		item, err := r.ReadItem()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	if err != io.EOF {
-		log.Fatalf("error reading item: %v", err)
+		switch {
+		case item.IsBatchMarker():
+			fmt.Printf("batch of %d records\n", item.ValueSize)
+		case item.ValueSize == -1:
+			fmt.Printf("key: %q, removed\n", string(item.Key))
+		default:
+			fmt.Printf("key: %q, value: %q, expiry: %d\n", string(item.Key), string(item.Value), item.Expiry)
+		}
 	}
 }
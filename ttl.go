@@ -0,0 +1,144 @@
+package keychain
+
+import (
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+const (
+	// NoExpiry is returned by TTL for keys that exist but do not expire.
+	NoExpiry time.Duration = -1
+
+	// KeyNotFound is returned by TTL for keys that do not exist.
+	KeyNotFound time.Duration = -2
+)
+
+// SetWithTTL inserts a key-value pair into the store that expires after the specified duration.
+// Once it expires, the key is treated as if it were removed. If the key already exists in the
+// store, then the previous value is overwritten. A nil value is stored as an empty value.
+func (k *Keychain) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	k.mtx.Lock()
+	seq, err := k.setExpiry(key, value, time.Now().Add(ttl).UnixNano())
+	k.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return k.waitSync(seq)
+}
+
+// Expire sets the time after which an existing key expires. Returns true only if the key exists.
+func (k *Keychain) Expire(key []byte, ttl time.Duration) (bool, error) {
+	return k.updateExpiry(key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist removes the expiry of a key, so that it no longer expires. Returns true only if the key
+// exists and had an expiry.
+func (k *Keychain) Persist(key []byte) (bool, error) {
+	return k.updateExpiry(key, 0)
+}
+
+// TTL returns the remaining time before a key expires. If the key exists but does not expire,
+// then NoExpiry is returned, and if the key does not exist, then KeyNotFound is returned.
+func (k *Keychain) TTL(key []byte) (time.Duration, error) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+
+	now := time.Now().UnixNano()
+	entry, ok := k.liveEntry(key, now)
+	if !ok {
+		return KeyNotFound, nil
+	}
+
+	if entry.Expiry == 0 {
+		return NoExpiry, nil
+	}
+
+	return time.Duration(entry.Expiry - now), nil
+}
+
+// updateExpiry rewrites the record of an existing key with a new expiry, which is zero if the key
+// should no longer expire.
+func (k *Keychain) updateExpiry(key []byte, expiry int64) (bool, error) {
+	k.mtx.Lock()
+
+	entry, ok := k.liveEntry(key, time.Now().UnixNano())
+	if !ok || (expiry == 0 && entry.Expiry == 0) {
+		k.mtx.Unlock()
+		return false, nil
+	}
+
+	value, err := k.readValue(key, entry)
+	if err != nil {
+		k.mtx.Unlock()
+		return false, err
+	}
+
+	seq, err := k.setExpiry(key, value, expiry)
+	k.mtx.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, k.waitSync(seq)
+}
+
+// setExpiry appends a key-value pair with the specified expiry, returning the sequence number of
+// the write. It must be called with the write lock held.
+func (k *Keychain) setExpiry(key []byte, value []byte, expiry int64) (uint64, error) {
+	item := data.NewItem(key, value)
+	item.Expiry = expiry
+
+	entries, err := k.append(item)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := entries[0].Seq
+	k.applyEntry(key, entries[0])
+	return seq, nil
+}
+
+// liveEntry returns the entry of a key if it exists and has not expired. It must be called with
+// the lock held.
+func (k *Keychain) liveEntry(key []byte, now int64) (*data.Entry, bool) {
+	v, found := k.entries.Search(key)
+	if !found {
+		return nil, false
+	}
+
+	entry := v.(*data.Entry)
+	if entry.ValueSize == -1 || entry.Expired(now) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// dropExpired removes the keys that have expired from the radix tree. Their records are dead, and
+// are discarded by the next merge.
+func (k *Keychain) dropExpired() {
+	now := time.Now().UnixNano()
+
+	var expired [][]byte
+	k.entries.ForEach(func(node art.Node) bool {
+		if node.Value().(*data.Entry).Expired(now) {
+			expired = append(expired, node.Key())
+		}
+
+		return true
+	})
+
+	for _, key := range expired {
+		v, _ := k.entries.Delete(art.Key(key))
+		k.markDead(key, v.(*data.Entry))
+	}
+}
@@ -0,0 +1,114 @@
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func expectTTL(keys *Keychain, key []byte, expected time.Duration, t *testing.T) {
+	ttl, err := keys.TTL(key)
+	if err != nil {
+		t.Fatalf("failed to get ttl of key %q: %v", key, err)
+	}
+
+	if ttl != expected {
+		t.Fatalf("incorrect ttl for key %q: expected=%v, got=%v", key, expected, ttl)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	if err := keys.SetWithTTL([]byte("session"), []byte("value-session"), time.Hour); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	if err := keys.SetWithTTL([]byte("short"), []byte("lived"), 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	set(keys, []byte("key"), []byte("value-key"), t)
+
+	getAndExpect(keys, []byte("session"), []byte("value-session"), t)
+	expectTTL(keys, []byte("key"), NoExpiry, t)
+	expectTTL(keys, []byte("missing"), KeyNotFound, t)
+
+	if ttl, err := keys.TTL([]byte("session")); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("incorrect ttl for key %q: got=%v, err=%v", "session", ttl, err)
+	}
+
+	if ok, err := keys.Expire([]byte("key"), time.Hour); err != nil || !ok {
+		t.Fatalf("failed to expire key: ok=%v, err=%v", ok, err)
+	}
+
+	if ok, err := keys.Expire([]byte("missing"), time.Hour); err != nil || ok {
+		t.Fatalf("expected expiring a missing key to fail: ok=%v, err=%v", ok, err)
+	}
+
+	if ok, err := keys.Persist([]byte("session")); err != nil || !ok {
+		t.Fatalf("failed to persist key: ok=%v, err=%v", ok, err)
+	}
+
+	expectTTL(keys, []byte("session"), NoExpiry, t)
+	getAndExpect(keys, []byte("session"), []byte("value-session"), t)
+
+	time.Sleep(100 * time.Millisecond)
+
+	getAndExpect(keys, []byte("short"), nil, t)
+	expectTTL(keys, []byte("short"), KeyNotFound, t)
+	expectKeys([]string{"key", "session"}, collect(keys.Scan(nil), t), t)
+
+	// Expiries survive reopening the database, and expired keys are not loaded.
+	if err := keys.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	keys2, err := Open(name)
+	if err != nil {
+		t.Fatalf("could not reopen database: %v", err)
+	}
+	defer keys2.Close()
+
+	if _, found := keys2.entries.Search([]byte("short")); found {
+		t.Fatalf("expected expired key to be dropped on open")
+	}
+
+	getAndExpect(keys2, []byte("session"), []byte("value-session"), t)
+	expectTTL(keys2, []byte("session"), NoExpiry, t)
+
+	if ttl, err := keys2.TTL([]byte("key")); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("incorrect ttl for key %q: got=%v, err=%v", "key", ttl, err)
+	}
+
+	// Merging discards expired records but keeps the expiry of live ones.
+	if err := keys2.SetWithTTL([]byte("short"), []byte("lived"), time.Millisecond); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := keys2.Merge(); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	if _, found := keys2.entries.Search([]byte("short")); found {
+		t.Fatalf("expected expired key to be discarded by merge")
+	}
+
+	getAndExpect(keys2, []byte("key"), []byte("value-key"), t)
+	if ttl, err := keys2.TTL([]byte("key")); err != nil || ttl <= 59*time.Minute {
+		t.Fatalf("incorrect ttl for key %q after merge: got=%v, err=%v", "key", ttl, err)
+	}
+}
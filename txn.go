@@ -0,0 +1,218 @@
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/maybetheresloop/keychain/internal/data"
+)
+
+// ErrConflict is returned when committing a transaction that read a key which has been modified
+// since the transaction started.
+var ErrConflict = errors.New("keychain: transaction conflict")
+
+// ErrTxnDone is returned when using a transaction that has already been committed or rolled back.
+var ErrTxnDone = errors.New("keychain: transaction is done")
+
+// Txn is an optimistic transaction. Reads see a snapshot of the store as of the start of the
+// transaction, along with the transaction's own writes. Writes are buffered until the transaction
+// is committed, at which point they are applied atomically, as with Keychain.Write. A transaction
+// is not safe for concurrent use.
+type Txn struct {
+	k        *Keychain
+	seq      uint64
+	segments map[uint64]*segment
+	reads    map[string]struct{}
+	writes   map[string][]byte
+	batch    Batch
+	done     bool
+}
+
+// Begin starts a new transaction. The transaction must be either committed or rolled back.
+func (k *Keychain) Begin() *Txn {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	t := &Txn{
+		k:        k,
+		seq:      k.counter,
+		segments: k.acquireSegments(),
+		reads:    make(map[string]struct{}),
+		writes:   make(map[string][]byte),
+	}
+
+	k.txns[t] = struct{}{}
+	return t
+}
+
+// Get retrieves the value of a key as of the start of the transaction, or as last written by the
+// transaction itself. If the key does not exist, then nil is returned.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	if value, ok := t.writes[string(key)]; ok {
+		return value, nil
+	}
+
+	t.reads[string(key)] = struct{}{}
+
+	t.k.mtx.RLock()
+	defer t.k.mtx.RUnlock()
+
+	v, found := t.k.entries.Search(key)
+	if !found {
+		return nil, nil
+	}
+
+	entry := v.(*data.Entry)
+	for entry != nil && entry.Seq > t.seq {
+		entry = entry.Prev
+	}
+
+	if entry == nil || entry.ValueSize == -1 || entry.Expired(time.Now().UnixNano()) {
+		return nil, nil
+	}
+
+	// The entry may have been moved to a new data file by a merge since the transaction started.
+	seg, ok := t.k.segments[entry.FileID]
+	if !ok {
+		if seg, ok = t.segments[entry.FileID]; !ok {
+			return nil, fmt.Errorf("data file %d does not exist", entry.FileID)
+		}
+	}
+
+	return data.ReadValueAt(seg.file, seg.version, key, entry.ValuePos, entry.ValueSize)
+}
+
+// Set buffers the insertion of a key-value pair.
+func (t *Txn) Set(key []byte, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+
+	t.writes[string(key)] = value
+	t.batch.Set(key, value)
+	return nil
+}
+
+// Delete buffers the removal of a key.
+func (t *Txn) Delete(key []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.writes[string(key)] = nil
+	t.batch.Delete(key)
+	return nil
+}
+
+// Commit applies the writes of the transaction. If any key read by the transaction has been
+// modified since the transaction started, then none of the writes are applied and ErrConflict
+// is returned.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	k := t.k
+	k.mtx.Lock()
+
+	var seq uint64
+	var err error
+	if t.batch.Len() > 0 {
+		if t.conflicts() {
+			err = ErrConflict
+		} else {
+			seq, err = k.writeBatch(&t.batch)
+		}
+	}
+
+	k.mtx.Unlock()
+
+	if err == nil {
+		err = k.waitSync(seq)
+	}
+
+	if finishErr := t.finish(); err == nil {
+		err = finishErr
+	}
+
+	return err
+}
+
+// Rollback discards the writes of the transaction.
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	return t.finish()
+}
+
+// conflicts reports whether any key read by the transaction has been written since it started.
+// It must be called with the write lock held.
+func (t *Txn) conflicts() bool {
+	for key := range t.reads {
+		v, found := t.k.entries.Search([]byte(key))
+		if found && v.(*data.Entry).Seq > t.seq {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finish ends the transaction and releases its snapshot.
+func (t *Txn) finish() error {
+	t.done = true
+
+	t.k.mtx.Lock()
+	delete(t.k.txns, t)
+	t.k.mtx.Unlock()
+
+	return t.k.releaseSegments(t.segments)
+}
+
+// pin keeps a data file that is being retired open until the transaction finishes, since the
+// previous versions of keys in the transaction's snapshot may still refer to it. It must be
+// called with the write lock held.
+func (t *Txn) pin(seg *segment) {
+	if _, ok := t.segments[seg.id]; ok {
+		return
+	}
+
+	atomic.AddInt32(&seg.refs, 1)
+	t.segments[seg.id] = seg
+}
+
+// oldestSnapshot returns the sequence number of the oldest snapshot of the transactions in
+// progress. It must be called with the lock held.
+func (k *Keychain) oldestSnapshot() uint64 {
+	oldest := k.counter
+	for t := range k.txns {
+		if t.seq < oldest {
+			oldest = t.seq
+		}
+	}
+
+	return oldest
+}
+
+// pruneVersions discards the versions of a key that are older than the newest version visible
+// to the snapshot with the specified sequence number, since no snapshot can see them.
+func pruneVersions(entry *data.Entry, seq uint64) {
+	for ; entry != nil; entry = entry.Prev {
+		if entry.Seq <= seq {
+			entry.Prev = nil
+			return
+		}
+	}
+}
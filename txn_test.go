@@ -0,0 +1,97 @@
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func txnGetAndExpect(txn *Txn, key []byte, expected []byte, t *testing.T) {
+	value, err := txn.Get(key)
+	if err != nil {
+		t.Fatalf("failed getting value: %v", err)
+	}
+
+	if string(expected) != string(value) || (expected == nil) != (value == nil) {
+		t.Fatalf("incorrect value: expected =%s, got =%s", expected, value)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	name, err := ioutil.TempDir("", "keychain-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	defer os.RemoveAll(name)
+
+	keys, err := OpenConf(name, &Conf{MaxFileSize: 128})
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer keys.Close()
+
+	set(keys, []byte("a"), []byte("1"), t)
+	set(keys, []byte("b"), []byte("2"), t)
+
+	// Reads see a snapshot, even after the key is overwritten, removed and merged.
+	txn := keys.Begin()
+	txnGetAndExpect(txn, []byte("a"), []byte("1"), t)
+
+	set(keys, []byte("a"), []byte("10"), t)
+	remove(keys, []byte("b"), t)
+	set(keys, []byte("c"), []byte("3"), t)
+	if err := keys.Merge(); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	txnGetAndExpect(txn, []byte("a"), []byte("1"), t)
+	txnGetAndExpect(txn, []byte("b"), []byte("2"), t)
+	txnGetAndExpect(txn, []byte("c"), nil, t)
+
+	// Writes are visible to the transaction, but not to the store until commit.
+	if err := txn.Set([]byte("d"), []byte("4")); err != nil {
+		t.Fatalf("failed setting value: %v", err)
+	}
+	txnGetAndExpect(txn, []byte("d"), []byte("4"), t)
+	getAndExpect(keys, []byte("d"), nil, t)
+
+	// The transaction read a key that has been modified since it started.
+	if err := txn.Commit(); err != ErrConflict {
+		t.Fatalf("expected ErrConflict, got=%v", err)
+	}
+	getAndExpect(keys, []byte("d"), nil, t)
+
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Fatalf("expected ErrTxnDone, got=%v", err)
+	}
+
+	// A transaction whose reads are unchanged commits all of its writes.
+	txn = keys.Begin()
+	txnGetAndExpect(txn, []byte("a"), []byte("10"), t)
+	set(keys, []byte("c"), []byte("30"), t)
+
+	if err := txn.Set([]byte("a"), []byte("11")); err != nil {
+		t.Fatalf("failed setting value: %v", err)
+	}
+	if err := txn.Delete([]byte("c")); err != nil {
+		t.Fatalf("failed deleting value: %v", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	getAndExpect(keys, []byte("a"), []byte("11"), t)
+	getAndExpect(keys, []byte("c"), nil, t)
+
+	// Rolled back writes are discarded.
+	txn = keys.Begin()
+	if err := txn.Set([]byte("a"), []byte("12")); err != nil {
+		t.Fatalf("failed setting value: %v", err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	getAndExpect(keys, []byte("a"), []byte("11"), t)
+}